@@ -2,8 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"time"
+
+	"lenslocked.com/email"
+	"lenslocked.com/hash"
+	"lenslocked.com/models"
+	"lenslocked.com/sso"
 )
 
 type PostgresConfig struct {
@@ -37,25 +45,234 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+// MailerConfig decides how we deliver emails. Provider
+// can be "smtp" to deliver emails for real, or "log" or
+// "file" to just print them out or write them to Dir while
+// developing.
+type MailerConfig struct {
+	Provider  string `json:"provider"`
+	FromName  string `json:"from_name"`
+	FromEmail string `json:"from_email"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Dir       string `json:"dir"`
+}
+
+// Mailer builds the email.Mailer described by the config.
+func (c MailerConfig) Mailer() email.Mailer {
+	switch c.Provider {
+	case "smtp":
+		return email.SMTPMailer{
+			Host:     c.Host,
+			Port:     c.Port,
+			Username: c.Username,
+			Password: c.Password,
+		}
+	case "file":
+		dir := c.Dir
+		if dir == "" {
+			dir = "emails"
+		}
+		return email.FileMailer{Dir: dir}
+	default:
+		return email.LogMailer{}
+	}
+}
+
+func DefaultMailerConfig() MailerConfig {
+	return MailerConfig{
+		Provider:  "log",
+		FromName:  "LensLocked Support",
+		FromEmail: "support@lenslocked.com",
+	}
+}
+
+// PasswordConfig decides how we hash passwords. Algorithm
+// can be "argon2id" or "bcrypt". Passwords hashed with the
+// other algorithm, or with weaker settings, are rehashed the
+// next time the user logs in.
+type PasswordConfig struct {
+	Algorithm     string `json:"algorithm"`
+	BcryptCost    int    `json:"bcrypt_cost"`
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+}
+
+// Passwords builds the hash.Passwords described by the config.
+func (c PasswordConfig) Passwords() *hash.Passwords {
+	bc := hash.Bcrypt{Cost: c.BcryptCost}
+	a2 := hash.DefaultArgon2id()
+	if c.Argon2Time > 0 {
+		a2.Time = c.Argon2Time
+	}
+	if c.Argon2Memory > 0 {
+		a2.Memory = c.Argon2Memory
+	}
+	if c.Argon2Threads > 0 {
+		a2.Threads = c.Argon2Threads
+	}
+	switch c.Algorithm {
+	case "bcrypt":
+		return hash.NewPasswords(bc, a2)
+	default:
+		return hash.NewPasswords(a2, bc)
+	}
+}
+
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		Algorithm: "argon2id",
+	}
+}
+
+// SessionConfig decides how long users stay signed in. Each
+// value is a duration such as "30m" or "720h", and any that
+// are left out fall back to models.DefaultSessionLifetime.
+type SessionConfig struct {
+	IdleTimeout         string `json:"idle_timeout"`
+	RememberIdleTimeout string `json:"remember_idle_timeout"`
+	MaxAge              string `json:"max_age"`
+}
+
+// Lifetime parses the config into a models.SessionLifetime.
+func (c SessionConfig) Lifetime() (models.SessionLifetime, error) {
+	lifetime := models.DefaultSessionLifetime()
+	fields := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"idle_timeout", c.IdleTimeout, &lifetime.Idle},
+		{"remember_idle_timeout", c.RememberIdleTimeout, &lifetime.RememberIdle},
+		{"max_age", c.MaxAge, &lifetime.MaxAge},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return lifetime, fmt.Errorf("session %s: %v", f.name, err)
+		}
+		*f.dst = d
+	}
+	return lifetime, nil
+}
+
+// RegistrationConfig decides who can sign up. Mode can be
+// "open", "invite" to require an invite code, or "domains" to
+// only let people with an email address at one of
+// AllowedDomains sign up.
+type RegistrationConfig struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowed_domains"`
+}
+
+// Policy turns the config into a models.RegistrationPolicy.
+func (c RegistrationConfig) Policy() (models.RegistrationPolicy, error) {
+	policy := models.RegistrationPolicy{
+		Mode:           models.RegistrationMode(c.Mode),
+		AllowedDomains: c.AllowedDomains,
+	}
+	if policy.Mode == "" {
+		policy.Mode = models.RegistrationOpen
+	}
+	return policy, policy.Validate()
+}
+
+func DefaultRegistrationConfig() RegistrationConfig {
+	return RegistrationConfig{
+		Mode: string(models.RegistrationOpen),
+	}
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		IdleTimeout:         "30m",
+		RememberIdleTimeout: "336h",
+		MaxAge:              "720h",
+	}
+}
+
+// Config is our app's configuration. Peppers and HMACKeys
+// are versioned so that they can be rotated: add a new key,
+// make it active, and keep the old one around until nothing
+// depends on it anymore. The single Pepper and HMACKey
+// fields are still supported for configs written before we
+// could rotate keys.
 type Config struct {
-	Port     int            `json:"port"`
-	Env      string         `json:"env"`
-	Pepper   string         `json:"pepper"`
-	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
+	Port         int                  `json:"port"`
+	Env          string               `json:"env"`
+	BaseURL      string               `json:"base_url"`
+	Pepper       string               `json:"pepper"`
+	HMACKey      string               `json:"hmac_key"`
+	Peppers      hash.KeySet          `json:"peppers"`
+	HMACKeys     hash.KeySet          `json:"hmac_keys"`
+	Password     PasswordConfig       `json:"password"`
+	Session      SessionConfig        `json:"session"`
+	Registration RegistrationConfig   `json:"registration"`
+	OIDC         []sso.ProviderConfig `json:"oidc"`
+	Database     PostgresConfig       `json:"database"`
+	Mailer       MailerConfig         `json:"mailer"`
 }
 
 func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+// PepperKeys returns the configured peppers, falling back
+// to the single legacy pepper if there aren't any.
+func (c Config) PepperKeys() hash.KeySet {
+	if len(c.Peppers.Keys) == 0 {
+		return hash.SingleKey(c.Pepper)
+	}
+	return c.Peppers
+}
+
+// HMACKeySet returns the configured HMAC keys, falling back
+// to the single legacy HMAC key if there aren't any.
+func (c Config) HMACKeySet() hash.KeySet {
+	if len(c.HMACKeys.Keys) == 0 {
+		return hash.SingleKey(c.HMACKey)
+	}
+	return c.HMACKeys
+}
+
+// Providers builds an sso.Provider for each of the OpenID
+// Connect providers in the config. Each provider needs a
+// unique name, as it is used in the provider's URLs.
+func (c Config) Providers() ([]*sso.Provider, error) {
+	providers := make([]*sso.Provider, 0, len(c.OIDC))
+	seen := make(map[string]bool)
+	for _, pc := range c.OIDC {
+		if pc.Name == "" || seen[pc.Name] {
+			return nil, fmt.Errorf("oidc: provider names must be unique and not empty, got %q", pc.Name)
+		}
+		seen[pc.Name] = true
+		if pc.DisplayName == "" {
+			pc.DisplayName = pc.Name
+		}
+		redirectURL := c.BaseURL + "/auth/" + url.PathEscape(pc.Name) + "/callback"
+		providers = append(providers, sso.NewProvider(pc, redirectURL))
+	}
+	return providers, nil
+}
+
 func DefaultConfig() Config {
 	return Config{
-		Port:     3000,
-		Env:      "dev",
-		Pepper:   "I-like-cheese",
-		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
+		Port:         3000,
+		Env:          "dev",
+		BaseURL:      "http://localhost:3000",
+		Peppers:      hash.SingleKey("I-like-cheese"),
+		HMACKeys:     hash.SingleKey("secret-hmac-key"),
+		Password:     DefaultPasswordConfig(),
+		Session:      DefaultSessionConfig(),
+		Registration: DefaultRegistrationConfig(),
+		Database:     DefaultPostgresConfig(),
+		Mailer:       DefaultMailerConfig(),
 	}
 }
 
@@ -74,6 +291,17 @@ func LoadConfig(configReq bool) Config {
 	if err != nil {
 		panic(err)
 	}
+	// Links in emails are built from the base URL, and they
+	// wouldn't work without it.
+	if c.BaseURL == "" {
+		panic(errors.New("base_url: must be set, eg https://lenslocked.com"))
+	}
+	if err := c.PepperKeys().Validate(); err != nil {
+		panic(fmt.Errorf("peppers: %v", err))
+	}
+	if err := c.HMACKeySet().Validate(); err != nil {
+		panic(fmt.Errorf("hmac_keys: %v", err))
+	}
 	fmt.Println("Successfully loaded .config")
 	return c
 }
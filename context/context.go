@@ -7,7 +7,9 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+	tokenKey   privateKey = "api_token"
 )
 
 type privateKey string
@@ -24,3 +26,34 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession stores the session the current user signed
+// in with, which lets us tell it apart from their others.
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithAPIToken stores the API token the current user
+// authenticated with. It is only set for requests made with
+// a token rather than a browser session.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	if temp := ctx.Value(tokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+// adminSearchLimit is the most results we show on one admin
+// page. Anything past it can be found by searching.
+const adminSearchLimit = 50
+
+func NewAdmin(us models.UserService, ss models.SessionService, gs models.GalleryService, as models.AuditService, co cookies.Options) *Admin {
+	return &Admin{
+		UsersView:     views.NewView("bootstrap", "admin/users", "admin/nav"),
+		GalleriesView: views.NewView("bootstrap", "admin/galleries", "admin/nav"),
+		AuditView:     views.NewView("bootstrap", "admin/audit", "admin/nav", "audit/events"),
+		us:            us,
+		ss:            ss,
+		gs:            gs,
+		as:            as,
+		cookies:       co,
+	}
+}
+
+// Admin lets moderators and admins look after users and
+// galleries. What each of them can do is decided by the
+// policy package, and the routes are expected to be behind
+// RequireRole.
+type Admin struct {
+	UsersView     *views.View
+	GalleriesView *views.View
+	AuditView     *views.View
+	us            models.UserService
+	ss            models.SessionService
+	gs            models.GalleryService
+	as            models.AuditService
+	cookies       cookies.Options
+}
+
+// SearchForm is used to search the admin pages.
+type SearchForm struct {
+	Query string `schema:"q"`
+}
+
+// AdminNav is used to render the tabs at the top of every
+// admin page. Only admins can see the audit log.
+type AdminNav struct {
+	Tab       string
+	ShowAudit bool
+}
+
+func adminNav(r *http.Request, tab string) AdminNav {
+	return AdminNav{
+		Tab:       tab,
+		ShowAudit: policy.CanViewAuditLog(context.User(r.Context())),
+	}
+}
+
+// AdminUsersView is used to render the users page.
+type AdminUsersView struct {
+	AdminNav
+	Query string
+	Users []AdminUserView
+}
+
+// AdminUserView is used to render a user on the users page,
+// along with what the current user can do to them. Roles
+// lists the roles they can be given, if any.
+type AdminUserView struct {
+	models.User
+	Roles          []models.Role
+	CanSuspend     bool
+	CanChangeRole  bool
+	CanImpersonate bool
+}
+
+// Users lists users, or the ones matching the search.
+//
+// GET /admin/users
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form SearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.UsersView.Render(w, r, vd)
+		return
+	}
+	actor := context.User(r.Context())
+	users, err := a.us.Search(form.Query, adminSearchLimit)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	auv := AdminUsersView{
+		AdminNav: adminNav(r, "users"),
+		Query:    form.Query,
+		Users:    make([]AdminUserView, len(users)),
+	}
+	for i := range users {
+		auv.Users[i] = AdminUserView{
+			User:           users[i],
+			CanSuspend:     policy.CanSuspend(actor, &users[i]),
+			CanChangeRole:  policy.CanChangeRole(actor, &users[i]),
+			CanImpersonate: policy.CanImpersonate(actor, &users[i]),
+		}
+		if auv.Users[i].CanChangeRole {
+			auv.Users[i].Roles = models.Roles
+		}
+	}
+	vd.Yield = auv
+	a.UsersView.Render(w, r, vd)
+}
+
+// Suspend stops a user from signing in, and signs them out
+// everywhere they already are.
+//
+// POST /admin/users/:id/suspend
+func (a *Admin) Suspend(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.targetUser(w, r, policy.CanSuspend)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	target.SuspendedAt = &now
+	if err := a.us.Update(target); err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return
+	}
+	a.as.Record(auditEvent(r, models.AuditUserSuspended, models.AuditTargetUser, target.ID))
+	if err := a.ss.DeleteByUserID(target.ID); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/admin/users", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: target.Email + " has been suspended and signed out everywhere.",
+	})
+}
+
+// Unsuspend lets a suspended user sign in again.
+//
+// POST /admin/users/:id/unsuspend
+func (a *Admin) Unsuspend(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.targetUser(w, r, policy.CanSuspend)
+	if !ok {
+		return
+	}
+	target.SuspendedAt = nil
+	if err := a.us.Update(target); err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return
+	}
+	a.as.Record(auditEvent(r, models.AuditUserUnsuspended, models.AuditTargetUser, target.ID))
+	views.RedirectAlert(w, r, "/admin/users", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: target.Email + " can sign in again.",
+	})
+}
+
+// RoleForm is used to change a user's role.
+type RoleForm struct {
+	Role models.Role `schema:"role"`
+}
+
+// ChangeRole gives a user a different role.
+//
+// POST /admin/users/:id/role
+func (a *Admin) ChangeRole(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.targetUser(w, r, policy.CanChangeRole)
+	if !ok {
+		return
+	}
+	var form RoleForm
+	if err := parseForm(r, &form); err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return
+	}
+	oldRole := target.Role
+	target.Role = form.Role
+	if err := a.us.Update(target); err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return
+	}
+	event := auditEvent(r, models.AuditRoleChanged, models.AuditTargetUser, target.ID)
+	event.Details = string(oldRole) + " to " + string(target.Role)
+	a.as.Record(event)
+	views.RedirectAlert(w, r, "/admin/users", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: target.Email + "'s role is now " + target.Role.Title() + ".",
+	})
+}
+
+// Impersonate signs the admin in as another user, so they
+// can see what that user sees. The admin's own session is
+// left alone and its token is kept in a cookie, so that
+// StopImpersonating can switch back to it.
+//
+// POST /admin/users/:id/impersonate
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.targetUser(w, r, policy.CanImpersonate)
+	if !ok {
+		return
+	}
+	cookie, err := r.Cookie(cookies.RememberToken)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	actor := context.User(r.Context())
+	session := models.Session{
+		UserID:         target.ID,
+		ImpersonatorID: actor.ID,
+		UserAgent:      r.UserAgent(),
+		IP:             clientIP(r),
+	}
+	if err := a.ss.Create(&session); err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return
+	}
+	a.as.Record(auditEvent(r, models.AuditImpersonationStarted, models.AuditTargetUser, target.ID))
+	a.cookies.Set(w, cookies.Impersonator, cookie.Value, time.Time{})
+	a.cookies.Set(w, cookies.RememberToken, session.Remember, time.Time{})
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: "You are now signed in as " + target.Email + ".",
+	})
+}
+
+// StopImpersonating signs the admin back in as themselves.
+// It isn't behind RequireRole, as the current user is the
+// one being impersonated.
+//
+// POST /admin/impersonate/stop
+func (a *Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	current := context.Session(r.Context())
+	if current == nil || !current.Impersonated() {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := a.ss.Delete(current.ID); err != nil {
+		log.Println(err)
+	}
+	// The admin is the one who stopped, not the user they
+	// were signed in as.
+	event := auditEvent(r, models.AuditImpersonationStopped, models.AuditTargetUser, current.UserID)
+	event.ActorID = current.ImpersonatorID
+	event.ImpersonatorID = 0
+	a.as.Record(event)
+	a.cookies.Clear(w, cookies.RememberToken)
+	cookie, err := r.Cookie(cookies.Impersonator)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	a.cookies.Clear(w, cookies.Impersonator)
+	// The admin's session may have expired or been signed out
+	// while they were impersonating, in which case they need
+	// to log in again.
+	session, err := a.ss.ByRemember(cookie.Value)
+	if err != nil || session.UserID != current.ImpersonatorID {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	var expires time.Time
+	if session.Persistent {
+		expires = session.IdleExpiresAt
+	}
+	a.cookies.Set(w, cookies.RememberToken, cookie.Value, expires)
+	views.RedirectAlert(w, r, "/admin/users", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: "You are signed in as yourself again.",
+	})
+}
+
+// AdminGalleryView is used to render a gallery on the
+// galleries page along with its owner.
+type AdminGalleryView struct {
+	models.Gallery
+	Owner *models.User
+}
+
+// AdminGalleriesView is used to render the galleries page.
+type AdminGalleriesView struct {
+	AdminNav
+	Query     string
+	Galleries []AdminGalleryView
+}
+
+// Galleries lists the newest galleries, or the ones
+// matching the search, so they can be moderated.
+//
+// GET /admin/galleries
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form SearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.GalleriesView.Render(w, r, vd)
+		return
+	}
+	galleries, err := a.gs.Search(form.Query, adminSearchLimit)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	agv := AdminGalleriesView{
+		AdminNav:  adminNav(r, "galleries"),
+		Query:     form.Query,
+		Galleries: make([]AdminGalleryView, len(galleries)),
+	}
+	owners := make(map[uint]*models.User)
+	for i, gallery := range galleries {
+		owner, ok := owners[gallery.UserID]
+		if !ok {
+			// A missing owner shouldn't stop the rest of the
+			// page from rendering.
+			owner, _ = a.us.ByID(gallery.UserID)
+			owners[gallery.UserID] = owner
+		}
+		agv.Galleries[i] = AdminGalleryView{
+			Gallery: gallery,
+			Owner:   owner,
+		}
+	}
+	vd.Yield = agv
+	a.GalleriesView.Render(w, r, vd)
+}
+
+// DeleteGallery takes down a gallery.
+//
+// POST /admin/galleries/:id/delete
+func (a *Admin) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return
+	}
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		a.failed(w, r, "/admin/galleries", err)
+		return
+	}
+	if !policy.CanDeleteGallery(context.User(r.Context()), gallery) {
+		http.Error(w, "You do not have permission to delete this gallery", http.StatusForbidden)
+		return
+	}
+	if err := a.gs.Delete(gallery.ID); err != nil {
+		a.failed(w, r, "/admin/galleries", err)
+		return
+	}
+	a.as.Record(auditEvent(r, models.AuditGalleryDeleted, models.AuditTargetGallery, gallery.ID))
+	views.RedirectAlert(w, r, "/admin/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: `"` + gallery.Title + `" has been taken down.`,
+	})
+}
+
+// AuditForm is used to filter the audit log. Since and Until
+// are dates, and Until includes the whole day.
+type AuditForm struct {
+	Email  string `schema:"email"`
+	Action string `schema:"action"`
+	Since  string `schema:"since"`
+	Until  string `schema:"until"`
+}
+
+// AdminAuditView is used to render the audit log.
+type AdminAuditView struct {
+	AdminNav
+	AuditForm
+	Actions []AuditActionOption
+	Events  []AuditEventView
+}
+
+// AuditActionOption is used to render an action in the audit
+// log's filter.
+type AuditActionOption struct {
+	Action string
+	Title  string
+}
+
+// auditDateFormat is the format dates are entered in when
+// filtering the audit log, as used by date inputs.
+const auditDateFormat = "2006-01-02"
+
+// Audit lists the most recent audit events, or the ones
+// matching the filter.
+//
+// GET /admin/audit
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	aav := AdminAuditView{
+		AdminNav: adminNav(r, "audit"),
+		Actions:  make([]AuditActionOption, len(models.AuditActions)),
+	}
+	for i, action := range models.AuditActions {
+		aav.Actions[i] = AuditActionOption{action, models.AuditTitle(action)}
+	}
+	vd.Yield = &aav
+	if err := parseURLParams(r, &aav.AuditForm); err != nil {
+		vd.SetAlert(err)
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+	filter := models.AuditFilter{
+		Action: aav.Action,
+		Limit:  adminSearchLimit,
+	}
+	var err error
+	filter.Since, filter.Until, err = auditDates(aav.Since, aav.Until)
+	if err != nil {
+		vd.AlertError("Dates must look like " + auditDateFormat + ".")
+		a.AuditView.Render(w, r, vd)
+		return
+	}
+	// An email address that doesn't belong to anybody is an
+	// error, rather than quietly showing everyone's events.
+	if strings.TrimSpace(aav.Email) != "" {
+		user, err := a.us.ByEmail(aav.Email)
+		if err != nil {
+			vd.SetAlert(err)
+			a.AuditView.Render(w, r, vd)
+			return
+		}
+		filter.UserID = user.ID
+	}
+	events, err := a.as.Search(filter)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	aav.Events = auditEventViews(a.us, events)
+	a.AuditView.Render(w, r, vd)
+}
+
+// auditDates parses the dates used to filter the audit log.
+// Until is moved to the start of the next day, so that the
+// day itself is included. Blank dates are left as zero.
+func auditDates(sinceStr, untilStr string) (since, until time.Time, err error) {
+	if sinceStr != "" {
+		since, err = time.ParseInLocation(auditDateFormat, sinceStr, time.Local)
+		if err != nil {
+			return since, until, err
+		}
+	}
+	if untilStr != "" {
+		until, err = time.ParseInLocation(auditDateFormat, untilStr, time.Local)
+		if err != nil {
+			return since, until, err
+		}
+		until = until.AddDate(0, 0, 1)
+	}
+	return since, until, nil
+}
+
+// targetUser looks up the user the request is about, and
+// makes sure the current user is allowed to do it to them.
+// If they aren't, or the user doesn't exist, a response is
+// written and ok is false.
+func (a *Admin) targetUser(w http.ResponseWriter, r *http.Request, allowed func(actor, target *models.User) bool) (target *models.User, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return nil, false
+	}
+	target, err = a.us.ByID(uint(id))
+	if err != nil {
+		a.failed(w, r, "/admin/users", err)
+		return nil, false
+	}
+	if !allowed(context.User(r.Context()), target) {
+		http.Error(w, "You do not have permission to do that", http.StatusForbidden)
+		return nil, false
+	}
+	return target, true
+}
+
+// failed redirects the user with an alert for err, which is
+// only shown to them if it is a public error.
+func (a *Admin) failed(w http.ResponseWriter, r *http.Request, urlStr string, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, *vd.Alert)
+}
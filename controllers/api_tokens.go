@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func NewAPITokens(ats models.APITokenService, as models.AuditService) *APITokens {
+	return &APITokens{
+		IndexView: views.NewView("bootstrap", "api_tokens/index"),
+		ats:       ats,
+		as:        as,
+	}
+}
+
+// APITokens lets users create and revoke the tokens their
+// scripts use to act on their behalf.
+type APITokens struct {
+	IndexView *views.View
+	ats       models.APITokenService
+	as        models.AuditService
+}
+
+// APITokensView is used to render the API tokens page. Created
+// is only set right after a token is created, as it is the
+// only time we have the token itself to show.
+type APITokensView struct {
+	Tokens  []models.APIToken
+	Scopes  []models.Scope
+	Created *models.APIToken
+}
+
+// APITokenForm is used to create an API token. ExpiresIn is a
+// number of days, and 0 means the token never expires.
+type APITokenForm struct {
+	Name      string         `schema:"name"`
+	Scopes    []models.Scope `schema:"scopes"`
+	ExpiresIn int            `schema:"expires_in"`
+}
+
+// GET /account/tokens
+func (a *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	a.render(w, r, views.Data{}, nil)
+}
+
+// Create creates an API token and shows it to the user. We
+// render the page rather than redirect, as the token can't be
+// shown again once they leave it.
+//
+// POST /account/tokens
+func (a *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd, nil)
+		return
+	}
+	user := context.User(r.Context())
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+	}
+	token.SetScopes(form.Scopes)
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := a.ats.Create(&token); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd, nil)
+		return
+	}
+	event := auditEvent(r, models.AuditAPITokenCreated, models.AuditTargetAPIToken, token.ID)
+	event.Details = token.Name
+	a.as.Record(event)
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your token has been created. Make sure to copy it now, as you won't be able to see it again.",
+	}
+	a.render(w, r, vd, &token)
+}
+
+// Delete revokes one of the user's API tokens.
+//
+// POST /account/tokens/:id/delete
+func (a *APITokens) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	tokens, err := a.ats.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Only tokens belonging to the current user can be
+	// revoked, so we look for it amongst theirs rather than
+	// trusting the ID on its own.
+	var found *models.APIToken
+	for i := range tokens {
+		if tokens[i].ID == uint(id) {
+			found = &tokens[i]
+		}
+	}
+	if found == nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err := a.ats.Delete(found.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account/tokens", http.StatusFound, *vd.Alert)
+		return
+	}
+	event := auditEvent(r, models.AuditAPITokenRevoked, models.AuditTargetAPIToken, found.ID)
+	event.Details = found.Name
+	a.as.Record(event)
+	views.RedirectAlert(w, r, "/account/tokens", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The token has been revoked.",
+	})
+}
+
+func (a *APITokens) render(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.APIToken) {
+	user := context.User(r.Context())
+	tokens, err := a.ats.ByUserID(user.ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = APITokensView{
+		Tokens:  tokens,
+		Scopes:  models.Scopes,
+		Created: created,
+	}
+	a.IndexView.Render(w, r, vd)
+}
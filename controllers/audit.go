@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// securityHistoryLimit is how many of their most recent audit
+// events users can see.
+const securityHistoryLimit = 100
+
+func NewAudit(as models.AuditService, us models.UserService) *Audit {
+	return &Audit{
+		IndexView: views.NewView("bootstrap", "audit/index", "audit/events"),
+		as:        as,
+		us:        us,
+	}
+}
+
+// Audit lets users look through their own security history,
+// eg to spot sign ins they don't recognize.
+type Audit struct {
+	IndexView *views.View
+	as        models.AuditService
+	us        models.UserService
+}
+
+// AuditEventView is used to render an audit event along with
+// the users it mentions. Any of them can be nil, either
+// because the event doesn't have one or because the user has
+// since been purged.
+type AuditEventView struct {
+	models.AuditEvent
+	Actor        *models.User
+	Impersonator *models.User
+	Target       *models.User
+}
+
+// GET /account/security
+func (a *Audit) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	events, err := a.as.ForUser(user.ID, securityHistoryLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = auditEventViews(a.us, events)
+	a.IndexView.Render(w, r, vd)
+}
+
+// auditEventViews looks up the users mentioned by each event.
+// Each user is only looked up once, as the same few people
+// tend to show up over and over.
+func auditEventViews(us models.UserService, events []models.AuditEvent) []AuditEventView {
+	users := make(map[uint]*models.User)
+	lookup := func(id uint) *models.User {
+		if id == 0 {
+			return nil
+		}
+		user, ok := users[id]
+		if !ok {
+			// A missing user shouldn't stop the rest of the
+			// page from rendering.
+			user, _ = us.ByID(id)
+			users[id] = user
+		}
+		return user
+	}
+	aevs := make([]AuditEventView, len(events))
+	for i, event := range events {
+		aevs[i] = AuditEventView{
+			AuditEvent:   event,
+			Actor:        lookup(event.ActorID),
+			Impersonator: lookup(event.ImpersonatorID),
+		}
+		if event.TargetType == models.AuditTargetUser {
+			aevs[i].Target = lookup(event.TargetID)
+		}
+	}
+	return aevs
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func NewAvatars(us models.UserService, is models.ImageService) *Avatars {
+	return &Avatars{
+		us: us,
+		is: is,
+	}
+}
+
+// Avatars lets users upload and remove the picture shown on
+// their profile and in the navbar. Both forms are on the
+// account page, which is where we send users back to.
+type Avatars struct {
+	us models.UserService
+	is models.ImageService
+}
+
+// POST /account/avatar
+func (a *Avatars) Upload(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxAvatarBytes+maxMultipartMem)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		a.failed(w, r, models.ErrAvatarTooLarge)
+		return
+	}
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		a.failed(w, r, models.ErrAvatarType)
+		return
+	}
+	defer file.Close()
+	if err := a.is.CreateAvatar(user.ID, file); err != nil {
+		a.failed(w, r, err)
+		return
+	}
+	changed := *user
+	now := time.Now()
+	changed.AvatarUpdatedAt = &now
+	if err := a.us.Update(&changed); err != nil {
+		a.failed(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your picture has been updated.",
+	})
+}
+
+// POST /account/avatar/delete
+func (a *Avatars) Delete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	changed := *user
+	changed.AvatarUpdatedAt = nil
+	if err := a.us.Update(&changed); err != nil {
+		a.failed(w, r, err)
+		return
+	}
+	// The user no longer points at the files, so failing to
+	// delete them only wastes a little disk space.
+	if err := a.is.DeleteAvatar(user.ID); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your picture has been removed.",
+	})
+}
+
+// failed redirects the user back to the account page with an
+// alert for err, which is only shown to them if it is a
+// public error.
+func (a *Avatars) failed(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, "/account", http.StatusFound, *vd.Alert)
+}
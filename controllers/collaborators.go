@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+// CollaboratorView is used to render a collaborator along with
+// the user who accepted the invitation, which is nil until
+// somebody has.
+type CollaboratorView struct {
+	models.Collaborator
+	User *models.User
+}
+
+// InvitationView is used to render an invitation to a gallery
+// that the user hasn't accepted yet, along with the gallery
+// and who invited them.
+type InvitationView struct {
+	models.Collaborator
+	Gallery   *models.Gallery
+	InvitedBy *models.User
+}
+
+// CollaboratorForm is used to invite somebody to a gallery,
+// and to change the role of somebody who already has been.
+type CollaboratorForm struct {
+	Email string                  `schema:"email"`
+	Role  models.CollaboratorRole `schema:"role"`
+}
+
+// InviteCollaborator shares the gallery with somebody by
+// emailing them an invitation. They don't need to have signed
+// up yet, but they need to sign up with the same email
+// address to accept it.
+//
+// POST /galleries/:id/collaborators
+func (g *Galleries) InviteCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !policy.CanEditGallery(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var form CollaboratorForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	owner, err := g.us.ByID(gallery.UserID)
+	if err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	collaborator := models.Collaborator{
+		GalleryID:   gallery.ID,
+		Email:       form.Email,
+		Role:        form.Role,
+		InvitedByID: user.ID,
+	}
+	if owner.Email == strings.ToLower(strings.TrimSpace(form.Email)) {
+		g.renderEditAlert(w, r, gallery, models.ErrCollaboratorIsOwner)
+		return
+	}
+	if err := g.cs.Create(&collaborator); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	event := auditEvent(r, models.AuditCollaboratorInvited, models.AuditTargetGallery, gallery.ID)
+	event.Details = collaborator.Email + " as " + collaborator.Role.Title()
+	g.as.Record(event)
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "An invitation has been emailed to " + collaborator.Email + ".",
+	}
+	err = g.emailer.CollaboratorInvite(collaborator.Email, inviterName(user), gallery.Title, collaborator.Role.Title())
+	if err != nil {
+		log.Println(err)
+		alert = views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "We couldn't email the invitation, but " + collaborator.Email + " can still accept it from their galleries page.",
+		}
+	}
+	g.redirectEdit(w, r, gallery, alert)
+}
+
+// POST /galleries/:id/collaborators/:collaboratorID/role
+func (g *Galleries) UpdateCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !policy.CanEditGallery(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	collaborator := collaboratorByID(w, r, gallery)
+	if collaborator == nil {
+		return
+	}
+	var form CollaboratorForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	old := collaborator.Role
+	collaborator.Role = form.Role
+	if err := g.cs.Update(collaborator); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	event := auditEvent(r, models.AuditCollaboratorRoleChanged, models.AuditTargetGallery, gallery.ID)
+	event.Details = collaborator.Email + " from " + old.Title() + " to " + collaborator.Role.Title()
+	g.as.Record(event)
+	g.redirectEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: collaborator.Email + " is now a " + collaborator.Role.Title() + ".",
+	})
+}
+
+// RemoveCollaborator stops sharing the gallery with somebody,
+// or cancels their invitation if they haven't accepted it
+// yet. Collaborators can also use it to leave a gallery.
+//
+// POST /galleries/:id/collaborators/:collaboratorID/delete
+func (g *Galleries) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !policy.IsGalleryMember(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	collaborator := collaboratorByID(w, r, gallery)
+	if collaborator == nil {
+		return
+	}
+	leaving := collaborator.Accepted() && collaborator.UserID == user.ID
+	if !leaving && !policy.CanEditGallery(user, gallery) {
+		http.Error(w, "You do not have permission to remove collaborators", http.StatusForbidden)
+		return
+	}
+	if err := g.cs.Delete(collaborator.ID); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	event := auditEvent(r, models.AuditCollaboratorRemoved, models.AuditTargetGallery, gallery.ID)
+	event.Details = collaborator.Email
+	g.as.Record(event)
+	if leaving {
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "You have left " + gallery.Title + ".",
+		})
+		return
+	}
+	g.redirectEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: collaborator.Email + " has been removed from this gallery.",
+	})
+}
+
+// POST /galleries/invitations/:id/accept
+func (g *Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	collaborator, err := g.cs.Accept(uint(id), user)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, *vd.Alert)
+		return
+	}
+	u, err := g.r.Get(ShowGallery).URL("id", strconv.Itoa(int(collaborator.GalleryID)))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, u.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "You have joined this gallery as a " + collaborator.Role.Title() + ".",
+	})
+}
+
+// POST /galleries/invitations/:id/decline
+func (g *Galleries) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	collaborator, err := g.cs.ByID(uint(id))
+	if err != nil || collaborator.Accepted() || collaborator.Email != user.Email {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err := g.cs.Delete(collaborator.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The invitation has been declined.",
+	})
+}
+
+// collaboratorByID finds the collaborator in the path among
+// the gallery's, so that nobody can change collaborators on
+// other galleries. Like galleryByID it renders the error
+// itself, and returns nil if there was one.
+func collaboratorByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) *models.Collaborator {
+	id, err := strconv.Atoi(mux.Vars(r)["collaboratorID"])
+	if err != nil {
+		http.Error(w, "Invalid collaborator ID", http.StatusNotFound)
+		return nil
+	}
+	for i := range gallery.Collaborators {
+		if gallery.Collaborators[i].ID == uint(id) {
+			return &gallery.Collaborators[i]
+		}
+	}
+	http.Error(w, "Collaborator not found", http.StatusNotFound)
+	return nil
+}
+
+// collaboratorViews looks up the users who have accepted their
+// invitations to the gallery. Users who can't be found are
+// left out rather than stopping the page from rendering.
+func (g *Galleries) collaboratorViews(gallery *models.Gallery) []CollaboratorView {
+	cvs := make([]CollaboratorView, len(gallery.Collaborators))
+	for i, c := range gallery.Collaborators {
+		cvs[i] = CollaboratorView{Collaborator: c}
+		if c.Accepted() {
+			cvs[i].User, _ = g.us.ByID(c.UserID)
+		}
+	}
+	return cvs
+}
+
+// invitationViews looks up the user's pending invitations,
+// skipping any to galleries that have since been deleted.
+// Only users who have verified their email address can
+// accept them, so nobody can sign up with somebody else's
+// address to get in.
+func (g *Galleries) invitationViews(user *models.User) []InvitationView {
+	pending, err := g.cs.PendingByEmail(user.Email)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	var ivs []InvitationView
+	for _, c := range pending {
+		gallery, err := g.gs.ByID(c.GalleryID)
+		if err != nil {
+			continue
+		}
+		invitedBy, _ := g.us.ByID(c.InvitedByID)
+		ivs = append(ivs, InvitationView{
+			Collaborator: c,
+			Gallery:      gallery,
+			InvitedBy:    invitedBy,
+		})
+	}
+	return ivs
+}
+
+// inviterName is how the user is described in the emails we
+// send on their behalf.
+func inviterName(user *models.User) string {
+	if user.Name != "" {
+		return user.Name
+	}
+	return "@" + user.Username
+}
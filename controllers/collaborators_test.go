@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"lenslocked.com/models"
+)
+
+type fakeCollaborators struct {
+	models.CollaboratorService
+	collaborators []models.Collaborator
+}
+
+func (f *fakeCollaborators) ByGalleryID(galleryID uint) ([]models.Collaborator, error) {
+	return f.collaborators, nil
+}
+
+func TestShowImageCollaborator(t *testing.T) {
+	// Covers on the galleries page are loaded this way for the
+	// galleries shared with the user, too.
+	accepted := time.Now()
+	collaborators := []models.Collaborator{{
+		GalleryID:  1,
+		UserID:     2,
+		Role:       models.CollaboratorViewer,
+		AcceptedAt: &accepted,
+	}, {
+		GalleryID: 1,
+		UserID:    3,
+		Role:      models.CollaboratorViewer,
+	}}
+	tests := []struct {
+		gallery  models.Gallery
+		remember string
+		want     int
+		name     string
+	}{
+		{models.Gallery{UserID: 1, Visibility: models.VisibilityPrivate}, "user2", http.StatusOK, "collaborator"},
+		{models.Gallery{UserID: 1, Visibility: models.VisibilityPrivate}, "user3", http.StatusNotFound, "invited collaborator"},
+		{models.Gallery{UserID: 1, Visibility: models.VisibilityPublic, PasswordHash: "hash"}, "user2", http.StatusOK, "collaborator on a locked gallery"},
+	}
+	for _, tc := range tests {
+		g := newTestGalleries(t, tc.gallery)
+		g.cs = &fakeCollaborators{collaborators: collaborators}
+		if got := serveImage(g, "", tc.remember).Code; got != tc.want {
+			t.Errorf("ShowImage(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/email"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func NewExports(es models.ExportService, emailer *email.Client) *Exports {
+	return &Exports{
+		IndexView: views.NewView("bootstrap", "exports/index"),
+		es:        es,
+		emailer:   emailer,
+	}
+}
+
+// Exports lets users download a copy of everything we hold
+// about them.
+type Exports struct {
+	IndexView *views.View
+	es        models.ExportService
+	emailer   *email.Client
+}
+
+// GET /account/export
+func (e *Exports) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	exports, err := e.es.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = exports
+	e.IndexView.Render(w, r, vd)
+}
+
+// Create starts building an export for the user in the
+// background, and emails them once it is ready to download.
+//
+// POST /account/export
+func (e *Exports) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	export, err := e.es.Request(user)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account/export", http.StatusFound, *vd.Alert)
+		return
+	}
+	go e.build(export, user.Email)
+	views.RedirectAlert(w, r, "/account/export", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We're preparing your export. We'll email you when it is ready to download.",
+	})
+}
+
+func (e *Exports) build(export *models.Export, toEmail string) {
+	if err := e.es.Build(export); err != nil {
+		log.Printf("controllers: building export %d: %v", export.ID, err)
+		return
+	}
+	if err := e.emailer.ExportReady(toEmail, export.ExpiresAt); err != nil {
+		log.Println(err)
+	}
+}
+
+// Download sends the user the archive for one of their
+// exports. Exports can only be downloaded by the user they
+// belong to, so the link is useless to anyone it is shared
+// with.
+//
+// GET /account/export/:id/download
+func (e *Exports) Download(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	export, err := e.es.ByID(uint(id))
+	if err != nil || export.UserID != user.ID {
+		// We don't let users find out which exports exist by
+		// responding differently to ones that aren't theirs.
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	f, err := e.es.Open(export)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account/export", http.StatusFound, *vd.Alert)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+export.Filename()+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, export.Filename(), export.CreatedAt, f)
+}
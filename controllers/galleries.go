@@ -3,12 +3,21 @@ package controllers
 import (
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/email"
 	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/throttle"
 	"lenslocked.com/views"
 )
 
@@ -16,34 +25,106 @@ const (
 	IndexGalleries = "index_galleries"
 	ShowGallery    = "show_gallery"
 	EditGallery    = "edit_gallery"
+	ShowImage      = "show_image"
 
 	maxMultipartMem = 1 << 20 // 1 megabyte
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, cs models.CollaboratorService, us models.UserService, as models.AuditService, emailer *email.Client, co cookies.Options, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:            views.NewView("bootstrap", "galleries/new"),
+		ShowView:       views.NewView("bootstrap", "galleries/show"),
+		EditView:       views.NewView("bootstrap", "galleries/edit"),
+		IndexView:      views.NewView("bootstrap", "galleries/index"),
+		UnlockView:     views.NewView("bootstrap", "galleries/unlock"),
+		gs:             gs,
+		is:             is,
+		sls:            sls,
+		cs:             cs,
+		us:             us,
+		as:             as,
+		emailer:        emailer,
+		cookies:        co,
+		unlockThrottle: throttle.New(galleryUnlockThrottle),
+		r:              r,
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New            *views.View
+	ShowView       *views.View
+	EditView       *views.View
+	IndexView      *views.View
+	UnlockView     *views.View
+	gs             models.GalleryService
+	is             models.ImageService
+	sls            models.ShareLinkService
+	cs             models.CollaboratorService
+	us             models.UserService
+	as             models.AuditService
+	emailer        *email.Client
+	cookies        cookies.Options
+	unlockThrottle *throttle.Limiter
+	r              *mux.Router
+	// imageDir is the directory the images directory is in,
+	// which is the working directory outside of tests.
+	imageDir string
 }
 
+// GalleryForm is used to create and update galleries. The
+// password is only changed if a new one is entered, or if
+// RemovePassword is checked. EventDate is in the format of
+// models.EventDateFormat, or empty if the gallery isn't for
+// an event.
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title          string            `schema:"title"`
+	Description    string            `schema:"description"`
+	EventDate      string            `schema:"event_date"`
+	Location       string            `schema:"location"`
+	CoverImage     string            `schema:"cover_image"`
+	Visibility     models.Visibility `schema:"visibility"`
+	Password       string            `schema:"password"`
+	RemovePassword bool              `schema:"remove_password"`
+}
+
+// eventDate parses the form's event date, returning nil if
+// it was left empty.
+func (form GalleryForm) eventDate() (*time.Time, error) {
+	if strings.TrimSpace(form.EventDate) == "" {
+		return nil, nil
+	}
+	date, err := time.Parse(models.EventDateFormat, strings.TrimSpace(form.EventDate))
+	if err != nil {
+		return nil, models.ErrEventDateInvalid
+	}
+	return &date, nil
+}
+
+// GalleryEditView is used to render the edit page, along with
+// the visibilities the gallery can be given and the links and
+// people it has been shared with. The Can fields decide which
+// parts of the page the user gets to see, as collaborators
+// can only do some of what the owner can.
+type GalleryEditView struct {
+	*models.Gallery
+	Visibilities      []models.Visibility
+	ShareLinks        []models.ShareLink
+	SharePermissions  []models.SharePermission
+	Collaborators     []CollaboratorView
+	CollaboratorRoles []models.CollaboratorRole
+	CanRename         bool
+	CanDeleteImages   bool
+	CanManage         bool
+	CanDelete         bool
+}
+
+// GalleryIndexView is used to render the galleries the user
+// owns, the galleries that have been shared with them, and
+// the invitations to galleries they haven't accepted yet.
+type GalleryIndexView struct {
+	Owned       []models.Gallery
+	Shared      []models.Gallery
+	Invitations []InvitationView
 }
 
 // GET /galleries
@@ -62,22 +143,178 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	var index GalleryIndexView
+	for _, gallery := range galleries {
+		if gallery.UserID == user.ID {
+			index.Owned = append(index.Owned, gallery)
+		} else {
+			index.Shared = append(index.Shared, gallery)
+		}
+	}
+	index.Invitations = g.invitationViews(user)
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = index
 	g.IndexView.Render(w, r, vd)
 }
 
+// GalleryShowView is used to render a gallery, along with
+// whether the visitor can download its images. Membership is
+// set if the gallery has been shared with the visitor, so
+// that they can leave it.
+type GalleryShowView struct {
+	*models.Gallery
+	CanDownload bool
+	Membership  *models.Collaborator
+}
+
+// Show renders a gallery for anyone who can see it. Galleries
+// they can't see are reported as not found, so nobody can
+// tell which private galleries exist. Visitors are asked for
+// the password of password protected galleries first. Each
+// time the gallery is viewed with a share link counts as one
+// of its views.
+//
 // GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
+	access, ok := g.access(r, gallery)
+	if !ok {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	if g.locked(r, gallery) {
+		g.renderUnlock(w, r, gallery, access, views.Data{})
+		return
+	}
+	if access.shareLink != nil {
+		switch err := g.sls.RecordView(access.shareLink.ID); err {
+		case nil:
+		case models.ErrShareLinkInvalid:
+			http.Error(w, models.ErrShareLinkInvalid.Public(), http.StatusGone)
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Visitors who got in with a key or a share link aren't
+	// signed in as the owner, so the images need it as well.
+	for i := range gallery.Images {
+		gallery.Images[i].Access = access.query
+	}
+	view := GalleryShowView{
+		Gallery:     gallery,
+		CanDownload: access.canDownload,
+	}
+	if user := context.User(r.Context()); user != nil {
+		view.Membership = gallery.Collaborator(user.ID)
+	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = view
 	g.ShowView.Render(w, r, vd)
 }
 
+// ShowImage serves one of a gallery's images to anyone who can
+// see the gallery, once they have unlocked it if it has a
+// password. Images are downloaded rather than shown if
+// the download query param is set, which only the owner,
+// collaborators, and share links with the download
+// permission can do.
+//
+// GET /images/galleries/:id/:filename
+func (g *Galleries) ShowImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	access, ok := g.imageAccess(r, gallery)
+	if !ok || g.locked(r, gallery) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	if filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	image := models.Image{
+		GalleryID: gallery.ID,
+		Filename:  filename,
+	}
+	if r.URL.Query().Get("download") != "" {
+		if !access.canDownload {
+			http.Error(w, "You do not have permission to download this image", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": filename,
+		}))
+	}
+	if gallery.Visibility != models.VisibilityPublic || gallery.HasPassword() {
+		// Shared caches mustn't hand the image to people who
+		// can't see the gallery.
+		w.Header().Set("Cache-Control", "private")
+	}
+	http.ServeFile(w, r, filepath.Join(g.imageDir, image.RelativePath()))
+}
+
+// galleryAccess is how the current request is allowed to see
+// a gallery. query is added to the paths of the gallery's
+// images, so that visitors who got in with a key or a share
+// link can load them too.
+type galleryAccess struct {
+	query       url.Values
+	canDownload bool
+	shareLink   *models.ShareLink
+}
+
+// access returns how the current request can see the
+// gallery, and false if it can't. An active share link is
+// checked first, so that its views are counted and its
+// downloads allowed even if the gallery is public. Without
+// one, owners, collaborators, and anyone at all for public
+// galleries, get in by policy. Everyone else needs the key
+// to an unlisted gallery.
+func (g *Galleries) access(r *http.Request, gallery *models.Gallery) (galleryAccess, bool) {
+	return g.accessWith(r, gallery, (*models.ShareLink).Active)
+}
+
+// imageAccess is access for the gallery's images, which share
+// links that have used up their views can only load for a
+// little while after their last view.
+func (g *Galleries) imageAccess(r *http.Request, gallery *models.Gallery) (galleryAccess, bool) {
+	return g.accessWith(r, gallery, (*models.ShareLink).CanLoadImages)
+}
+
+// accessWith is access, with usable deciding whether a share
+// link still lets the request in.
+func (g *Galleries) accessWith(r *http.Request, gallery *models.Gallery, usable func(*models.ShareLink) bool) (galleryAccess, bool) {
+	user := context.User(r.Context())
+	member := policy.IsGalleryMember(user, gallery)
+	query := r.URL.Query()
+	if token := query.Get("share"); token != "" {
+		link, err := g.sls.ByToken(token)
+		if err == nil && link.GalleryID == gallery.ID && usable(link) {
+			return galleryAccess{
+				query:       url.Values{"share": {token}},
+				canDownload: member || link.CanDownload(),
+				shareLink:   link,
+			}, true
+		}
+	}
+	if policy.CanViewGallery(user, gallery) {
+		return galleryAccess{canDownload: member}, true
+	}
+	if key := query.Get("key"); gallery.KeyValid(key) {
+		return galleryAccess{query: url.Values{"key": {key}}}, true
+	}
+	return galleryAccess{}, false
+}
+
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -85,15 +322,43 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !policy.CanUploadImages(user, gallery) {
 		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editView(r, gallery)
 	g.EditView.Render(w, r, vd)
 }
 
+// editView works out what the user can do on the edit page,
+// and looks up the gallery's share links and collaborators
+// if they can manage them. A failed lookup is only logged,
+// since the rest of the page is still useful without them.
+func (g *Galleries) editView(r *http.Request, gallery *models.Gallery) GalleryEditView {
+	user := context.User(r.Context())
+	ev := GalleryEditView{
+		Gallery:           gallery,
+		Visibilities:      models.Visibilities,
+		SharePermissions:  models.SharePermissions,
+		CollaboratorRoles: models.CollaboratorRoles,
+		CanRename:         policy.CanRenameGallery(user, gallery),
+		CanDeleteImages:   policy.CanDeleteImages(user, gallery),
+		CanManage:         policy.CanEditGallery(user, gallery),
+		CanDelete:         policy.CanDeleteGallery(user, gallery),
+	}
+	if !ev.CanManage {
+		return ev
+	}
+	links, err := g.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	ev.ShareLinks = links
+	ev.Collaborators = g.collaboratorViews(gallery)
+	return ev
+}
+
 // POST /galleries/:id/update
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -101,19 +366,41 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !policy.CanRenameGallery(user, gallery) {
 		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editView(r, gallery)
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	eventDate, err := form.eventDate()
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
 	gallery.Title = form.Title
+	gallery.Description = form.Description
+	gallery.EventDate = eventDate
+	gallery.Location = form.Location
+	gallery.CoverImage = form.CoverImage
+	// Editors can only change the gallery's title and
+	// details, so anything else they send is ignored.
+	if policy.CanEditGallery(user, gallery) {
+		if form.Visibility != "" {
+			gallery.Visibility = form.Visibility
+		}
+		if form.RemovePassword {
+			gallery.PasswordHash = ""
+		} else {
+			gallery.Password = form.Password
+		}
+	}
 	err = g.gs.Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
@@ -133,13 +420,13 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !policy.CanUploadImages(user, gallery) {
 		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return
 	}
 
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editView(r, gallery)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
 		vd.SetAlert(err)
@@ -183,7 +470,7 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
+	if !policy.CanDeleteImages(user, gallery) {
 		http.Error(w, "You do not have permission to edit this gallery or image", http.StatusForbidden)
 		return
 	}
@@ -195,11 +482,22 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	err = g.is.Delete(&i)
 	if err != nil {
 		var vd views.Data
-		vd.Yield = gallery
+		vd.Yield = g.editView(r, gallery)
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	if gallery.CoverImage == filename {
+		// The gallery would otherwise keep pointing at an
+		// image that is gone.
+		gallery.CoverImage = ""
+		if err := g.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+	event := auditEvent(r, models.AuditImageDeleted, models.AuditTargetGallery, gallery.ID)
+	event.Details = filename
+	g.as.Record(event)
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		log.Println(err)
@@ -218,10 +516,20 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		g.New.Render(w, r, vd)
 		return
 	}
+	eventDate, err := form.eventDate()
+	if err != nil {
+		vd.SetAlert(err)
+		g.New.Render(w, r, vd)
+		return
+	}
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		EventDate:   eventDate,
+		Location:    form.Location,
+		UserID:      user.ID,
+		Visibility:  form.Visibility,
 	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
@@ -249,8 +557,8 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to edit "+
+	if !policy.CanDeleteGallery(user, gallery) {
+		http.Error(w, "You do not have permission to delete "+
 			"this gallery", http.StatusForbidden)
 		return
 	}
@@ -258,10 +566,11 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	err = g.gs.Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
-		vd.Yield = gallery
+		vd.Yield = g.editView(r, gallery)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	g.as.Record(auditEvent(r, models.AuditGalleryDeleted, models.AuditTargetGallery, gallery.ID))
 	url, err := g.r.Get(IndexGalleries).URL()
 	if err != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -303,5 +612,14 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	}
 	images, _ := g.is.ByGalleryID(gallery.ID)
 	gallery.Images = images
+	collaborators, err := g.cs.ByGalleryID(gallery.ID)
+	if err != nil {
+		// Without its collaborators the policy would lock
+		// them out, so it's better not to carry on.
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	gallery.Collaborators = collaborators
 	return gallery, nil
 }
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/cookies"
+	"lenslocked.com/middleware"
+	"lenslocked.com/models"
+)
+
+type fakeUsers struct {
+	models.UserService
+	users map[uint]*models.User
+}
+
+func (f *fakeUsers) ByID(id uint) (*models.User, error) {
+	if user, ok := f.users[id]; ok {
+		return user, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+type fakeSessions struct {
+	models.SessionService
+	sessions map[string]*models.Session
+}
+
+func (f *fakeSessions) ByRemember(token string) (*models.Session, error) {
+	if session, ok := f.sessions[token]; ok {
+		return session, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeSessions) Touch(session *models.Session) (bool, error) {
+	return false, nil
+}
+
+type fakeGalleries struct {
+	models.GalleryService
+	gallery models.Gallery
+}
+
+func (f *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	if id != f.gallery.ID {
+		return nil, models.ErrNotFound
+	}
+	gallery := f.gallery
+	return &gallery, nil
+}
+
+type fakeImages struct {
+	models.ImageService
+}
+
+func (f *fakeImages) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return nil, nil
+}
+
+// newTestGalleries returns Galleries for the gallery, which is
+// given the ID 1 and the image a.jpg in a temporary directory.
+func newTestGalleries(t *testing.T, gallery models.Gallery) *Galleries {
+	dir := t.TempDir()
+	imageDir := filepath.Join(dir, "images", "galleries", "1")
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "a.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gallery.ID = 1
+	return &Galleries{
+		gs:       &fakeGalleries{gallery: gallery},
+		is:       &fakeImages{},
+		sls:      &fakeShareLinks{},
+		cs:       &fakeCollaborators{},
+		imageDir: dir,
+	}
+}
+
+// serveImage requests a.jpg with the query the way main.go
+// routes it, with the user middleware in front. Users 1 to 3
+// are signed in with the remember tokens "user1" to "user3",
+// and remember is left out if it's empty.
+func serveImage(g *Galleries, query, remember string) *httptest.ResponseRecorder {
+	us := &fakeUsers{users: map[uint]*models.User{}}
+	ss := &fakeSessions{sessions: map[string]*models.Session{}}
+	for _, id := range []uint{1, 2, 3} {
+		us.users[id] = &models.User{Model: gorm.Model{ID: id}, Role: models.RoleUser}
+		ss.sessions[fmt.Sprintf("user%d", id)] = &models.Session{UserID: id}
+	}
+	userMw := &middleware.User{
+		UserService:    us,
+		SessionService: ss,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", g.ShowImage)
+
+	req := httptest.NewRequest("GET", "/images/galleries/1/a.jpg"+query, nil)
+	if remember != "" {
+		req.AddCookie(&http.Cookie{Name: cookies.RememberToken, Value: remember})
+	}
+	rec := httptest.NewRecorder()
+	userMw.Apply(r).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestShowImagePrivate(t *testing.T) {
+	g := newTestGalleries(t, models.Gallery{
+		UserID:     1,
+		Visibility: models.VisibilityPrivate,
+	})
+	tests := []struct {
+		remember string
+		want     int
+		name     string
+	}{
+		{"user1", http.StatusOK, "owner"},
+		{"user2", http.StatusNotFound, "other user"},
+		{"", http.StatusNotFound, "signed out"},
+	}
+	for _, tc := range tests {
+		if got := serveImage(g, "", tc.remember).Code; got != tc.want {
+			t.Errorf("ShowImage(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
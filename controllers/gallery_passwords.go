@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/throttle"
+	"lenslocked.com/views"
+)
+
+// galleryUnlockThrottle slows down guessing at a gallery's
+// password. Failures are counted per gallery and IP address,
+// so that one visitor can't lock everyone else out.
+var galleryUnlockThrottle = throttle.Config{
+	Name:         "gallery unlock",
+	Free:         5,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockoutAfter: 20,
+	LockoutFor:   15 * time.Minute,
+	Window:       time.Hour,
+}
+
+// GalleryUnlockView is used to render the form visitors enter
+// a gallery's password in. Action keeps the key or share
+// token they got in with, so it still works once they unlock.
+type GalleryUnlockView struct {
+	*models.Gallery
+	Action string
+}
+
+// UnlockForm is used to unlock a password protected gallery.
+type UnlockForm struct {
+	Password string `schema:"password"`
+}
+
+// Unlock checks the password of a password protected gallery.
+// Visitors who get it right are given a cookie that lets them
+// see the gallery and its images until it expires.
+//
+// POST /galleries/:id/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	access, ok := g.access(r, gallery)
+	if !ok {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	var form UnlockForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderUnlock(w, r, gallery, access, vd)
+		return
+	}
+	key := fmt.Sprintf("%d %s", gallery.ID, clientIP(r))
+	if wait := g.unlockThrottle.Wait(key); wait > 0 {
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		g.renderUnlock(w, r, gallery, access, vd)
+		return
+	}
+	token, expires, err := g.gs.Unlock(gallery, form.Password)
+	if err != nil {
+		if err == models.ErrPasswordIncorrect {
+			g.unlockThrottle.Fail(key)
+		}
+		vd.SetAlert(err)
+		g.renderUnlock(w, r, gallery, access, vd)
+		return
+	}
+	g.unlockThrottle.Reset(key)
+	g.cookies.Set(w, cookies.GalleryUnlock(gallery.ID), token, expires)
+	http.Redirect(w, r, g.showURL(gallery, access), http.StatusFound)
+}
+
+// locked returns true if the gallery has a password and the
+// current request hasn't unlocked it. Owners and collaborators
+// never need to enter the gallery's password.
+func (g *Galleries) locked(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.HasPassword() {
+		return false
+	}
+	user := context.User(r.Context())
+	if policy.IsGalleryMember(user, gallery) {
+		return false
+	}
+	cookie, err := r.Cookie(cookies.GalleryUnlock(gallery.ID))
+	if err != nil {
+		return true
+	}
+	return !g.gs.Unlocked(gallery, cookie.Value)
+}
+
+func (g *Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, access galleryAccess, vd views.Data) {
+	action := "/galleries/" + strconv.Itoa(int(gallery.ID)) + "/unlock"
+	if len(access.query) > 0 {
+		action += "?" + access.query.Encode()
+	}
+	vd.Yield = GalleryUnlockView{
+		Gallery: gallery,
+		Action:  action,
+	}
+	g.UnlockView.Render(w, r, vd)
+}
+
+// showURL returns the path of the gallery along with the key
+// or share token the visitor got in with.
+func (g *Galleries) showURL(gallery *models.Gallery, access galleryAccess) string {
+	u, err := g.r.Get(ShowGallery).URL("id", strconv.Itoa(int(gallery.ID)))
+	if err != nil {
+		log.Println(err)
+		return "/"
+	}
+	u.RawQuery = access.query.Encode()
+	return u.String()
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"lenslocked.com/models"
+)
+
+func TestShowImageLocked(t *testing.T) {
+	g := newTestGalleries(t, models.Gallery{
+		UserID:       1,
+		Visibility:   models.VisibilityPublic,
+		PasswordHash: "hash",
+	})
+	tests := []struct {
+		remember string
+		want     int
+		name     string
+	}{
+		{"user1", http.StatusOK, "owner"},
+		{"user2", http.StatusNotFound, "other user"},
+		{"", http.StatusNotFound, "signed out"},
+	}
+	for _, tc := range tests {
+		if got := serveImage(g, "", tc.remember).Code; got != tc.want {
+			t.Errorf("ShowImage(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestShowImageCacheControl(t *testing.T) {
+	tests := []struct {
+		password string
+		want     string
+		name     string
+	}{
+		{"", "", "public"},
+		{"hash", "private", "public with a password"},
+	}
+	for _, tc := range tests {
+		g := newTestGalleries(t, models.Gallery{
+			UserID:       1,
+			Visibility:   models.VisibilityPublic,
+			PasswordHash: tc.password,
+		})
+		rec := serveImage(g, "", "user1")
+		if got := rec.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("ShowImage(%s) Cache-Control = %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,20 +1,94 @@
 package controllers
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/gorilla/schema"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
 	}
+	return parseValues(r.PostForm, dst)
+}
+
+// parseURLParams works like parseForm, but it decodes the
+// query params in the request URL instead of a POST body.
+func parseURLParams(r *http.Request, dst interface{}) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	return parseValues(r.Form, dst)
+}
 
+func parseValues(values url.Values, dst interface{}) error {
 	dec := schema.NewDecoder()
 	dec.IgnoreUnknownKeys(true)
-	if err := dec.Decode(dst, r.PostForm); err != nil {
+	if err := dec.Decode(dst, values); err != nil {
 		return err
 	}
 	return nil
 }
+
+// clientIP returns the IP address of the client that made
+// the request. In production we sit behind Caddy, so when a
+// request comes from the local machine we trust the
+// X-Real-IP header it sets. Anyone else could set that
+// header to whatever they like, so we ignore it for them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	return host
+}
+
+// waitString formats how long a user needs to wait in a
+// friendly way, rounding up so we never tell them to wait
+// less time than they need to.
+func waitString(d time.Duration) string {
+	if d <= time.Minute {
+		secs := int((d + time.Second - 1) / time.Second)
+		if secs == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", secs)
+	}
+	mins := int((d + time.Minute - 1) / time.Minute)
+	return fmt.Sprintf("%d minutes", mins)
+}
+
+// auditEvent starts an audit event for the request, with the
+// current user as the actor. Callers that know better, eg
+// because the user has only just signed in, can change it.
+func auditEvent(r *http.Request, action, targetType string, targetID uint) models.AuditEvent {
+	event := models.AuditEvent{
+		Action:     action,
+		IP:         clientIP(r),
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if user := context.User(r.Context()); user != nil {
+		event.ActorID = user.ID
+	}
+	if session := context.Session(r.Context()); session != nil {
+		event.ImpersonatorID = session.ImpersonatorID
+	}
+	if token := context.APIToken(r.Context()); token != nil {
+		event.APITokenID = token.ID
+	}
+	return event
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+func NewInvites(is models.InviteService, registration models.RegistrationPolicy, baseURL string) *Invites {
+	return &Invites{
+		IndexView:    views.NewView("bootstrap", "invites/index"),
+		is:           is,
+		registration: registration,
+		baseURL:      baseURL,
+	}
+}
+
+// Invites lets users invite people to sign up while sign ups
+// are invite only.
+type Invites struct {
+	IndexView    *views.View
+	is           models.InviteService
+	registration models.RegistrationPolicy
+	baseURL      string
+}
+
+// InviteView is used to render an invite along with the link
+// that signs people up with it.
+type InviteView struct {
+	models.Invite
+	SignupURL string
+}
+
+// InvitesView is used to render the invites page. UseLimit is
+// the most people each of the user's invites can be for, or 0
+// if there is no limit.
+type InvitesView struct {
+	Invites        []InviteView
+	InviteRequired bool
+	UseLimit       int
+}
+
+// InviteForm is used to create an invite. ExpiresIn is a
+// number of days, and 0 means the invite never expires.
+type InviteForm struct {
+	MaxUses   int `schema:"max_uses"`
+	ExpiresIn int `schema:"expires_in"`
+}
+
+// GET /account/invites
+func (i *Invites) Index(w http.ResponseWriter, r *http.Request) {
+	i.render(w, r, views.Data{})
+}
+
+// POST /account/invites
+func (i *Invites) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form InviteForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		i.render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	if limit := policy.InviteUseLimit(user); limit > 0 && (form.MaxUses <= 0 || form.MaxUses > limit) {
+		vd.AlertError(fmt.Sprintf("Each invite can be used by at most %d people.", limit))
+		i.render(w, r, vd)
+		return
+	}
+	invite := models.Invite{
+		UserID:  user.ID,
+		MaxUses: form.MaxUses,
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		invite.ExpiresAt = &expiresAt
+	}
+	if err := i.is.Create(&invite); err != nil {
+		vd.SetAlert(err)
+		i.render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/invites", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your invite has been created. Send the link to the people you want to invite.",
+	})
+}
+
+// POST /account/invites/:id/delete
+func (i *Invites) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	invites, err := i.is.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Only invites belonging to the current user can be
+	// deleted, so we look for it amongst theirs rather than
+	// trusting the ID on its own.
+	var found bool
+	for _, invite := range invites {
+		if invite.ID == uint(id) {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err := i.is.Delete(uint(id)); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account/invites", http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/invites", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The invite has been deleted. Anybody who already used it keeps their account.",
+	})
+}
+
+func (i *Invites) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	invites, err := i.is.ByUserID(user.ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	ivs := make([]InviteView, len(invites))
+	for j, invite := range invites {
+		ivs[j] = InviteView{
+			Invite:    invite,
+			SignupURL: i.baseURL + "/signup?invite=" + url.QueryEscape(invite.Code),
+		}
+	}
+	vd.Yield = InvitesView{
+		Invites:        ivs,
+		InviteRequired: i.registration.InviteRequired(),
+		UseLimit:       policy.InviteUseLimit(user),
+	}
+	i.IndexView.Render(w, r, vd)
+}
@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
+	"lenslocked.com/sso"
+	"lenslocked.com/views"
+)
+
+// oauthStateDuration is how long a user has to sign in with
+// their provider before they need to start over.
+const oauthStateDuration = 10 * time.Minute
+
+// NewOAuth needs the Users controller so that signing in with
+// a provider ends up in the same place as every other way of
+// signing in.
+func NewOAuth(providers []*sso.Provider, is models.IdentityService, users *Users, co cookies.Options) *OAuth {
+	byName := make(map[string]*sso.Provider, len(providers))
+	for _, p := range providers {
+		byName[p.Name] = p
+	}
+	return &OAuth{
+		IdentitiesView: views.NewView("bootstrap", "identities/index"),
+		providers:      providers,
+		byName:         byName,
+		is:             is,
+		users:          users,
+		cookies:        co,
+	}
+}
+
+// OAuth lets users sign in with their OpenID Connect provider
+// accounts, and link and unlink those accounts.
+type OAuth struct {
+	IdentitiesView *views.View
+	providers      []*sso.Provider
+	byName         map[string]*sso.Provider
+	is             models.IdentityService
+	users          *Users
+	cookies        cookies.Options
+}
+
+// OAuthForm is used to start signing in with a provider.
+type OAuthForm struct {
+	RememberMe bool `schema:"remember_me"`
+	Link       bool `schema:"link"`
+}
+
+// Start sends the user off to the provider to sign in. What
+// we need to finish the sign in is kept in a short-lived
+// cookie, which also ties the callback to this browser.
+//
+// POST /auth/:provider
+func (o *OAuth) Start(w http.ResponseWriter, r *http.Request) {
+	provider := o.provider(r)
+	if provider == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	var form OAuthForm
+	if err := parseForm(r, &form); err != nil {
+		o.failed(w, r, "/login", err)
+		return
+	}
+	if form.Link && context.User(r.Context()) == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	ar, err := sso.NewAuthRequest()
+	if err != nil {
+		o.failed(w, r, "/login", err)
+		return
+	}
+	authURL, err := provider.AuthCodeURL(r.Context(), ar)
+	if err != nil {
+		o.failed(w, r, "/login", err)
+		return
+	}
+	state := url.Values{}
+	state.Set("provider", provider.Name)
+	state.Set("state", ar.State)
+	state.Set("nonce", ar.Nonce)
+	state.Set("verifier", ar.Verifier)
+	state.Set("remember_me", strconv.FormatBool(form.RememberMe))
+	state.Set("link", strconv.FormatBool(form.Link))
+	o.cookies.Set(w, cookies.OAuthState, state.Encode(), time.Now().Add(oauthStateDuration))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back to once
+// they have signed in. Depending on how the sign in was
+// started, we either link the provider account to the current
+// user or sign in the user it belongs to.
+//
+// GET /auth/:provider/callback
+func (o *OAuth) Callback(w http.ResponseWriter, r *http.Request) {
+	provider := o.provider(r)
+	if provider == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	cookie, err := r.Cookie(cookies.OAuthState)
+	if err != nil {
+		o.expired(w, r)
+		return
+	}
+	o.cookies.Clear(w, cookies.OAuthState)
+	state, err := url.ParseQuery(cookie.Value)
+	if err != nil || state.Get("provider") != provider.Name ||
+		subtle.ConstantTimeCompare([]byte(state.Get("state")), []byte(r.FormValue("state"))) != 1 {
+		o.expired(w, r)
+		return
+	}
+	link := state.Get("link") == "true"
+	returnTo := "/login"
+	if link {
+		returnTo = "/account/identities"
+	}
+	if r.FormValue("error") != "" {
+		views.RedirectAlert(w, r, returnTo, http.StatusFound, views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Signing in with " + provider.DisplayName + " was cancelled.",
+		})
+		return
+	}
+
+	ar := sso.AuthRequest{
+		State:    state.Get("state"),
+		Nonce:    state.Get("nonce"),
+		Verifier: state.Get("verifier"),
+	}
+	claims, err := provider.Exchange(r.Context(), ar, r.FormValue("code"))
+	if err != nil {
+		o.failed(w, r, returnTo, err)
+		return
+	}
+	ext := models.ExternalIdentity{
+		Provider:      provider.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}
+
+	if link {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if err := o.is.Link(user, ext); err != nil {
+			o.failed(w, r, returnTo, err)
+			return
+		}
+		views.RedirectAlert(w, r, returnTo, http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Your " + provider.DisplayName + " account has been linked.",
+		})
+		return
+	}
+
+	user, err := o.is.Resolve(ext)
+	if err != nil {
+		o.failed(w, r, returnTo, err)
+		return
+	}
+	if err := o.users.completeLogin(w, r, user, state.Get("remember_me") == "true"); err != nil {
+		o.failed(w, r, returnTo, err)
+		return
+	}
+}
+
+// IdentityView is used to render a provider on the linked
+// accounts page, along with the identity linking the user to
+// it if there is one.
+type IdentityView struct {
+	Provider *sso.Provider
+	Identity *models.Identity
+}
+
+// Index lists the providers the user can sign in with, and
+// which of them they have linked.
+//
+// GET /account/identities
+func (o *OAuth) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	identities, err := o.is.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		o.IdentitiesView.Render(w, r, vd)
+		return
+	}
+	ivs := make([]IdentityView, len(o.providers))
+	for i, p := range o.providers {
+		ivs[i].Provider = p
+		for j := range identities {
+			if identities[j].Provider == p.Name {
+				ivs[i].Identity = &identities[j]
+			}
+		}
+	}
+	vd.Yield = ivs
+	o.IdentitiesView.Render(w, r, vd)
+}
+
+// Unlink removes the link between the user and one of their
+// provider accounts. Users can always get back into their
+// account with a password reset or sign in link, so we don't
+// need to stop them from unlinking their last provider.
+//
+// POST /account/identities/:id/delete
+func (o *OAuth) Unlink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid identity ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	identities, err := o.is.ByUserID(user.ID)
+	if err != nil {
+		o.failed(w, r, "/account/identities", err)
+		return
+	}
+	found := false
+	for _, identity := range identities {
+		if identity.ID == uint(id) {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "Linked account not found", http.StatusNotFound)
+		return
+	}
+	if err := o.is.Delete(uint(id)); err != nil {
+		o.failed(w, r, "/account/identities", err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/identities", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The account has been unlinked.",
+	})
+}
+
+func (o *OAuth) provider(r *http.Request) *sso.Provider {
+	return o.byName[mux.Vars(r)["provider"]]
+}
+
+// failed redirects the user with an alert for err, which is
+// only shown to them if it is a public error.
+func (o *OAuth) failed(w http.ResponseWriter, r *http.Request, urlStr string, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, urlStr, http.StatusFound, *vd.Alert)
+}
+
+func (o *OAuth) expired(w http.ResponseWriter, r *http.Request) {
+	views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: "Your sign in attempt has expired. Please try again.",
+	})
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	ShowProfile = "show_profile"
+)
+
+func NewProfiles(us models.UserService, gs models.GalleryService) *Profiles {
+	return &Profiles{
+		ShowView: views.NewView("bootstrap", "profiles/show"),
+		us:       us,
+		gs:       gs,
+	}
+}
+
+// Profiles shows everyone a page for each user, with their
+// bio and public galleries.
+type Profiles struct {
+	ShowView *views.View
+	us       models.UserService
+	gs       models.GalleryService
+}
+
+// ProfileView is used to render a user's profile.
+type ProfileView struct {
+	User      *models.User
+	Galleries []models.Gallery
+}
+
+// Show renders a user's profile. Suspended users and users
+// who are waiting to be deleted don't have one, and we don't
+// say why, so nobody can tell which usernames are in use.
+//
+// GET /u/:username
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	user, err := p.us.ByUsername(mux.Vars(r)["username"])
+	if err != nil || user.Suspended() || user.DeletionPending() {
+		if err != nil && err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	galleries, err := p.gs.PublicByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = ProfileView{
+		User:      user,
+		Galleries: galleries,
+	}
+	p.ShowView.Render(w, r, vd)
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func init() {
+	// The tests run in controllers/, not the repo's root.
+	views.LayoutDir = "../" + views.LayoutDir
+	views.TemplateDir = "../" + views.TemplateDir
+}
+
+type fakeProfileUsers struct {
+	models.UserService
+	user models.User
+}
+
+func (f *fakeProfileUsers) ByUsername(username string) (*models.User, error) {
+	if username != f.user.Username {
+		return nil, models.ErrNotFound
+	}
+	user := f.user
+	return &user, nil
+}
+
+type fakePublicGalleries struct {
+	models.GalleryService
+	galleries []models.Gallery
+}
+
+func (f *fakePublicGalleries) PublicByUserID(userID uint) ([]models.Gallery, error) {
+	return f.galleries, nil
+}
+
+func TestProfileShowCovers(t *testing.T) {
+	p := NewProfiles(&fakeProfileUsers{user: models.User{
+		Model:    gorm.Model{ID: 1},
+		Name:     "Jon",
+		Username: "jon",
+	}}, &fakePublicGalleries{galleries: []models.Gallery{{
+		Model:      gorm.Model{ID: 1},
+		UserID:     1,
+		Title:      "Open",
+		Visibility: models.VisibilityPublic,
+		CoverImage: "a.jpg",
+	}, {
+		Model:        gorm.Model{ID: 2},
+		UserID:       1,
+		Title:        "Locked",
+		Visibility:   models.VisibilityPublic,
+		CoverImage:   "b.jpg",
+		PasswordHash: "hash",
+	}}})
+	req := httptest.NewRequest("GET", "/u/jon", nil)
+	req = mux.SetURLVars(req, map[string]string{"username": "jon"})
+	rec := httptest.NewRecorder()
+	p.Show(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Show() = %d; want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `src="/images/galleries/1/a.jpg"`) {
+		t.Errorf("Show() is missing the cover of a public gallery")
+	}
+	if strings.Contains(body, "/images/galleries/2/") {
+		t.Errorf("Show() has the cover of a gallery with a password")
+	}
+}
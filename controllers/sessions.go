@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func NewSessions(ss models.SessionService, co cookies.Options) *Sessions {
+	return &Sessions{
+		IndexView: views.NewView("bootstrap", "sessions/index"),
+		ss:        ss,
+		cookies:   co,
+	}
+}
+
+// Sessions lets users see everywhere they are signed in and
+// sign out of any of those places.
+type Sessions struct {
+	IndexView *views.View
+	ss        models.SessionService
+	cookies   cookies.Options
+}
+
+// SessionView wraps a session so that templates can tell
+// which session is the one being used to view the page.
+type SessionView struct {
+	models.Session
+	Current bool
+}
+
+// GET /account/sessions
+func (s *Sessions) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	current := context.Session(r.Context())
+	sessions, err := s.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	svs := make([]SessionView, len(sessions))
+	for i, session := range sessions {
+		svs[i] = SessionView{
+			Session: session,
+			Current: current != nil && current.ID == session.ID,
+		}
+	}
+	var vd views.Data
+	vd.Yield = svs
+	s.IndexView.Render(w, r, vd)
+}
+
+// POST /account/sessions/:id/delete
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	sessions, err := s.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Only sessions belonging to the current user can be
+	// revoked, so we look for it amongst theirs rather than
+	// trusting the ID on its own.
+	var found bool
+	for _, session := range sessions {
+		if session.ID == uint(id) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := s.ss.Delete(uint(id)); err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	current := context.Session(r.Context())
+	if current != nil && current.ID == uint(id) {
+		// The user just signed themselves out, so we clear
+		// their cookie just like Users.Logout does.
+		s.cookies.Clear(w, cookies.RememberToken)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The session has been signed out.",
+	})
+}
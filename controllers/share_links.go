@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+// maxShareDays is the longest a share link can last.
+const maxShareDays = 365
+
+// ShareLinkForm is used to create a share link. ExpiresIn is
+// a number of days, and MaxViews is 0 if the link can be
+// viewed any number of times.
+type ShareLinkForm struct {
+	ExpiresIn  int                    `schema:"expires_in"`
+	MaxViews   int                    `schema:"max_views"`
+	Permission models.SharePermission `schema:"permission"`
+}
+
+// Share sends people with a share link to the gallery it is
+// for. The link is checked by Show rather than here, so that
+// it is only counted as viewed once.
+//
+// GET /s/:token
+func (g *Galleries) Share(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	link, err := g.sls.ByToken(token)
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	if !link.Active() {
+		http.Error(w, models.ErrShareLinkInvalid.Public(), http.StatusGone)
+		return
+	}
+	u, err := g.r.Get(ShowGallery).URL("id", strconv.Itoa(int(link.GalleryID)))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.RawQuery = url.Values{"share": {link.Token}}.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !policy.CanEditGallery(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	if form.ExpiresIn < 0 || form.ExpiresIn > maxShareDays {
+		var vd views.Data
+		vd.Yield = g.editView(r, gallery)
+		vd.AlertError(fmt.Sprintf("Share links can last at most %d days.", maxShareDays))
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID:  gallery.ID,
+		MaxViews:   form.MaxViews,
+		Permission: form.Permission,
+	}
+	if form.ExpiresIn > 0 {
+		link.ExpiresAt = time.Now().AddDate(0, 0, form.ExpiresIn)
+	}
+	if err := g.sls.Create(&link); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	event := auditEvent(r, models.AuditShareLinkCreated, models.AuditTargetGallery, gallery.ID)
+	event.Details = string(link.Permission)
+	g.as.Record(event)
+	g.redirectEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your share link has been created. Copy it from the table below.",
+	})
+}
+
+// POST /galleries/:id/shares/:linkID/revoke
+func (g *Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !policy.CanEditGallery(user, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	linkID, err := strconv.Atoi(mux.Vars(r)["linkID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+	links, err := g.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Only links for this gallery can be revoked, so that the
+	// owner of one gallery can't revoke links to another.
+	found := false
+	for _, link := range links {
+		if link.ID == uint(linkID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err := g.sls.Revoke(uint(linkID)); err != nil {
+		g.renderEditAlert(w, r, gallery, err)
+		return
+	}
+	g.as.Record(auditEvent(r, models.AuditShareLinkRevoked, models.AuditTargetGallery, gallery.ID))
+	g.redirectEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The share link has been revoked. It will stop working straight away.",
+	})
+}
+
+func (g *Galleries) renderEditAlert(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error) {
+	var vd views.Data
+	vd.Yield = g.editView(r, gallery)
+	vd.SetAlert(err)
+	g.EditView.Render(w, r, vd)
+}
+
+func (g *Galleries) redirectEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, alert views.Alert) {
+	u, err := g.r.Get(EditGallery).URL("id", strconv.Itoa(int(gallery.ID)))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, u.Path, http.StatusFound, alert)
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"lenslocked.com/models"
+)
+
+type fakeShareLinks struct {
+	models.ShareLinkService
+	links []models.ShareLink
+}
+
+func (f *fakeShareLinks) ByToken(token string) (*models.ShareLink, error) {
+	for _, link := range f.links {
+		if link.Token == token {
+			return &link, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func TestShowImageShareLinkDownload(t *testing.T) {
+	g := newTestGalleries(t, models.Gallery{
+		UserID:     1,
+		Visibility: models.VisibilityPublic,
+	})
+	g.sls = &fakeShareLinks{links: []models.ShareLink{{
+		GalleryID:  1,
+		Token:      "download",
+		Permission: models.ShareDownload,
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}}}
+	tests := []struct {
+		query    string
+		remember string
+		want     int
+		name     string
+	}{
+		{"?download=1", "", http.StatusForbidden, "signed out"},
+		{"?download=1&share=download", "", http.StatusOK, "signed out with link"},
+		{"?download=1&share=download", "user2", http.StatusOK, "other user with link"},
+		{"?download=1&share=unknown", "", http.StatusForbidden, "signed out with unknown link"},
+		{"?download=1", "user1", http.StatusOK, "owner"},
+	}
+	for _, tc := range tests {
+		if got := serveImage(g, tc.query, tc.remember).Code; got != tc.want {
+			t.Errorf("ShowImage(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestShowImageShareLinkUsedUp(t *testing.T) {
+	g := newTestGalleries(t, models.Gallery{
+		UserID:     1,
+		Visibility: models.VisibilityPrivate,
+	})
+	justNow := time.Now().Add(-time.Minute)
+	anHourAgo := time.Now().Add(-time.Hour)
+	link := models.ShareLink{
+		GalleryID:  1,
+		Permission: models.ShareView,
+		MaxViews:   1,
+		Views:      1,
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	recent, old := link, link
+	recent.Token, recent.LastViewedAt = "recent", &justNow
+	old.Token, old.LastViewedAt = "old", &anHourAgo
+	g.sls = &fakeShareLinks{links: []models.ShareLink{recent, old}}
+	tests := []struct {
+		query string
+		want  int
+		name  string
+	}{
+		{"?share=recent", http.StatusOK, "viewed a minute ago"},
+		{"?share=old", http.StatusNotFound, "viewed an hour ago"},
+	}
+	for _, tc := range tests {
+		if got := serveImage(g, tc.query, "").Code; got != tc.want {
+			t.Errorf("ShowImage(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
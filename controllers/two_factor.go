@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/throttle"
+	"lenslocked.com/totp"
+	"lenslocked.com/views"
+)
+
+// totpIssuer is the name authenticator apps show next to
+// our codes.
+const totpIssuer = "LensLocked"
+
+// NewTwoFactor shares the login throttle of users, so that
+// confirming a password here can't be used to get around it.
+func NewTwoFactor(tfs models.TwoFactorService, users *Users) *TwoFactor {
+	return &TwoFactor{
+		SetupView:         views.NewView("bootstrap", "two_factor/setup"),
+		RecoveryCodesView: views.NewView("bootstrap", "two_factor/recovery_codes"),
+		tfs:               tfs,
+		us:                users.us,
+		accountThrottle:   users.accountThrottle,
+	}
+}
+
+// TwoFactor is used by signed in users to turn two factor
+// authentication on and off.
+type TwoFactor struct {
+	SetupView         *views.View
+	RecoveryCodesView *views.View
+	tfs               models.TwoFactorService
+	us                models.UserService
+	accountThrottle   *throttle.Limiter
+}
+
+// TwoFactorSetup is the data used to render the setup page.
+type TwoFactorSetup struct {
+	User      *models.User
+	Secret    string
+	URI       string
+	QRCode    template.URL
+	CodesLeft int
+}
+
+// PasswordForm is used by actions that need the user to
+// confirm their current password.
+type PasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// Setup shows the QR code and secret for a user who is
+// enabling two factor authentication, or the current status
+// for a user who already has.
+//
+// GET /account/2fa
+func (tf *TwoFactor) Setup(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	setup, err := tf.setup(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = setup
+	tf.SetupView.Render(w, r, vd)
+}
+
+// Enable confirms the user has set up their authenticator
+// app correctly and turns on two factor authentication.
+//
+// POST /account/2fa
+func (tf *TwoFactor) Enable(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		tf.renderSetup(w, r, err)
+		return
+	}
+	codes, err := tf.tfs.Enable(user, form.Code)
+	if err != nil {
+		tf.renderSetup(w, r, err)
+		return
+	}
+	if codes == nil {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two factor authentication is now enabled!",
+	}
+	vd.Yield = codes
+	tf.RecoveryCodesView.Render(w, r, vd)
+}
+
+// RecoveryCodes replaces the user's recovery codes with a
+// new set after confirming their password.
+//
+// POST /account/2fa/recovery
+func (tf *TwoFactor) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := tf.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+	codes, err := tf.tfs.NewRecoveryCodes(user)
+	if err != nil {
+		tf.renderSetup(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = codes
+	tf.RecoveryCodesView.Render(w, r, vd)
+}
+
+// Disable turns off two factor authentication after
+// confirming the user's password.
+//
+// POST /account/2fa/disable
+func (tf *TwoFactor) Disable(w http.ResponseWriter, r *http.Request) {
+	user, ok := tf.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+	if err := tf.tfs.Disable(user); err != nil {
+		tf.renderSetup(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/2fa", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two factor authentication has been disabled.",
+	})
+}
+
+// confirmPassword parses a PasswordForm and checks the
+// password against the current user's. If it can't, the
+// setup page is rendered with an alert and false is
+// returned. Failures count against the same throttle as
+// logging in.
+func (tf *TwoFactor) confirmPassword(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		tf.renderSetup(w, r, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	account := strings.ToLower(user.Email)
+	if wait := tf.accountThrottle.Wait(account); wait > 0 {
+		var vd views.Data
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		tf.render(w, r, vd)
+		return nil, false
+	}
+	confirmed, err := tf.us.Authenticate(user.Email, form.Password)
+	if err != nil {
+		if err == models.ErrPasswordIncorrect {
+			tf.accountThrottle.Fail(account)
+		}
+		tf.renderSetup(w, r, err)
+		return nil, false
+	}
+	tf.accountThrottle.Reset(account)
+	return confirmed, true
+}
+
+// renderSetup renders the setup page with the error as an
+// alert.
+func (tf *TwoFactor) renderSetup(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	tf.render(w, r, vd)
+}
+
+// render renders the setup page along with whatever alert
+// is already in vd.
+func (tf *TwoFactor) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	setup, setupErr := tf.setup(r)
+	if setupErr != nil {
+		log.Println(setupErr)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = setup
+	tf.SetupView.Render(w, r, vd)
+}
+
+// setup builds the data for the setup page, generating a
+// pending secret for the user if they don't have one yet.
+func (tf *TwoFactor) setup(r *http.Request) (*TwoFactorSetup, error) {
+	user := context.User(r.Context())
+	setup := TwoFactorSetup{User: user}
+	if user.TwoFactorEnabled() {
+		n, err := tf.tfs.RecoveryCodesLeft(user)
+		if err != nil {
+			return nil, err
+		}
+		setup.CodesLeft = n
+		return &setup, nil
+	}
+
+	if err := tf.tfs.Initiate(user); err != nil {
+		return nil, err
+	}
+	setup.Secret = user.TOTPSecret
+	setup.URI = totp.URI(totpIssuer, user.Email, user.TOTPSecret)
+	png, err := qrcode.Encode(setup.URI, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+	setup.QRCode = template.URL("data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(png))
+	return &setup, nil
+}
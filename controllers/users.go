@@ -2,46 +2,144 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/email"
 	"lenslocked.com/models"
-	"lenslocked.com/rand"
+	"lenslocked.com/sso"
+	"lenslocked.com/throttle"
 	"lenslocked.com/views"
 )
 
-func NewUsers(us models.UserService) *Users {
+var (
+	// loginAccountThrottle slows down password guessing
+	// against a single account, no matter where it comes from.
+	loginAccountThrottle = throttle.Config{
+		Name:         "login account",
+		Free:         3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockoutAfter: 10,
+		LockoutFor:   15 * time.Minute,
+		Window:       time.Hour,
+	}
+
+	// loginIPThrottle slows down a single IP address trying
+	// lots of accounts. It is more forgiving than the account
+	// throttle, as many people can share an IP address.
+	loginIPThrottle = throttle.Config{
+		Name:         "login ip",
+		Free:         10,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockoutAfter: 50,
+		LockoutFor:   30 * time.Minute,
+		Window:       time.Hour,
+	}
+
+	// magicLinkThrottle limits how many sign in links and
+	// password reset emails can be sent to a single account.
+	magicLinkThrottle = throttle.Config{
+		Name:         "magic link",
+		Free:         3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		LockoutAfter: 10,
+		LockoutFor:   time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+func NewUsers(us models.UserService, ss models.SessionService, tfs models.TwoFactorService, as models.AuditService, emailer *email.Client, co cookies.Options, providers []*sso.Provider, registration models.RegistrationPolicy) *Users {
 	return &Users{
-		NewView:   views.NewView("bootstrap", "users/new"),
-		LoginView: views.NewView("bootstrap", "users/login"),
-		us:        us,
+		NewView:         views.NewView("bootstrap", "users/new"),
+		LoginView:       views.NewView("bootstrap", "users/login"),
+		ForgotPwView:    views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:     views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:     views.NewView("bootstrap", "users/account"),
+		TwoFactorView:   views.NewView("bootstrap", "users/two_factor"),
+		MagicLinkView:   views.NewView("bootstrap", "users/magic_link"),
+		us:              us,
+		ss:              ss,
+		tfs:             tfs,
+		as:              as,
+		ipThrottle:      throttle.New(loginIPThrottle),
+		accountThrottle: throttle.New(loginAccountThrottle),
+		linkThrottle:    throttle.New(magicLinkThrottle),
+		emailer:         emailer,
+		cookies:         co,
+		providers:       providers,
+		registration:    registration,
 	}
 }
 
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView         *views.View
+	LoginView       *views.View
+	ForgotPwView    *views.View
+	ResetPwView     *views.View
+	AccountView     *views.View
+	TwoFactorView   *views.View
+	MagicLinkView   *views.View
+	us              models.UserService
+	ss              models.SessionService
+	tfs             models.TwoFactorService
+	as              models.AuditService
+	ipThrottle      *throttle.Limiter
+	accountThrottle *throttle.Limiter
+	linkThrottle    *throttle.Limiter
+	emailer         *email.Client
+	cookies         cookies.Options
+	providers       []*sso.Provider
+	registration    models.RegistrationPolicy
 }
 
 // New is used to render the form where a user can
-// create a new user account.
+// create a new user account. Invite links fill in the invite
+// code for them.
 //
 // GET /signup
 func (u *Users) New(w http.ResponseWriter, r *http.Request) {
-	u.NewView.Render(w, r, nil)
+	// A bad query string just leaves the form empty.
+	var form SignupForm
+	parseURLParams(r, &form)
+	u.renderSignup(w, r, views.Data{}, form)
+}
+
+// SignupView is used to render the signup form. The form is
+// filled back in if signing up fails, except for the password.
+type SignupView struct {
+	SignupForm
+	InviteRequired bool
+}
+
+// renderSignup renders the signup page with the given data.
+func (u *Users) renderSignup(w http.ResponseWriter, r *http.Request, vd views.Data, form SignupForm) {
+	form.Password = ""
+	vd.Yield = SignupView{
+		SignupForm:     form,
+		InviteRequired: u.registration.InviteRequired(),
+	}
+	u.NewView.Render(w, r, vd)
 }
 
 type SignupForm struct {
-	Name     string `schema:"name"`
-	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Name       string `schema:"name"`
+	Username   string `schema:"username"`
+	Email      string `schema:"email"`
+	Password   string `schema:"password"`
+	InviteCode string `schema:"invite"`
 }
 
 type LoginForm struct {
-	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Email      string `schema:"email"`
+	Password   string `schema:"password"`
+	RememberMe bool   `schema:"remember_me"`
 }
 
 // Create is used to process the signup form when a user
@@ -53,25 +151,49 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var form SignupForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.NewView.Render(w, r, vd)
+		u.renderSignup(w, r, vd, form)
 		return
 	}
 	user := models.User{
-		Name:     form.Name,
-		Email:    form.Email,
-		Password: form.Password,
+		Name:       form.Name,
+		Username:   form.Username,
+		Email:      form.Email,
+		Password:   form.Password,
+		InviteCode: form.InviteCode,
 	}
 	if err := u.us.Create(&user); err != nil {
 		vd.SetAlert(err)
-		u.NewView.Render(w, r, vd)
+		u.renderSignup(w, r, vd, form)
 		return
 	}
-	err := u.signIn(w, &user)
+	if err := u.sendVerification(&user); err != nil {
+		// The user can always request another verification
+		// email, so this shouldn't stop them signing up.
+		log.Println(err)
+	}
+	err := u.signIn(w, r, &user, false)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome to LensLocked! Please check your inbox for a link to verify your email address.",
+	})
+}
+
+// LoginPage is used to render the login form, along with a
+// button for each provider users can sign in with.
+//
+// GET /login
+func (u *Users) LoginPage(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, r, views.Data{})
+}
+
+// renderLogin renders the login page with the given data.
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	vd.Yield = u.providers
+	u.LoginView.Render(w, r, vd)
 }
 
 // Login is used to process the login form when a user
@@ -84,7 +206,19 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	var form LoginForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	ip := clientIP(r)
+	account := strings.ToLower(strings.TrimSpace(form.Email))
+	wait := u.accountThrottle.Wait(account)
+	if ipWait := u.ipThrottle.Wait(ip); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		u.renderLogin(w, r, vd)
 		return
 	}
 
@@ -92,87 +226,738 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		switch err {
+		case models.ErrNotFound, models.ErrPasswordIncorrect:
+			// We respond the same way whether or not the account
+			// exists, so that the login form can't be used to
+			// find out who has signed up.
+			u.accountThrottle.Fail(account)
+			u.ipThrottle.Fail(ip)
+			u.recordFailedLogin(r, form.Email)
+			vd.AlertError("Invalid email address or password.")
+		default:
+			vd.SetAlert(err)
+		}
+		u.renderLogin(w, r, vd)
+		return
+	}
+	// We only reset the account, as an attacker could
+	// otherwise reset their IP address's failures by
+	// logging into an account of their own. Users with two
+	// factor authentication enabled haven't finished logging
+	// in yet, so theirs is reset once they enter a code.
+	if !user.TwoFactorEnabled() {
+		u.accountThrottle.Reset(account)
+	}
+
+	if err := u.completeLogin(w, r, user, form.RememberMe); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+}
+
+// MagicLinkForm is used to request a sign in link and to
+// use one.
+type MagicLinkForm struct {
+	Email      string `schema:"email"`
+	RememberMe bool   `schema:"remember_me"`
+	Token      string `schema:"token"`
+}
+
+// RequestMagicLink is used to process the form on the login
+// page where users can ask for a sign in link instead of
+// entering their password.
+//
+// POST /login/link/request
+func (u *Users) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	// Every link we send counts against the account, so the
+	// form can't be used to flood someone's inbox. We still
+	// respond as if we sent one when it is throttled, as
+	// anything else would reveal that the account exists.
+	account := strings.ToLower(strings.TrimSpace(form.Email))
+	if u.linkThrottle.Wait(account) == 0 {
+		token, err := u.us.InitiateMagicLink(form.Email, form.RememberMe)
+		switch err {
+		case nil:
+			u.linkThrottle.Fail(account)
+			if err := u.emailer.MagicLink(form.Email, token); err != nil {
+				vd.SetAlert(err)
+				u.renderLogin(w, r, vd)
+				return
+			}
 		case models.ErrNotFound:
-			vd.AlertError("No user exists with that email address")
 		default:
 			vd.SetAlert(err)
+			u.renderLogin(w, r, vd)
+			return
 		}
-		u.LoginView.Render(w, r, vd)
+	}
+
+	views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists with that email address, we have emailed it a link to sign in.",
+	})
+}
+
+// MagicLink displays a page asking the user to confirm that
+// they want to sign in with the link they were emailed. We
+// don't sign them in on a GET, as email scanners that follow
+// links would otherwise use up the link before the user can.
+//
+// GET /login/link
+func (u *Users) MagicLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.MagicLinkView.Render(w, r, vd)
+}
+
+// CompleteMagicLink uses up the sign in link and signs the
+// user in, going through two factor authentication first if
+// they have it enabled.
+//
+// POST /login/link
+func (u *Users) CompleteMagicLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form MagicLinkForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
 		return
 	}
 
-	err = u.signIn(w, user)
-	if err != nil {
+	user, rememberMe, err := u.us.CompleteMagicLink(form.Token)
+	switch err {
+	case nil:
+	case models.ErrTokenInvalid:
+		views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "That sign in link has expired or already been used. Please request a new one.",
+		})
+		return
+	default:
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.completeLogin(w, r, user, rememberMe); err != nil {
+		vd.SetAlert(err)
+		u.MagicLinkView.Render(w, r, vd)
+		return
+	}
+}
+
+// TwoFactorForm is used to process two factor codes.
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// LoginTwoFactor is used to process the second step of
+// logging in for users with two factor authentication
+// enabled. It expects the pending_2fa cookie set by Login.
+//
+// POST /login/2fa
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	cookie, err := r.Cookie(cookies.Pending2FA)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Codes are throttled along with passwords, so that
+	// starting a new sign in every few attempts doesn't give
+	// anyone more guesses.
+	pending, err := u.tfs.ChallengeUser(cookie.Value)
+	if err != nil {
+		u.challengeFailed(w, r, err)
+		return
+	}
+	ip := clientIP(r)
+	account := pending.Email
+	wait := u.accountThrottle.Wait(account)
+	if ipWait := u.ipThrottle.Wait(ip); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		u.TwoFactorView.Render(w, r, vd)
 		return
 	}
 
+	user, rememberMe, err := u.tfs.CompleteChallenge(cookie.Value, form.Code)
+	if err != nil {
+		if err == models.ErrCodeInvalid {
+			u.accountThrottle.Fail(account)
+			u.ipThrottle.Fail(ip)
+		}
+		u.challengeFailed(w, r, err)
+		return
+	}
+	u.accountThrottle.Reset(account)
+
+	u.cookies.Clear(w, cookies.Pending2FA)
+	err = u.signIn(w, r, user, rememberMe)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
 
+// challengeFailed lets the user know their code couldn't be
+// used, sending them back to log in again if their sign in
+// attempt is over.
+func (u *Users) challengeFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if err == models.ErrTokenInvalid {
+		u.cookies.Clear(w, cookies.Pending2FA)
+		views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Your sign in attempt has expired. Please log in again.",
+		})
+		return
+	}
+	var vd views.Data
+	vd.SetAlert(err)
+	u.TwoFactorView.Render(w, r, vd)
 }
 
 // Logout is used to delete a user's session cookie
-// and invalidate their current remember token, which will
-// sign the current user out.
+// and the session it refers to, which will sign the
+// current user out on this device only.
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	// First expire the user's cookie
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
-	// Then we update the user with a new remember token
-	user := context.User(r.Context())
-	// We are ignoring errors for now because they are
+	u.cookies.Clear(w, cookies.RememberToken)
+	// Then we delete the session so the token can't be used
+	// again. We are ignoring errors for now because they are
 	// unlikely, and even if they do occur we can't recover
 	// now that the user doesn't have a valid cookie
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.Update(user)
+	if session := context.Session(r.Context()); session != nil {
+		u.ss.Delete(session.ID)
+	}
+	user := context.User(r.Context())
+	u.as.Record(auditEvent(r, models.AuditLogout, models.AuditTargetUser, user.ID))
 	// Finally send the user to the home page
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// ResetPwForm is used to process both the forgot password
+// form and the reset password form.
+type ResetPwForm struct {
+	Email    string `schema:"email"`
+	Token    string `schema:"token"`
+	Password string `schema:"password"`
+}
+
+// InitiateReset is used to process the forgot password form
+// and email the user a token they can use to reset it.
+//
+// POST /forgot
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	// Reset emails share their limit with sign in links, as
+	// both can be used to flood someone's inbox. Like sign in
+	// links, we respond as if we sent one when it is
+	// throttled.
+	account := strings.ToLower(strings.TrimSpace(form.Email))
+	if u.linkThrottle.Wait(account) == 0 {
+		token, err := u.us.InitiateReset(form.Email)
+		switch err {
+		case nil:
+			u.linkThrottle.Fail(account)
+			err = u.emailer.ResetPw(form.Email, token)
+			if err != nil {
+				vd.SetAlert(err)
+				u.ForgotPwView.Render(w, r, vd)
+				return
+			}
+		case models.ErrNotFound:
+			// We don't want to reveal which email addresses have
+			// accounts, so we respond exactly as if we had sent
+			// an email.
+		default:
+			vd.SetAlert(err)
+			u.ForgotPwView.Render(w, r, vd)
+			return
+		}
+	}
+
+	views.RedirectAlert(w, r, "/reset", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists with that email address, we have emailed it instructions for resetting the password.",
+	})
+}
+
+// ResetPw displays the reset password form and has a method
+// so that we can prefill the form data with a token provided
+// via the URL query params.
+//
+// GET /reset
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.ResetPwView.Render(w, r, vd)
+}
+
+// CompleteReset processes the reset password form
+//
+// POST /reset
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	event := auditEvent(r, models.AuditPasswordReset, models.AuditTargetUser, user.ID)
+	event.ActorID = user.ID
+	u.as.Record(event)
+
+	// Anyone who was signed in with the old password should
+	// be signed out now that it has been reset.
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		log.Println(err)
+	}
+	// Resetting a password only proves the user can read
+	// their email, so suspended users are still turned away
+	// and those with two factor authentication enabled still
+	// need to enter a code.
+	if err := u.completeLogin(w, r, user, false); err != nil {
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/login", http.StatusFound, *vd.Alert)
+		return
+	}
+}
+
+// EmailForm is used to change a user's email address.
+type EmailForm struct {
+	Email string `schema:"email"`
+}
+
+// VerifyForm is used to read the token from the link in a
+// verification email.
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
+// Account displays the user's account settings, where they
+// can change their name, email address, and password.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = context.User(r.Context())
+	u.AccountView.Render(w, r, vd)
+}
+
+// ProfileForm is used to change what others see on a user's
+// profile.
+type ProfileForm struct {
+	Name     string `schema:"name"`
+	Username string `schema:"username"`
+	Bio      string `schema:"bio"`
+}
+
+// UpdateProfile processes the form on the account page used
+// to change the user's name, username, and bio.
+//
+// POST /account/profile
+func (u *Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form ProfileForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	changed := *user
+	changed.Name = strings.TrimSpace(form.Name)
+	changed.Username = form.Username
+	changed.Bio = form.Bio
+	if err := u.us.Update(&changed); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your profile has been updated.",
+	})
+}
+
+// PasswordChangeForm is used to change a user's password.
+type PasswordChangeForm struct {
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+}
+
+// ChangePassword processes the form on the account page used
+// to change the user's password. The current password is
+// required, and guesses at it are throttled just like the
+// login form, so a stolen session can't be used to take over
+// the account. Every other session is signed out once the
+// password has been changed.
+//
+// POST /account/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form PasswordChangeForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	account := strings.ToLower(user.Email)
+	if wait := u.accountThrottle.Wait(account); wait > 0 {
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	changed := *user
+	err := u.us.ChangePassword(&changed, form.CurrentPassword, form.NewPassword)
+	if err != nil {
+		if err == models.ErrPasswordIncorrect {
+			u.accountThrottle.Fail(account)
+		}
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.accountThrottle.Reset(account)
+	u.as.Record(auditEvent(r, models.AuditPasswordChanged, models.AuditTargetUser, user.ID))
+
+	var except []uint
+	if session := context.Session(r.Context()); session != nil {
+		except = append(except, session.ID)
+	}
+	if err := u.ss.DeleteByUserID(user.ID, except...); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your password has been changed, and you have been signed out everywhere else.",
+	})
+}
+
+// DeleteAccountForm is used to confirm that a user wants to
+// delete their account.
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+// DeleteAccount schedules the user's account for deletion
+// once they have confirmed their password, then signs them
+// out everywhere. The account isn't purged until the grace
+// period is over, and signing back in before then lets them
+// cancel.
+//
+// POST /account/delete
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form DeleteAccountForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	account := strings.ToLower(user.Email)
+	if wait := u.accountThrottle.Wait(account); wait > 0 {
+		vd.AlertError(fmt.Sprintf("Too many failed attempts. Please try again in %s.", waitString(wait)))
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	changed := *user
+	if err := u.us.ScheduleDeletion(&changed, form.Password); err != nil {
+		if err == models.ErrPasswordIncorrect {
+			u.accountThrottle.Fail(account)
+		}
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.accountThrottle.Reset(account)
+	u.as.Record(auditEvent(r, models.AuditAccountDeletionRequested, models.AuditTargetUser, user.ID))
+
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		log.Println(err)
+	}
+	u.cookies.Clear(w, cookies.RememberToken)
+	if err := u.emailer.AccountDeletion(changed.Email, changed.PurgeAt()); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: "Your account will be deleted on " + changed.PurgeAt().Format("January 2, 2006") + ". Log in before then if you change your mind.",
+	})
+}
+
+// CancelDeletion stops the user's account from being
+// deleted.
+//
+// POST /account/delete/cancel
+func (u *Users) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.us.CancelDeletion(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/account", http.StatusFound, *vd.Alert)
+		return
+	}
+	u.as.Record(auditEvent(r, models.AuditAccountDeletionCancelled, models.AuditTargetUser, user.ID))
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome back! Your account will not be deleted.",
+	})
+}
+
+// ChangeEmail processes the change email form on the account
+// page. The new address is stored as pending until the user
+// follows the link we email to it, and checked again to make
+// sure nobody else has taken it in the meantime.
+//
+// POST /account/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form EmailForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	// We work on a copy so that a failed change doesn't show
+	// up as pending when we render the form again.
+	changed := *user
+	token, err := u.us.RequestEmailChange(&changed, form.Email)
+	if err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if token == "" {
+		views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "That is already your email address.",
+		})
+		return
+	}
+	if err := u.emailer.VerifyEmail(changed.PendingEmail, token); err != nil {
+		vd.Yield = &changed
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We have emailed a verification link to " + changed.PendingEmail + ". Your email address will be updated once you follow it.",
+	})
+}
+
+// ResendVerification sends the user a new verification
+// email for their pending or unverified email address.
+//
+// POST /account/email/verify
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() && user.PendingEmail == "" {
+		views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "Your email address has already been verified.",
+		})
+		return
+	}
+	if err := u.sendVerification(user); err != nil {
+		var vd views.Data
+		vd.Yield = user
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "A new verification link is on its way to your inbox.",
+	})
+}
+
+// Verify processes the link from a verification email.
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form VerifyForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/", http.StatusFound, *vd.Alert)
+		return
+	}
+	if _, err := u.us.CompleteVerification(form.Token); err != nil {
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/", http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks! Your email address has been verified.",
+	})
+}
+
 // CookieTest is used to display cookies set on the current user
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+	cookie, err := r.Cookie(cookies.RememberToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	user, err := u.us.ByRemember(cookie.Value)
+	session, err := u.ss.ByRemember(cookie.Value)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintln(w, user)
+	fmt.Fprintln(w, session)
 }
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
+// sendVerification emails the user a link to verify their
+// pending email address, or their current one if they
+// aren't changing it.
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	to := user.Email
+	if user.PendingEmail != "" {
+		to = user.PendingEmail
+	}
+	return u.emailer.VerifyEmail(to, token)
+}
+
+// completeLogin is used once a user has proven who they are,
+// either with their password or a sign in link. Users with
+// two factor authentication enabled are sent on to enter
+// their code, and everyone else is signed in. The user is
+// only redirected if there was no error.
+func (u *Users) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, rememberMe bool) error {
+	if user.Suspended() {
+		return models.ErrAccountSuspended
+	}
+	if user.TwoFactorEnabled() {
+		// The user isn't signed in until they give us a valid
+		// code as well.
+		token, err := u.tfs.CreateChallenge(user, rememberMe)
 		if err != nil {
 			return err
 		}
+		u.cookies.Set(w, cookies.Pending2FA, token, time.Now().Add(5*time.Minute))
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
 	}
 
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+	if err := u.signIn(w, r, user, rememberMe); err != nil {
+		return err
 	}
-	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
 	return nil
 }
+
+// signIn is used to sign the given user in via cookies. A
+// new session is created every time, so signing in on one
+// device doesn't affect any others.
+//
+// Unless the user asked us to remember them, the cookie only
+// lasts until they close their browser. Otherwise it lasts
+// as long as the session would if it went unused, and the
+// User middleware pushes that back as the session is used.
+//
+// Every way of signing in ends up here, so this is where
+// suspended users are turned away.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User, rememberMe bool) error {
+	if user.Suspended() {
+		return models.ErrAccountSuspended
+	}
+	session := models.Session{
+		UserID:     user.ID,
+		Persistent: rememberMe,
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+	}
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if session.Persistent {
+		expires = session.IdleExpiresAt
+	}
+	u.cookies.Set(w, cookies.RememberToken, session.Remember, expires)
+	event := auditEvent(r, models.AuditLogin, models.AuditTargetUser, user.ID)
+	event.ActorID = user.ID
+	u.as.Record(event)
+	return nil
+}
+
+// recordFailedLogin records a failed attempt to sign in with
+// the email address. If it belongs to a user, they are the
+// target, so the attempt shows up in their security history.
+func (u *Users) recordFailedLogin(r *http.Request, email string) {
+	event := auditEvent(r, models.AuditLoginFailed, "", 0)
+	event.Details = email
+	if user, err := u.us.ByEmail(email); err == nil {
+		event.TargetType = models.AuditTargetUser
+		event.TargetID = user.ID
+	}
+	u.as.Record(event)
+}
@@ -0,0 +1,74 @@
+// Package cookies is used to set the cookies we use to keep
+// track of users, so that they all get the same security
+// attributes no matter where they are set.
+package cookies
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// RememberToken holds the remember token of the user's
+	// current session.
+	RememberToken = "remember_token"
+
+	// Pending2FA holds the token of a sign in that is waiting
+	// on a two factor code.
+	Pending2FA = "pending_2fa"
+
+	// OAuthState holds what we need to finish signing in with
+	// an OpenID Connect provider once it sends the user back.
+	OAuthState = "oauth_state"
+
+	// Impersonator holds an admin's own remember token while
+	// they are signed in as someone else, so they can go back
+	// to being themselves.
+	Impersonator = "impersonator"
+)
+
+// GalleryUnlock returns the name of the cookie that holds the
+// token a visitor was given when they unlocked a password
+// protected gallery. Each gallery has its own cookie so that
+// unlocking one doesn't forget the others.
+func GalleryUnlock(galleryID uint) string {
+	return "gallery_unlock_" + strconv.FormatUint(uint64(galleryID), 10)
+}
+
+// Options are applied to every cookie we set. Secure should
+// be true whenever we are served over HTTPS, which is to say
+// in production.
+type Options struct {
+	Secure bool
+}
+
+// Set sets a cookie that scripts can't read and that isn't
+// sent along with cross-site subrequests. If expires is the
+// zero time the cookie only lasts until the browser closes.
+func (o Options) Set(w http.ResponseWriter, name, value string, expires time.Time) {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   o.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// Clear expires the cookie with the given name.
+func (o Options) Clear(w http.ResponseWriter, name string) {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   o.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
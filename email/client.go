@@ -0,0 +1,230 @@
+package email
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	resetSubject  = "Instructions for resetting your password."
+	resetBaseURL  = "/reset"
+	resetTextTmpl = `Hi there!
+
+It appears that you have requested a password reset. If this was you, please follow the link below to update your password:
+
+%s
+
+If you are asked for a token, please use the following value:
+
+%s
+
+If you didn't request a password reset you can safely ignore this email and your account will not be changed.
+
+Best,
+LensLocked Support
+`
+
+	verifySubject  = "Please verify your email address."
+	verifyBaseURL  = "/verify"
+	verifyTextTmpl = `Hi there!
+
+Please confirm that this is your email address by following the link below:
+
+%s
+
+If you didn't sign up for LensLocked or change your email address you can safely ignore this email.
+
+Best,
+LensLocked Support
+`
+
+	deletionSubject  = "Your LensLocked account will be deleted."
+	deletionTextTmpl = `Hi there!
+
+We have received your request to delete your LensLocked account. Your account, galleries, and images will be permanently deleted on %s.
+
+If you change your mind before then, log in at the link below and cancel the deletion from the banner at the top of the page:
+
+%s
+
+Best,
+LensLocked Support
+`
+
+	exportSubject  = "Your LensLocked data export is ready."
+	exportBaseURL  = "/account/export"
+	exportTextTmpl = `Hi there!
+
+The export of your LensLocked data that you asked for is ready. You can download it from the link below until %s:
+
+%s
+
+If you didn't ask for an export, please change your password, as someone else may have access to your account.
+
+Best,
+LensLocked Support
+`
+
+	collaboratorSubject  = "%s shared a gallery with you on LensLocked."
+	collaboratorBaseURL  = "/galleries"
+	collaboratorTextTmpl = `Hi there!
+
+%s has invited you to collaborate on the gallery "%s" on LensLocked, with the %s role.
+
+To accept the invitation, sign in or sign up with this email address and follow the link below:
+
+%s
+
+If you don't want to join the gallery you can safely ignore this email.
+
+Best,
+LensLocked Support
+`
+
+	magicLinkSubject  = "Your LensLocked sign in link."
+	magicLinkBaseURL  = "/login/link"
+	magicLinkTextTmpl = `Hi there!
+
+Follow the link below to sign in to LensLocked. The link can only be used once and expires in a few minutes:
+
+%s
+
+If you didn't ask to sign in you can safely ignore this email.
+
+Best,
+LensLocked Support
+`
+)
+
+type ClientConfig func(*Client)
+
+// WithMailer sets the Mailer used to deliver emails.
+func WithMailer(mailer Mailer) ClientConfig {
+	return func(c *Client) {
+		c.mailer = mailer
+	}
+}
+
+// WithSender sets the name and email address that our
+// emails will appear to be sent from.
+func WithSender(name, email string) ClientConfig {
+	return func(c *Client) {
+		c.from = buildEmail(name, email)
+	}
+}
+
+// WithBaseURL sets the URL that links in our emails are
+// built from, eg "https://www.lenslocked.com"
+func WithBaseURL(baseURL string) ClientConfig {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// NewClient accepts a list of config functions to run, much
+// like models.NewServices does. If no Mailer is provided
+// the client will fall back to logging emails.
+func NewClient(opts ...ClientConfig) *Client {
+	client := Client{
+		from:   "LensLocked Support <support@lenslocked.com>",
+		mailer: LogMailer{},
+	}
+	for _, opt := range opts {
+		opt(&client)
+	}
+	return &client
+}
+
+// Client is used to build and send all of the emails our
+// application sends to its users.
+type Client struct {
+	from    string
+	baseURL string
+	mailer  Mailer
+}
+
+// ResetPw will email the user a link they can use to reset
+// their password, along with the reset token in case they
+// need to enter it manually.
+func (c *Client) ResetPw(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	resetURL := c.baseURL + resetBaseURL + "?" + v.Encode()
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: resetSubject,
+		Text:    fmt.Sprintf(resetTextTmpl, resetURL, token),
+	})
+}
+
+// VerifyEmail will email the user a link they can use to
+// confirm that they own the email address.
+func (c *Client) VerifyEmail(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := c.baseURL + verifyBaseURL + "?" + v.Encode()
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: verifySubject,
+		Text:    fmt.Sprintf(verifyTextTmpl, verifyURL),
+	})
+}
+
+// MagicLink will email the user a link they can use to sign
+// in without their password.
+func (c *Client) MagicLink(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	linkURL := c.baseURL + magicLinkBaseURL + "?" + v.Encode()
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: magicLinkSubject,
+		Text:    fmt.Sprintf(magicLinkTextTmpl, linkURL),
+	})
+}
+
+// AccountDeletion will email the user to let them know when
+// their account will be deleted, and how to stop it.
+func (c *Client) AccountDeletion(toEmail string, purgeAt time.Time) error {
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: deletionSubject,
+		Text:    fmt.Sprintf(deletionTextTmpl, purgeAt.Format("January 2, 2006"), c.baseURL+"/login"),
+	})
+}
+
+// ExportReady will email the user to let them know their
+// data export can be downloaded, and until when.
+func (c *Client) ExportReady(toEmail string, expiresAt time.Time) error {
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: exportSubject,
+		Text:    fmt.Sprintf(exportTextTmpl, expiresAt.Format("January 2, 2006 at 3:04 PM MST"), c.baseURL+exportBaseURL),
+	})
+}
+
+// CollaboratorInvite will email somebody who has been invited
+// to collaborate on a gallery, letting them know who invited
+// them and what they will be able to do.
+func (c *Client) CollaboratorInvite(toEmail, inviter, galleryTitle, role string) error {
+	return c.mailer.Send(Message{
+		From:    c.from,
+		To:      toEmail,
+		Subject: fmt.Sprintf(collaboratorSubject, inviter),
+		Text:    fmt.Sprintf(collaboratorTextTmpl, inviter, galleryTitle, strings.ToLower(role), c.baseURL+collaboratorBaseURL),
+	})
+}
+
+func buildEmail(name, email string) string {
+	if name == "" {
+		return email
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
@@ -0,0 +1,121 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a single plain text email that is ready to be
+// handed off to a Mailer for delivery.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer is used to deliver emails. Our Client builds the
+// messages we send, and a Mailer is responsible for getting
+// them to the recipient, which makes it easy to swap out the
+// real thing for something local while developing.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// LogMailer doesn't deliver emails at all. Instead it writes
+// them to the standard logger so that we can copy links out
+// of our terminal while working locally.
+type LogMailer struct{}
+
+func (lm LogMailer) Send(msg Message) error {
+	log.Printf("email: From: %s\nTo: %s\nSubject: %s\n\n%s\n",
+		msg.From, msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// FileMailer doesn't deliver emails either. Instead it writes
+// each one to its own file in Dir, which is handy when the
+// terminal is too noisy to find them, or when a script needs
+// to pick up a link.
+type FileMailer struct {
+	Dir string
+}
+
+func (fm FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(fm.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml",
+		time.Now().Format("20060102-150405.000000000"), fileSafe(msg.To))
+	path := filepath.Join(fm.Dir, name)
+	if err := ioutil.WriteFile(path, buildMessage(msg), 0644); err != nil {
+		return err
+	}
+	log.Printf("email: wrote %q to %s\n", msg.Subject, path)
+	return nil
+}
+
+// fileSafe replaces anything but letters, digits, dots, and
+// dashes so an email address can be used in a file name.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// SMTPMailer delivers emails using a plain SMTP server.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (sm SMTPMailer) Send(msg Message) error {
+	addr := fmt.Sprintf("%s:%d", sm.Host, sm.Port)
+	var auth smtp.Auth
+	if sm.Username != "" {
+		auth = smtp.PlainAuth("", sm.Username, sm.Password, sm.Host)
+	}
+	return smtp.SendMail(addr, auth, fromAddress(msg.From),
+		[]string{msg.To}, buildMessage(msg))
+}
+
+// buildMessage converts a message into the raw bytes
+// expected by smtp.SendMail, headers and all.
+func buildMessage(msg Message) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&sb, "To: %s\r\n", msg.To)
+	// Subjects can include names our users chose, which
+	// could contain anything, so they're always encoded.
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.Replace(msg.Text, "\n", "\r\n", -1))
+	return []byte(sb.String())
+}
+
+// fromAddress pulls the bare email address out of a from
+// value like "LensLocked Support <support@lenslocked.com>"
+func fromAddress(from string) string {
+	start := strings.LastIndex(from, "<")
+	end := strings.LastIndex(from, ">")
+	if start < 0 || end < start {
+		return from
+	}
+	return from[start+1 : end]
+}
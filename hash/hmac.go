@@ -5,27 +5,68 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"hash"
+	"sync"
 )
 
-// NewHMAC creates and returns a new HMAC object
-func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+// NewHMAC creates and returns a new HMAC object that uses
+// the active key in keys for hashing, but can produce
+// hashes with any of the keys so that values hashed before
+// a key was rotated can still be looked up.
+func NewHMAC(keys KeySet) HMAC {
+	ids := keys.IDs()
+	pools := make([]*sync.Pool, len(ids))
+	for i, id := range ids {
+		key, _ := keys.Key(id)
+		pools[i] = newMACPool([]byte(key))
+	}
 	return HMAC{
-		hmac: h,
+		pools: pools,
 	}
 }
 
 // HMAC is a wrapper around the crypto/hmac package making
-// it a little easier to use in our code.
+// it a little easier to use in our code. It is safe for
+// concurrent use.
 type HMAC struct {
-	hmac hash.Hash
+	// pools has one entry per key, starting with the active
+	// key. A hash.Hash keeps state between calls, so each
+	// goroutine borrows its own from the pool rather than
+	// sharing one, and we avoid setting up a new HMAC (which
+	// hashes the key) on every call.
+	pools []*sync.Pool
+}
+
+func newMACPool(key []byte) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return hmac.New(sha256.New, key)
+		},
+	}
 }
 
 // Hash will hash the provided input string using HMAC with
-// the secret key provided when the HMAC object was created
+// the active secret key provided when the HMAC object was
+// created
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	return h.hash(h.pools[0], input)
+}
+
+// HashAll will hash the provided input string with every
+// key, starting with the active key. This is used to look
+// up values that may have been hashed with an older key.
+func (h HMAC) HashAll(input string) []string {
+	ret := make([]string, len(h.pools))
+	for i, pool := range h.pools {
+		ret[i] = h.hash(pool, input)
+	}
+	return ret
+}
+
+func (h HMAC) hash(pool *sync.Pool, input string) string {
+	mac := pool.Get().(hash.Hash)
+	defer pool.Put(mac)
+	mac.Reset()
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
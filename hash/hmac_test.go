@@ -0,0 +1,84 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func expectedHMAC(key, input string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(input))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACHash(t *testing.T) {
+	h := NewHMAC(SingleKey("secret"))
+	for _, input := range []string{"", "a", "remember-token"} {
+		if got, want := h.Hash(input), expectedHMAC("secret", input); got != want {
+			t.Errorf("Hash(%q) = %q; want %q", input, got, want)
+		}
+	}
+}
+
+func TestHMACHashAll(t *testing.T) {
+	h := NewHMAC(KeySet{
+		Active: "new",
+		Keys: map[string]string{
+			"old": "old-secret",
+			"new": "new-secret",
+		},
+	})
+	got := h.HashAll("token")
+	want := []string{
+		expectedHMAC("new-secret", "token"),
+		expectedHMAC("old-secret", "token"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("HashAll() returned %d hashes; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("HashAll()[%d] = %q; want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// TestHMACConcurrent is meant to be run with -race. Before
+// HMAC pooled its hashes every goroutine shared one
+// hash.Hash and this would both race and return garbage.
+func TestHMACConcurrent(t *testing.T) {
+	h := NewHMAC(KeySet{
+		Active: "b",
+		Keys:   map[string]string{"a": "key-a", "b": "key-b"},
+	})
+	const goroutines, iterations = 50, 200
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				input := fmt.Sprintf("token-%d-%d", g, i)
+				if got, want := h.Hash(input), expectedHMAC("key-b", input); got != want {
+					errs <- fmt.Errorf("Hash(%q) = %q; want %q", input, got, want)
+					return
+				}
+				all := h.HashAll(input)
+				if all[1] != expectedHMAC("key-a", input) {
+					errs <- fmt.Errorf("HashAll(%q)[1] = %q; want %q", input, all[1], expectedHMAC("key-a", input))
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package hash
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultKeyID is the ID given to a key that was configured
+// on its own, before we supported rotating keys.
+const DefaultKeyID = "default"
+
+// KeySet is a set of versioned secret keys. The Active key is
+// used for anything new that we hash, and every key in Keys
+// can still be used to check existing hashes. Rotating a key
+// is a matter of adding a new one, making it active, and then
+// removing the old one once everything has been rehashed.
+type KeySet struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// SingleKey returns a KeySet with just the one key in it.
+func SingleKey(key string) KeySet {
+	return KeySet{
+		Active: DefaultKeyID,
+		Keys:   map[string]string{DefaultKeyID: key},
+	}
+}
+
+// Validate makes sure that the active key exists.
+func (ks KeySet) Validate() error {
+	if _, ok := ks.Keys[ks.Active]; !ok {
+		return fmt.Errorf("hash: active key %q is not in the key set", ks.Active)
+	}
+	return nil
+}
+
+// ActiveKey returns the ID and value of the active key.
+func (ks KeySet) ActiveKey() (string, string) {
+	return ks.Active, ks.Keys[ks.Active]
+}
+
+// Key returns the key with the given ID, if there is one.
+func (ks KeySet) Key(id string) (string, bool) {
+	key, ok := ks.Keys[id]
+	return key, ok
+}
+
+// IDs returns the ID of every key in the set, starting with
+// the active key so that it is always tried first.
+func (ks KeySet) IDs() []string {
+	ids := make([]string, 0, len(ks.Keys))
+	for id := range ks.Keys {
+		if id != ks.Active {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return append([]string{ks.Active}, ids...)
+}
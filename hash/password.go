@@ -0,0 +1,231 @@
+package hash
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/rand"
+)
+
+var (
+	// ErrPasswordMismatch is returned when a password doesn't
+	// match the hash it is compared against.
+	ErrPasswordMismatch = errors.New("hash: password does not match")
+
+	// ErrUnknownHash is returned when none of our hashers
+	// recognize the format of a password hash.
+	ErrUnknownHash = errors.New("hash: unknown password hash format")
+)
+
+// PasswordHasher is implemented by each password hashing
+// algorithm we support.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password. The
+	// encoding includes the algorithm, parameters and salt.
+	Hash(password string) (string, error)
+
+	// Compare returns nil if the password matches the hash,
+	// or ErrPasswordMismatch if it doesn't.
+	Compare(hash, password string) error
+
+	// Handles returns true if the hash was created by this
+	// algorithm, which we can tell from its prefix.
+	Handles(hash string) bool
+
+	// NeedsRehash returns true if the hash was created with
+	// weaker parameters than the hasher is set up to use.
+	NeedsRehash(hash string) bool
+}
+
+// NewPasswords returns a Passwords that hashes all new
+// passwords with current, but can still check passwords
+// hashed by any of the others.
+func NewPasswords(current PasswordHasher, others ...PasswordHasher) *Passwords {
+	return &Passwords{
+		current: current,
+		hashers: append([]PasswordHasher{current}, others...),
+	}
+}
+
+// Passwords picks the right PasswordHasher for a stored hash
+// so that we can change algorithms, or make the current one
+// stronger, without forcing every user to reset their
+// password.
+type Passwords struct {
+	current PasswordHasher
+	hashers []PasswordHasher
+}
+
+// Hash hashes the password with the current algorithm.
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Compare checks the password against the hash using the
+// algorithm that created it. If the password matches but the
+// hash was made with an old algorithm or weaker parameters,
+// rehash will be true and the caller should hash the
+// password again with Hash and store the result.
+func (p *Passwords) Compare(hash, password string) (rehash bool, err error) {
+	for _, h := range p.hashers {
+		if !h.Handles(hash) {
+			continue
+		}
+		if err := h.Compare(hash, password); err != nil {
+			return false, err
+		}
+		return h != p.current || h.NeedsRehash(hash), nil
+	}
+	return false, ErrUnknownHash
+}
+
+// Bcrypt hashes passwords using bcrypt, which salts for us.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (b Bcrypt) Compare(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (b Bcrypt) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+func (b Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < b.cost()
+}
+
+func (b Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Argon2id hashes passwords using argon2id. Hashes are
+// encoded in the same format as the reference implementation,
+// eg "$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>"
+type Argon2id struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory is the amount of memory used in KiB.
+	Memory uint32
+	// Threads is the number of threads used.
+	Threads uint8
+	// SaltLen and KeyLen are in bytes.
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2id uses the parameters recommended by the
+// argon2 package docs for interactive logins.
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Time:    1,
+		Memory:  64 * 1024,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt, err := rand.Bytes(int(a.SaltLen))
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2id) Compare(hash, password string) error {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time,
+		params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (a Argon2id) Handles(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+func (a Argon2id) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time < a.Time ||
+		params.Memory < a.Memory ||
+		params.Threads < a.Threads ||
+		uint32(len(salt)) < a.SaltLen ||
+		uint32(len(key)) < a.KeyLen
+}
+
+// decodeArgon2id splits an encoded argon2id hash into the
+// parameters, salt and key it was made with.
+func decodeArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(hash, "$")
+	// parts[0] is the empty string before the leading $
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
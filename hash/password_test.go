@@ -0,0 +1,112 @@
+package hash
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// These are far too weak for real passwords, but keep the
+// tests fast.
+var (
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+	testArgon2id = Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}
+)
+
+func TestPasswordHashers(t *testing.T) {
+	for _, h := range []PasswordHasher{testBcrypt, testArgon2id} {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatalf("%T.Hash() err = %v", h, err)
+		}
+		if !h.Handles(hash) {
+			t.Errorf("%T.Handles(%q) = false; want true", h, hash)
+		}
+		if err := h.Compare(hash, "password"); err != nil {
+			t.Errorf("%T.Compare(right password) = %v; want nil", h, err)
+		}
+		if err := h.Compare(hash, "wrong"); err != ErrPasswordMismatch {
+			t.Errorf("%T.Compare(wrong password) = %v; want %v", h, err, ErrPasswordMismatch)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%T.NeedsRehash(own hash) = true; want false", h)
+		}
+	}
+}
+
+func TestPasswordsCompare(t *testing.T) {
+	bcryptHash, _ := testBcrypt.Hash("password")
+	argonHash, _ := testArgon2id.Hash("password")
+	p := NewPasswords(testArgon2id, testBcrypt)
+
+	tests := []struct {
+		hash     string
+		password string
+		rehash   bool
+		err      error
+		name     string
+	}{
+		{argonHash, "password", false, nil, "current algorithm"},
+		{bcryptHash, "password", true, nil, "old algorithm"},
+		{bcryptHash, "wrong", false, ErrPasswordMismatch, "old algorithm, wrong password"},
+		{"$1$plain", "password", false, ErrUnknownHash, "unknown algorithm"},
+	}
+	for _, tc := range tests {
+		rehash, err := p.Compare(tc.hash, tc.password)
+		if rehash != tc.rehash || err != tc.err {
+			t.Errorf("Compare(%s) = %v, %v; want %v, %v", tc.name, rehash, err, tc.rehash, tc.err)
+		}
+	}
+
+	hash, err := p.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testArgon2id.Handles(hash) {
+		t.Errorf("Hash() = %q; want an argon2id hash", hash)
+	}
+}
+
+func TestBcryptHandles(t *testing.T) {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if !testBcrypt.Handles(prefix + "10$abc") {
+			t.Errorf("Handles(%s) = false; want true", prefix)
+		}
+	}
+	if testBcrypt.Handles("$argon2id$v=19$") {
+		t.Errorf("Handles(argon2id) = true; want false")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcryptHash, _ := testBcrypt.Hash("password")
+	argonHash, _ := testArgon2id.Hash("password")
+	stronger := func(change func(*Argon2id)) Argon2id {
+		a := testArgon2id
+		change(&a)
+		return a
+	}
+
+	tests := []struct {
+		h    PasswordHasher
+		hash string
+		want bool
+		name string
+	}{
+		{testBcrypt, bcryptHash, false, "bcrypt same cost"},
+		{Bcrypt{Cost: bcrypt.MinCost + 1}, bcryptHash, true, "bcrypt higher cost"},
+		{testBcrypt, "$2a$garbage", true, "bcrypt unreadable"},
+		{testArgon2id, argonHash, false, "argon2id same parameters"},
+		{stronger(func(a *Argon2id) { a.Time++ }), argonHash, true, "argon2id more time"},
+		{stronger(func(a *Argon2id) { a.Memory *= 2 }), argonHash, true, "argon2id more memory"},
+		{stronger(func(a *Argon2id) { a.Threads++ }), argonHash, true, "argon2id more threads"},
+		{stronger(func(a *Argon2id) { a.KeyLen *= 2 }), argonHash, true, "argon2id longer key"},
+		{stronger(func(a *Argon2id) { a.Time = 0 }), argonHash, false, "argon2id less time"},
+		{testArgon2id, "$argon2id$garbage", true, "argon2id unreadable"},
+	}
+	for _, tc := range tests {
+		if got := tc.h.NeedsRehash(tc.hash); got != tc.want {
+			t.Errorf("NeedsRehash(%s) = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
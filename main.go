@@ -3,11 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"lenslocked.com/controllers"
+	"lenslocked.com/cookies"
+	"lenslocked.com/email"
 	"lenslocked.com/middleware"
 	"lenslocked.com/models"
 	"lenslocked.com/rand"
@@ -15,15 +20,37 @@ import (
 
 func main() {
 	boolPtr := flag.Bool("prod", false, "Provide this flag in production. This ensures that a .config file is provided before the application starts.")
+	makeAdmin := flag.String("make-admin", "", "Give the user with this email address the admin role, then exit. This is how the first admin is created.")
 	flag.Parse()
 	cfg := LoadConfig(*boolPtr)
 	dbCfg := cfg.Database
+	sessionLifetime, err := cfg.Session.Lifetime()
+	if err != nil {
+		panic(err)
+	}
+	providers, err := cfg.Providers()
+	if err != nil {
+		panic(err)
+	}
+	registration, err := cfg.Registration.Policy()
+	if err != nil {
+		panic(err)
+	}
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
-		models.WithGallery(),
+		models.WithUser(cfg.PepperKeys(), cfg.HMACKeySet(), cfg.Password.Passwords(), registration),
+		models.WithSession(cfg.HMACKeySet(), sessionLifetime),
+		models.WithTwoFactor(cfg.HMACKeySet()),
+		models.WithIdentity(),
+		models.WithGallery(cfg.HMACKeySet()),
 		models.WithImage(),
+		models.WithExport(),
+		models.WithAPIToken(cfg.HMACKeySet()),
+		models.WithAudit(),
+		models.WithInvite(),
+		models.WithShareLink(),
+		models.WithCollaborator(),
 	)
 	if err != nil {
 		panic(err)
@@ -32,41 +59,173 @@ func main() {
 	defer services.Close()
 	services.AutoMigrate()
 
+	if *makeAdmin != "" {
+		if err := promoteToAdmin(services.User, *makeAdmin); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(*makeAdmin, "is now an admin.")
+		return
+	}
+
+	// Accounts are purged once their deletion grace period is
+	// over, and exports once they expire. Checking once an hour
+	// is plenty, as both last for days.
+	go func() {
+		for {
+			if err := services.PurgeDeletedUsers(); err != nil {
+				log.Println(err)
+			}
+			if err := services.Export.Cleanup(); err != nil {
+				log.Println(err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	r := mux.NewRouter()
 
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	mailCfg := cfg.Mailer
+	emailer := email.NewClient(
+		email.WithSender(mailCfg.FromName, mailCfg.FromEmail),
+		email.WithMailer(mailCfg.Mailer()),
+		email.WithBaseURL(cfg.BaseURL),
+	)
+
+	// Cookies are only marked Secure in production, as we
+	// don't serve HTTPS while developing.
+	cookieOpts := cookies.Options{Secure: cfg.IsProd()}
+	usersC := controllers.NewUsers(services.User, services.Session, services.TwoFactor, services.Audit, emailer, cookieOpts, providers, registration)
+	sessionsC := controllers.NewSessions(services.Session, cookieOpts)
+	twoFactorC := controllers.NewTwoFactor(services.TwoFactor, usersC)
+	oauthC := controllers.NewOAuth(providers, services.Identity, usersC, cookieOpts)
+	exportsC := controllers.NewExports(services.Export, emailer)
+	apiTokensC := controllers.NewAPITokens(services.APIToken, services.Audit)
+	adminC := controllers.NewAdmin(services.User, services.Session, services.Gallery, services.Audit, cookieOpts)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.Collaborator, services.User, services.Audit, emailer, cookieOpts, r)
+	auditC := controllers.NewAudit(services.Audit, services.User)
+	profilesC := controllers.NewProfiles(services.User, services.Gallery)
+	avatarsC := controllers.NewAvatars(services.User, services.Image)
+	invitesC := controllers.NewInvites(services.Invite, registration, cfg.BaseURL)
 
 	userMw := middleware.User{
-		UserService: services.User,
+		UserService:     services.User,
+		SessionService:  services.Session,
+		APITokenService: services.APIToken,
+		Cookies:         cookieOpts,
 	}
 	requireUserMw := middleware.RequireUser{}
+	requireVerifiedMw := middleware.RequireVerifiedEmail{}
+	// Admins who are signed in as another user can't change
+	// that user's account settings.
+	accountMw := middleware.RequireUser{NoImpersonation: true}
+	accountVerifiedMw := middleware.RequireVerifiedEmail{RequireUser: accountMw}
+	// These also let through requests made with API tokens
+	// that have the scope.
+	readGalleriesMw := middleware.RequireUser{Scope: models.ScopeGalleriesRead}
+	writeGalleriesMw := middleware.RequireUser{Scope: models.ScopeGalleriesWrite}
+	writeGalleriesVerifiedMw := middleware.RequireVerifiedEmail{RequireUser: writeGalleriesMw}
+	// Some galleries, and the profiles and share links that
+	// lead to them, can be seen without signing in, but API
+	// tokens still need to be allowed to read them.
+	galleriesScopeMw := middleware.RequireScope{Scope: models.ScopeGalleriesRead}
+	requireModeratorMw := middleware.RequireRole{Role: models.RoleModerator}
+	requireAdminMw := middleware.RequireRole{Role: models.RoleAdmin}
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
 	r.Handle("/faq", staticC.Faq).Methods("GET")
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
+	r.HandleFunc("/login", usersC.LoginPage).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.Handle("/login/2fa", usersC.TwoFactorView).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.LoginTwoFactor).Methods("POST")
+	r.HandleFunc("/login/link/request", usersC.RequestMagicLink).Methods("POST")
+	r.HandleFunc("/login/link", usersC.MagicLink).Methods("GET")
+	r.HandleFunc("/login/link", usersC.CompleteMagicLink).Methods("POST")
+	r.HandleFunc("/auth/{provider}", oauthC.Start).Methods("POST")
+	r.HandleFunc("/auth/{provider}/callback", oauthC.Callback).Methods("GET")
 	r.Handle("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
+	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
+	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/account", accountMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account/profile", accountMw.ApplyFn(usersC.UpdateProfile)).Methods("POST")
+	r.HandleFunc("/account/avatar", accountMw.ApplyFn(avatarsC.Upload)).Methods("POST")
+	r.HandleFunc("/account/avatar/delete", accountMw.ApplyFn(avatarsC.Delete)).Methods("POST")
+	r.HandleFunc("/account/password", accountMw.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/account/delete", accountMw.ApplyFn(usersC.DeleteAccount)).Methods("POST")
+	r.HandleFunc("/account/delete/cancel", accountMw.ApplyFn(usersC.CancelDeletion)).Methods("POST")
+	// The email settings used to live on their own page, so we
+	// keep the old URL working for anyone who bookmarked it.
+	r.Handle("/account/email", http.RedirectHandler("/account", http.StatusMovedPermanently)).Methods("GET")
+	r.HandleFunc("/account/email", accountMw.ApplyFn(usersC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/email/verify", accountMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account/sessions", accountMw.ApplyFn(sessionsC.Index)).Methods("GET")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/delete", accountMw.ApplyFn(sessionsC.Delete)).Methods("POST")
+	r.HandleFunc("/account/security", accountMw.ApplyFn(auditC.Index)).Methods("GET")
+	r.HandleFunc("/account/2fa", accountMw.ApplyFn(twoFactorC.Setup)).Methods("GET")
+	r.HandleFunc("/account/2fa", accountMw.ApplyFn(twoFactorC.Enable)).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery", accountMw.ApplyFn(twoFactorC.RecoveryCodes)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", accountMw.ApplyFn(twoFactorC.Disable)).Methods("POST")
+	r.HandleFunc("/account/identities", accountMw.ApplyFn(oauthC.Index)).Methods("GET")
+	r.HandleFunc("/account/identities/{id:[0-9]+}/delete", accountMw.ApplyFn(oauthC.Unlink)).Methods("POST")
+	r.HandleFunc("/account/tokens", accountMw.ApplyFn(apiTokensC.Index)).Methods("GET")
+	r.HandleFunc("/account/tokens", accountMw.ApplyFn(apiTokensC.Create)).Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/delete", accountMw.ApplyFn(apiTokensC.Delete)).Methods("POST")
+	r.HandleFunc("/account/invites", accountMw.ApplyFn(invitesC.Index)).Methods("GET")
+	r.HandleFunc("/account/invites", accountVerifiedMw.ApplyFn(invitesC.Create)).Methods("POST")
+	r.HandleFunc("/account/invites/{id:[0-9]+}/delete", accountMw.ApplyFn(invitesC.Delete)).Methods("POST")
+	r.HandleFunc("/account/export", accountMw.ApplyFn(exportsC.Index)).Methods("GET")
+	r.HandleFunc("/account/export", accountMw.ApplyFn(exportsC.Create)).Methods("POST")
+	r.HandleFunc("/account/export/{id:[0-9]+}/download", accountMw.ApplyFn(exportsC.Download)).Methods("GET")
+
+	// Admin routes. Moderators can get into the admin area,
+	// and the controller checks the policy for anything only
+	// admins can do.
+	r.Handle("/admin", http.RedirectHandler("/admin/users", http.StatusFound)).Methods("GET")
+	r.HandleFunc("/admin/users", requireModeratorMw.ApplyFn(adminC.Users)).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/suspend", requireModeratorMw.ApplyFn(adminC.Suspend)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/unsuspend", requireModeratorMw.ApplyFn(adminC.Unsuspend)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/role", requireModeratorMw.ApplyFn(adminC.ChangeRole)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/impersonate", requireModeratorMw.ApplyFn(adminC.Impersonate)).Methods("POST")
+	r.HandleFunc("/admin/impersonate/stop", requireUserMw.ApplyFn(adminC.StopImpersonating)).Methods("POST")
+	r.HandleFunc("/admin/galleries", requireModeratorMw.ApplyFn(adminC.Galleries)).Methods("GET")
+	r.HandleFunc("/admin/galleries/{id:[0-9]+}/delete", requireModeratorMw.ApplyFn(adminC.DeleteGallery)).Methods("POST")
+	r.HandleFunc("/admin/audit", requireAdminMw.ApplyFn(adminC.Audit)).Methods("GET")
+
+	// Profile routes
+	r.HandleFunc("/u/{username:[A-Za-z0-9_]+}", galleriesScopeMw.ApplyFn(profilesC.Show)).Methods("GET").Name(controllers.ShowProfile)
 
 	// Gallery routes
-	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
-	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.Handle("/galleries/new", requireVerifiedMw.Apply(galleriesC.New)).Methods("GET")
+	r.Handle("/galleries", writeGalleriesVerifiedMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesScopeMw.ApplyFn(galleriesC.Show)).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock", galleriesScopeMw.ApplyFn(galleriesC.Unlock)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").Name(controllers.EditGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
-	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET").Name(controllers.IndexGalleries)
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", writeGalleriesMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", writeGalleriesMw.ApplyFn(galleriesC.Delete)).Methods("POST")
+	r.Handle("/galleries", readGalleriesMw.ApplyFn(galleriesC.Index)).Methods("GET").Name(controllers.IndexGalleries)
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", writeGalleriesVerifiedMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", writeGalleriesMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares", writeGalleriesMw.ApplyFn(galleriesC.CreateShareLink)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{linkID:[0-9]+}/revoke", writeGalleriesMw.ApplyFn(galleriesC.RevokeShareLink)).Methods("POST")
+	r.HandleFunc("/s/{token}", galleriesScopeMw.ApplyFn(galleriesC.Share)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators", writeGalleriesMw.ApplyFn(galleriesC.InviteCollaborator)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/{collaboratorID:[0-9]+}/role", writeGalleriesMw.ApplyFn(galleriesC.UpdateCollaborator)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/{collaboratorID:[0-9]+}/delete", writeGalleriesMw.ApplyFn(galleriesC.RemoveCollaborator)).Methods("POST")
+	r.HandleFunc("/galleries/invitations/{id:[0-9]+}/accept", writeGalleriesVerifiedMw.ApplyFn(galleriesC.AcceptInvitation)).Methods("POST")
+	r.HandleFunc("/galleries/invitations/{id:[0-9]+}/decline", writeGalleriesMw.ApplyFn(galleriesC.DeclineInvitation)).Methods("POST")
 
-	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Image routes. Gallery images are only served to people
+	// who can see the gallery, but avatars are public.
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesScopeMw.ApplyFn(galleriesC.ShowImage)).Methods("GET").Name(controllers.ShowImage)
+	avatarHandler := noDirListing(http.FileServer(http.Dir("./images/avatars/")))
+	r.PathPrefix("/images/avatars/").Handler(http.StripPrefix("/images/avatars/", avatarHandler))
 
 	// Assets
 	assetHandler := http.FileServer(http.Dir("./assets/"))
@@ -83,6 +242,35 @@ func main() {
 	// Our port is not provided via config, so we need to
 	// update the last bit of our main function.
 	fmt.Printf("Starting the server on :%d...\n", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(r)))
+	// The User middleware runs first so that it can skip the
+	// CSRF check for requests made with API tokens.
+	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), userMw.Apply(csrfMw(r)))
+
+}
+
+// promoteToAdmin gives the user with the given email address
+// the admin role. Admins can promote other users from the
+// admin area, but somebody has to be first.
+func promoteToAdmin(us models.UserService, email string) error {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	user.Role = models.RoleAdmin
+	return us.Update(user)
+}
 
+// noDirListing responds with a 404 instead of a directory
+// listing, which for avatars would give away the ID of every
+// user who has one. http.FileServer redirects directories to
+// a path ending in a slash before listing them, so those are
+// the only paths we need to look at.
+func noDirListing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,165 @@
+// Package markdown renders the small subset of Markdown that
+// people use to describe their galleries. Everything that
+// isn't markup is HTML escaped, and raw HTML in the source is
+// shown as text rather than passed through, so the output is
+// safe to put in a page without any further sanitizing.
+//
+// The supported syntax is:
+//
+//   - paragraphs, separated by blank lines
+//   - headings, from "# " to "### "
+//   - unordered lists, with "- " or "* " items
+//   - **strong**, *emphasis* and `code`
+//   - [links](https://example.com) to http, https and mailto
+//     URLs, and a backslash to escape any of the above
+package markdown
+
+import (
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// Render converts src to HTML. Headings start at <h3>, as the
+// page they appear on already has its own title.
+func Render(src string) template.HTML {
+	var b strings.Builder
+	var para []string
+	inList := false
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>")
+			b.WriteString(inline(strings.Join(para, "\n")))
+			b.WriteString("</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if inList {
+			b.WriteString("</ul>\n")
+			inList = false
+		}
+	}
+
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	for _, line := range strings.Split(src, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case heading(trimmed) > 0:
+			flushPara()
+			closeList()
+			level := heading(trimmed)
+			tag := "h" + string(rune('2'+level))
+			b.WriteString("<" + tag + ">")
+			b.WriteString(inline(strings.TrimSpace(trimmed[level:])))
+			b.WriteString("</" + tag + ">\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			flushPara()
+			if !inList {
+				b.WriteString("<ul>\n")
+				inList = true
+			}
+			b.WriteString("<li>")
+			b.WriteString(inline(strings.TrimSpace(trimmed[2:])))
+			b.WriteString("</li>\n")
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+	closeList()
+	return template.HTML(b.String())
+}
+
+// heading returns the level of the heading on the line, or 0
+// if it isn't one.
+func heading(line string) int {
+	for level := 1; level <= 3; level++ {
+		if strings.HasPrefix(line, strings.Repeat("#", level)+" ") {
+			return level
+		}
+	}
+	return 0
+}
+
+// inline renders the spans within a single block of text.
+func inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte("\\`*_[]()#-", rest[1]) >= 0:
+			b.WriteString(template.HTMLEscapeString(rest[1:2]))
+			i += 2
+			continue
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				b.WriteString("<code>")
+				b.WriteString(template.HTMLEscapeString(rest[1 : 1+end]))
+				b.WriteString("</code>")
+				i += end + 2
+				continue
+			}
+		case strings.HasPrefix(rest, "**"):
+			if end := strings.Index(rest[2:], "**"); end > 0 {
+				b.WriteString("<strong>")
+				b.WriteString(inline(rest[2 : 2+end]))
+				b.WriteString("</strong>")
+				i += end + 4
+				continue
+			}
+		case rest[0] == '*':
+			if end := strings.IndexByte(rest[1:], '*'); end > 0 {
+				b.WriteString("<em>")
+				b.WriteString(inline(rest[1 : 1+end]))
+				b.WriteString("</em>")
+				i += end + 2
+				continue
+			}
+		case rest[0] == '[':
+			if text, href, n, ok := link(rest); ok {
+				b.WriteString(`<a href="`)
+				b.WriteString(template.HTMLEscapeString(href))
+				b.WriteString(`" rel="nofollow noopener">`)
+				b.WriteString(inline(text))
+				b.WriteString("</a>")
+				i += n
+				continue
+			}
+		}
+		b.WriteString(template.HTMLEscapeString(rest[:1]))
+		i++
+	}
+	return b.String()
+}
+
+// link parses a "[text](href)" link at the start of s,
+// returning its parts and length. Links to anything other
+// than http, https and mailto URLs aren't links at all, so
+// that nobody can sneak in a javascript: URL.
+func link(s string) (text, href string, n int, ok bool) {
+	mid := strings.Index(s, "](")
+	if mid < 0 {
+		return "", "", 0, false
+	}
+	end := strings.IndexByte(s[mid+2:], ')')
+	if end < 0 {
+		return "", "", 0, false
+	}
+	text = s[1:mid]
+	href = strings.TrimSpace(s[mid+2 : mid+2+end])
+	u, err := url.Parse(href)
+	if err != nil || text == "" {
+		return "", "", 0, false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+	default:
+		return "", "", 0, false
+	}
+	return text, href, mid + 3 + end, true
+}
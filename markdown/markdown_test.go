@@ -0,0 +1,42 @@
+package markdown
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"heading", "# Day one", "<h3>Day one</h3>\n"},
+		{"list", "- a\n* b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"spans", "**bold** *em* `x<y`", "<p><strong>bold</strong> <em>em</em> <code>x&lt;y</code></p>\n"},
+		{"link", "[site](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">site</a></p>` + "\n"},
+		{"escape", `\*not em\*`, "<p>*not em*</p>\n"},
+		{"unclosed", "2 * 3", "<p>2 * 3</p>\n"},
+	}
+	for _, tc := range tests {
+		if got := string(Render(tc.src)); got != tc.want {
+			t.Errorf("%s: Render(%q) = %q; want %q", tc.name, tc.src, got, tc.want)
+		}
+	}
+}
+
+// TestRenderUnsafe makes sure nothing in the source can end
+// up as markup we didn't write ourselves.
+func TestRenderUnsafe(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"[x](JavaScript:alert(1))", "<p>[x](JavaScript:alert(1))</p>\n"},
+		{`[x](https://a.com/"onmouseover="alert(1))`, `<p><a href="https://a.com/&#34;onmouseover=&#34;alert(1" rel="nofollow noopener">x</a>)</p>` + "\n"},
+		{"**<b>**", "<p><strong>&lt;b&gt;</strong></p>\n"},
+		{"# <img src=x onerror=alert(1)>", "<h3>&lt;img src=x onerror=alert(1)&gt;</h3>\n"},
+	}
+	for _, tc := range tests {
+		if got := string(Render(tc.src)); got != tc.want {
+			t.Errorf("Render(%q) = %q; want %q", tc.src, got, tc.want)
+		}
+	}
+}
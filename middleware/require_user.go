@@ -4,16 +4,34 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/gorilla/csrf"
 	"lenslocked.com/context"
+	"lenslocked.com/cookies"
 	"lenslocked.com/models"
+	"lenslocked.com/views"
 )
 
-// User middleware will lookup the current user via their
-// remember_token cookie using the UserService. If the user
-// is found, they will be set on the request context.
+// User middleware will lookup the current session via the
+// remember_token cookie using the SessionService, and then
+// the user it belongs to using the UserService. If both are
+// found, they will be set on the request context.
 // Regardless, the next handler is always called.
+//
+// Each time the session's idle expiry is pushed back, the
+// cookie of a persistent session is renewed to match, so
+// users who keep coming back stay signed in until the
+// session reaches its maximum age.
+//
+// Scripts authenticate with an API token in the
+// Authorization header instead. Browsers never send that
+// header on their own, so those requests can't be forged by
+// another site and don't need a CSRF token. This middleware
+// has to run before the CSRF middleware for that to work.
 type User struct {
 	models.UserService
+	models.SessionService
+	models.APITokenService
+	Cookies cookies.Options
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -24,36 +42,111 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		path := r.URL.Path
-		// If the user is requesting a static asset or image
+		// If the user is requesting a static asset or avatar
 		// we will not need to lookup the current user so we skip
-		// doing that.
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		// doing that. Gallery images are another matter, as
+		// who can see them depends on who the user is.
+		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/avatars/") {
 			next(w, r)
 			return
 		}
 
-		cookie, err := r.Cookie("remember_token")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			mw.applyToken(w, r, auth, next)
+			return
+		}
+
+		cookie, err := r.Cookie(cookies.RememberToken)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		session, err := mw.SessionService.ByRemember(cookie.Value)
 		if err != nil {
+			if err == models.ErrNotFound {
+				// The session has expired or been signed out, so
+				// there is no point in the browser keeping it.
+				mw.Cookies.Clear(w, cookies.RememberToken)
+			}
 			next(w, r)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		user, err := mw.UserService.ByID(session.UserID)
 		if err != nil {
 			next(w, r)
 			return
 		}
+		if user.Suspended() {
+			// Suspending a user signs them out everywhere, but
+			// we don't want a session created in the meantime to
+			// let them back in.
+			mw.Cookies.Clear(w, cookies.RememberToken)
+			next(w, r)
+			return
+		}
+		// Failing to record when a session was last seen isn't
+		// worth failing the request over.
+		renewed, _ := mw.SessionService.Touch(session)
+		if renewed && session.Persistent {
+			mw.Cookies.Set(w, cookies.RememberToken, cookie.Value, session.IdleExpiresAt)
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
 }
 
+// applyToken authenticates a request made with an API token.
+// Unlike a missing or expired cookie, a bad token is an error
+// rather than a reason to carry on signed out, as scripts
+// are better off failing loudly.
+func (mw *User) applyToken(w http.ResponseWriter, r *http.Request, auth string, next http.HandlerFunc) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		unauthorized(w, "Only Bearer authorization is supported.")
+		return
+	}
+	token, err := mw.APITokenService.Authenticate(strings.TrimPrefix(auth, prefix))
+	if err != nil {
+		unauthorized(w, "The API token is invalid or has expired.")
+		return
+	}
+	user, err := mw.UserService.ByID(token.UserID)
+	if err != nil || user.Suspended() || user.DeletionPending() {
+		unauthorized(w, "The API token is invalid or has expired.")
+		return
+	}
+	r = csrf.UnsafeSkipCheck(r)
+	ctx := r.Context()
+	ctx = context.WithUser(ctx, user)
+	ctx = context.WithAPIToken(ctx, token)
+	next(w, r.WithContext(ctx))
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="lenslocked", error="invalid_token"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
 // RequireUser will redirect a user to the /login page
 // if they are not logged in. This middleware assumes
 // that User middleware has already been run, otherwise
 // it will always redirect users.
-type RequireUser struct{}
+//
+// Requests made with an API token are only let through if
+// the token has Scope. Without a Scope they never are, so
+// tokens can only be used where we have decided they should.
+//
+// If NoImpersonation is set, admins who are signed in as
+// another user are turned away as well. Account settings
+// use it, so that an admin can't leave themselves a way back
+// into the account, like an API token, once they stop.
+type RequireUser struct {
+	Scope           models.Scope
+	NoImpersonation bool
+}
 
 func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
@@ -66,6 +159,101 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
+		if !tokenAllowed(r, mw.Scope) {
+			http.Error(w, "The API token isn't allowed to do that.", http.StatusForbidden)
+			return
+		}
+		if mw.NoImpersonation {
+			if session := context.Session(r.Context()); session != nil && session.Impersonated() {
+				views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+					Level:   views.AlertLvlWarning,
+					Message: "You can't change a user's account while signed in as them.",
+				})
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+// RequireScope is used on pages anyone can see, such as a
+// public gallery. Signed out visitors and browser sessions
+// are always let through, but requests made with an API
+// token are only let through if the token has Scope, just
+// like they would be by RequireUser.
+type RequireScope struct {
+	Scope models.Scope
+}
+
+func (mw *RequireScope) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireScope) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokenAllowed(r, mw.Scope) {
+			http.Error(w, "The API token isn't allowed to do that.", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// tokenAllowed returns false if the request was made with
+// an API token that doesn't have scope.
+func tokenAllowed(r *http.Request, scope models.Scope) bool {
+	token := context.APIToken(r.Context())
+	if token == nil {
+		return true
+	}
+	return scope != "" && token.HasScope(scope)
+}
+
+// RequireVerifiedEmail works like RequireUser, but it also
+// sends users who haven't verified their email address yet
+// to the page where they can do so.
+type RequireVerifiedEmail struct {
+	RequireUser
+}
+
+func (mw *RequireVerifiedEmail) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireVerifiedEmail) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.EmailVerified() {
+			views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+				Level:   views.AlertLvlWarning,
+				Message: "Please verify your email address before doing that.",
+			})
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireRole works like RequireUser, but it also responds
+// with a 404 to users who don't have at least Role. We don't
+// want the pages it protects to advertise themselves to
+// people who can't use them.
+type RequireRole struct {
+	RequireUser
+	Role models.Role
+}
+
+func (mw *RequireRole) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireRole) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.HasRole(mw.Role) {
+			http.NotFound(w, r)
+			return
+		}
 		next(w, r)
 	})
 }
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// signedIn returns a request made by user 1 with session.
+func signedIn(session *models.Session) *http.Request {
+	r := httptest.NewRequest("GET", "/account", nil)
+	ctx := context.WithUser(r.Context(), &models.User{Model: gorm.Model{ID: 1}})
+	ctx = context.WithSession(ctx, session)
+	return r.WithContext(ctx)
+}
+
+func TestRequireUserNoImpersonation(t *testing.T) {
+	own := &models.Session{UserID: 1}
+	impersonated := &models.Session{UserID: 1, ImpersonatorID: 2}
+	tests := []struct {
+		mw      RequireUser
+		session *models.Session
+		want    int
+		name    string
+	}{
+		{RequireUser{}, own, http.StatusOK, "own session"},
+		{RequireUser{}, impersonated, http.StatusOK, "impersonated, allowed"},
+		{RequireUser{NoImpersonation: true}, own, http.StatusOK, "own session, account route"},
+		{RequireUser{NoImpersonation: true}, impersonated, http.StatusFound, "impersonated, account route"},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		tc.mw.ApplyFn(ok)(rec, signedIn(tc.session))
+		if rec.Code != tc.want {
+			t.Errorf("RequireUser(%s) = %d; want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+type fakeUsers struct {
+	models.UserService
+	users map[uint]*models.User
+}
+
+func (f *fakeUsers) ByID(id uint) (*models.User, error) {
+	if user, ok := f.users[id]; ok {
+		return user, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+type fakeTokens struct {
+	models.APITokenService
+	tokens map[string]*models.APIToken
+}
+
+func (f *fakeTokens) Authenticate(token string) (*models.APIToken, error) {
+	if t, ok := f.tokens[token]; ok {
+		return t, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+// tokenUser returns a User middleware that knows about these
+// tokens. User 1 is active and user 2 has been suspended.
+func tokenUser() *User {
+	suspended := time.Now()
+	return &User{
+		UserService: &fakeUsers{users: map[uint]*models.User{
+			1: {Model: gorm.Model{ID: 1}},
+			2: {Model: gorm.Model{ID: 2}, SuspendedAt: &suspended},
+		}},
+		APITokenService: &fakeTokens{tokens: map[string]*models.APIToken{
+			"none":      {UserID: 1},
+			"write":     {UserID: 1, Scopes: string(models.ScopeGalleriesWrite)},
+			"read":      {UserID: 1, Scopes: string(models.ScopeGalleriesRead)},
+			"suspended": {UserID: 2, Scopes: string(models.ScopeGalleriesRead)},
+		}},
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	userMw := tokenUser()
+	requireRead := &RequireUser{Scope: models.ScopeGalleriesRead}
+	requireAny := &RequireUser{}
+	scopeRead := &RequireScope{Scope: models.ScopeGalleriesRead}
+
+	tests := []struct {
+		token                                 string
+		requireRead, requireAny, requireScope int
+		name                                  string
+	}{
+		{"", http.StatusFound, http.StatusFound, http.StatusOK, "no token"},
+		{"none", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, "token with no scope"},
+		{"write", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, "token with the wrong scope"},
+		{"read", http.StatusOK, http.StatusForbidden, http.StatusOK, "token with the right scope"},
+		{"suspended", http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, "suspended user's token"},
+		{"unknown", http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, "unknown token"},
+	}
+	for _, tc := range tests {
+		for _, mw := range []struct {
+			handler http.HandlerFunc
+			want    int
+			name    string
+		}{
+			{requireRead.ApplyFn(ok), tc.requireRead, "RequireUser(read)"},
+			{requireAny.ApplyFn(ok), tc.requireAny, "RequireUser()"},
+			{scopeRead.ApplyFn(ok), tc.requireScope, "RequireScope(read)"},
+		} {
+			r := httptest.NewRequest("GET", "/galleries", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			userMw.ApplyFn(mw.handler)(rec, r)
+			if rec.Code != mw.want {
+				t.Errorf("%s with %s = %d; want %d", mw.name, tc.name, rec.Code, mw.want)
+			}
+		}
+	}
+}
+
+func TestAPITokenSkipsCSRF(t *testing.T) {
+	userMw := tokenUser()
+	protect := csrf.Protect([]byte("01234567890123456789012345678901"), csrf.Secure(false))
+	handler := userMw.Apply(protect(http.HandlerFunc(ok)))
+
+	tests := []struct {
+		auth string
+		want int
+		name string
+	}{
+		{"Bearer write", http.StatusOK, "API token"},
+		{"", http.StatusForbidden, "no token"},
+		{"Basic d3JpdGU6", http.StatusUnauthorized, "not a Bearer token"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "/galleries", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("POST with %s = %d; want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrTokenNameRequired is returned when an API token is created without a name.
+	ErrTokenNameRequired modelError = "models: please give your token a name so you can tell it apart from your others"
+
+	// ErrScopeRequired is returned when an API token is created without any scopes.
+	ErrScopeRequired modelError = "models: please choose at least one thing the token can do"
+
+	// ErrScopeInvalid is returned when an API token is given a scope that doesn't exist.
+	ErrScopeInvalid modelError = "models: scope is not valid"
+
+	// ErrTokenExpiryInvalid is returned when an API token is created with an expiry in the past.
+	ErrTokenExpiryInvalid modelError = "models: token expiry must be in the future"
+)
+
+const (
+	// apiTokenPrefix starts every API token so that they are
+	// easy to recognize, eg by tools that look for secrets
+	// that have been committed by mistake.
+	apiTokenPrefix = "llk_"
+
+	// apiTokenTouchInterval is how often we record that an API
+	// token was used. Scripts can make a lot of requests, and
+	// to the minute is plenty for users to spot unused tokens.
+	apiTokenTouchInterval = time.Minute
+)
+
+// Scope is something an API token is allowed to do.
+type Scope string
+
+const (
+	// ScopeGalleriesRead lets a token list the user's
+	// galleries.
+	ScopeGalleriesRead Scope = "galleries:read"
+
+	// ScopeGalleriesWrite lets a token create, update, and
+	// delete galleries, and upload and delete their images.
+	ScopeGalleriesWrite Scope = "galleries:write"
+)
+
+// Scopes lists every scope an API token can have.
+var Scopes = []Scope{ScopeGalleriesRead, ScopeGalleriesWrite}
+
+// Valid returns true if s is one of Scopes.
+func (s Scope) Valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken lets a user's scripts act on their behalf without
+// their password. As with our other tokens we only store the
+// HMAC hash of the token, so the token itself is only
+// available when it is first created.
+//
+// Scopes are stored space separated, as they are in OAuth.
+type APIToken struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// ScopeList returns the token's scopes.
+func (t *APIToken) ScopeList() []Scope {
+	fields := strings.Fields(t.Scopes)
+	scopes := make([]Scope, len(fields))
+	for i, f := range fields {
+		scopes[i] = Scope(f)
+	}
+	return scopes
+}
+
+// SetScopes replaces the token's scopes.
+func (t *APIToken) SetScopes(scopes []Scope) {
+	fields := make([]string, len(scopes))
+	for i, s := range scopes {
+		fields[i] = string(s)
+	}
+	t.Scopes = strings.Join(fields, " ")
+}
+
+// HasScope returns true if the token is allowed to do the
+// given thing.
+func (t *APIToken) HasScope(scope Scope) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns true if the token can no longer be used.
+// Tokens without an expiry last until they are revoked.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenDB is used to interact with the API tokens table.
+//
+// Like UserDB, single token queries return ErrNotFound if the
+// token can't be found.
+type APITokenDB interface {
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+
+	// Create generates the token, which is only available on
+	// the APIToken passed in.
+	Create(token *APIToken) error
+
+	// Touch records that the token was used at t.
+	Touch(id uint, t time.Time) error
+
+	// UpdateHash replaces the stored hash of the token, eg
+	// once it has been hashed with a new HMAC key.
+	UpdateHash(id uint, tokenHash string) error
+	Delete(id uint) error
+}
+
+// APITokenService is a set of methods used to create API
+// tokens and to authenticate requests made with them.
+type APITokenService interface {
+	// Authenticate looks up an unexpired token, and records
+	// that it was used. Unknown and expired tokens are both
+	// reported as ErrNotFound.
+	Authenticate(token string) (*APIToken, error)
+	APITokenDB
+}
+
+func NewAPITokenService(db *gorm.DB, hmacKeys hash.KeySet) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacKeys),
+		},
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+func (ats *apiTokenService) Authenticate(token string) (*APIToken, error) {
+	apiToken, err := ats.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if apiToken.Expired() {
+		return nil, ErrNotFound
+	}
+	now := time.Now()
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) >= apiTokenTouchInterval {
+		// Failing to record when a token was last used isn't
+		// worth failing the request over.
+		if err := ats.Touch(apiToken.ID, now); err == nil {
+			apiToken.LastUsedAt = &now
+		}
+	}
+	return apiToken, nil
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the provided token with each of our HMAC
+// keys and pass the hashes on to the database layer until a
+// token is found. Anything that doesn't look like one of our
+// tokens isn't worth looking up. Tokens found with an old key
+// are re-hashed with the active one, so that the old key can
+// be retired.
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, ErrNotFound
+	}
+	hashes := atv.hmac.HashAll(token)
+	var apiToken *APIToken
+	err := byHashes(hashes, func(tokenHash string) error {
+		var err error
+		apiToken, err = atv.APITokenDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if apiToken.TokenHash != hashes[0] {
+		if err := atv.APITokenDB.UpdateHash(apiToken.ID, hashes[0]); err != nil {
+			return nil, err
+		}
+		apiToken.TokenHash = hashes[0]
+	}
+	return apiToken, nil
+}
+
+func (atv *apiTokenValidator) Create(token *APIToken) error {
+	err := runAPITokenValFns(token,
+		atv.userIDRequired,
+		atv.normalizeName,
+		atv.nameRequired,
+		atv.scopesValid,
+		atv.expiryInFuture,
+		atv.setToken,
+		atv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Create(token)
+}
+
+func (atv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return atv.APITokenDB.Delete(id)
+}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	err := first(atg.db.Where("token_hash = ?", tokenHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	db := atg.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := db.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (atg *apiTokenGorm) Create(token *APIToken) error {
+	return atg.db.Create(token).Error
+}
+
+func (atg *apiTokenGorm) Touch(id uint, t time.Time) error {
+	return atg.db.Model(&APIToken{ID: id}).UpdateColumn("last_used_at", t).Error
+}
+
+func (atg *apiTokenGorm) UpdateHash(id uint, tokenHash string) error {
+	return atg.db.Model(&APIToken{ID: id}).UpdateColumn("token_hash", tokenHash).Error
+}
+
+func (atg *apiTokenGorm) Delete(id uint) error {
+	token := APIToken{ID: id}
+	return atg.db.Delete(&token).Error
+}
+
+type apiTokenValFn func(*APIToken) error
+
+func runAPITokenValFns(token *APIToken, fns ...apiTokenValFn) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) userIDRequired(token *APIToken) error {
+	if token.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) normalizeName(token *APIToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(token *APIToken) error {
+	if token.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) scopesValid(token *APIToken) error {
+	scopes := token.ScopeList()
+	if len(scopes) == 0 {
+		return ErrScopeRequired
+	}
+	for _, s := range scopes {
+		if !s.Valid() {
+			return ErrScopeInvalid
+		}
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) expiryInFuture(token *APIToken) error {
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(time.Now()) {
+		return ErrTokenExpiryInvalid
+	}
+	return nil
+}
+
+// setToken always generates a new token, as tokens are
+// never chosen by the user.
+func (atv *apiTokenValidator) setToken(token *APIToken) error {
+	t, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	token.Token = apiTokenPrefix + t
+	return nil
+}
+
+func (atv *apiTokenValidator) hmacToken(token *APIToken) error {
+	token.TokenHash = atv.hmac.Hash(token.Token)
+	return nil
+}
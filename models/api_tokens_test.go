@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+
+	"lenslocked.com/hash"
+)
+
+// memAPITokenDB holds a single token.
+type memAPITokenDB struct {
+	APITokenDB
+	token APIToken
+}
+
+func (db *memAPITokenDB) ByToken(tokenHash string) (*APIToken, error) {
+	if tokenHash != db.token.TokenHash {
+		return nil, ErrNotFound
+	}
+	token := db.token
+	return &token, nil
+}
+
+func (db *memAPITokenDB) UpdateHash(id uint, tokenHash string) error {
+	db.token.TokenHash = tokenHash
+	return nil
+}
+
+func TestAPITokenRehash(t *testing.T) {
+	const token = apiTokenPrefix + "token"
+	old := hash.NewHMAC(hash.SingleKey("old"))
+	db := &memAPITokenDB{token: APIToken{ID: 1, TokenHash: old.Hash(token)}}
+	rotated := hash.NewHMAC(hash.KeySet{
+		Active: "new",
+		Keys:   map[string]string{"new": "new", hash.DefaultKeyID: "old"},
+	})
+	atv := &apiTokenValidator{APITokenDB: db, hmac: rotated}
+
+	found, err := atv.ByToken(token)
+	if err != nil {
+		t.Fatalf("ByToken() err = %v", err)
+	}
+	want := rotated.Hash(token)
+	if found.TokenHash != want || db.token.TokenHash != want {
+		t.Errorf("ByToken() left the token hashed with the old key")
+	}
+
+	// Once nothing is hashed with the old key it can go.
+	atv.hmac = hash.NewHMAC(hash.KeySet{
+		Active: "new",
+		Keys:   map[string]string{"new": "new"},
+	})
+	if _, err := atv.ByToken(token); err != nil {
+		t.Errorf("ByToken() after retiring the old key err = %v", err)
+	}
+}
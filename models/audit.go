@@ -0,0 +1,257 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrActionRequired is returned when an audit event is missing its action.
+const ErrActionRequired modelError = "models: audit event action is required"
+
+// The actions we record audit events for.
+const (
+	AuditLogin                    = "login"
+	AuditLoginFailed              = "login.failed"
+	AuditLogout                   = "logout"
+	AuditPasswordChanged          = "password.changed"
+	AuditPasswordReset            = "password.reset"
+	AuditAccountDeletionRequested = "account.deletion_requested"
+	AuditAccountDeletionCancelled = "account.deletion_cancelled"
+	AuditAccountPurged            = "account.purged"
+	AuditGalleryDeleted           = "gallery.deleted"
+	AuditImageDeleted             = "image.deleted"
+	AuditShareLinkCreated         = "share_link.created"
+	AuditShareLinkRevoked         = "share_link.revoked"
+	AuditCollaboratorInvited      = "collaborator.invited"
+	AuditCollaboratorRoleChanged  = "collaborator.role_changed"
+	AuditCollaboratorRemoved      = "collaborator.removed"
+	AuditAPITokenCreated          = "api_token.created"
+	AuditAPITokenRevoked          = "api_token.revoked"
+	AuditUserSuspended            = "user.suspended"
+	AuditUserUnsuspended          = "user.unsuspended"
+	AuditRoleChanged              = "user.role_changed"
+	AuditImpersonationStarted     = "impersonation.started"
+	AuditImpersonationStopped     = "impersonation.stopped"
+)
+
+// auditTitles describes each action for people reading the
+// audit log.
+var auditTitles = map[string]string{
+	AuditLogin:                    "Signed in",
+	AuditLoginFailed:              "Failed sign in",
+	AuditLogout:                   "Signed out",
+	AuditPasswordChanged:          "Changed password",
+	AuditPasswordReset:            "Reset password",
+	AuditAccountDeletionRequested: "Asked for account deletion",
+	AuditAccountDeletionCancelled: "Cancelled account deletion",
+	AuditAccountPurged:            "Account deleted",
+	AuditGalleryDeleted:           "Deleted gallery",
+	AuditImageDeleted:             "Deleted image",
+	AuditShareLinkCreated:         "Created share link",
+	AuditShareLinkRevoked:         "Revoked share link",
+	AuditCollaboratorInvited:      "Invited collaborator",
+	AuditCollaboratorRoleChanged:  "Changed collaborator role",
+	AuditCollaboratorRemoved:      "Removed collaborator",
+	AuditAPITokenCreated:          "Created API token",
+	AuditAPITokenRevoked:          "Revoked API token",
+	AuditUserSuspended:            "Suspended user",
+	AuditUserUnsuspended:          "Unsuspended user",
+	AuditRoleChanged:              "Changed role",
+	AuditImpersonationStarted:     "Started signing in as user",
+	AuditImpersonationStopped:     "Stopped signing in as user",
+}
+
+// AuditActions lists every action, in the order they are
+// offered when filtering the audit log.
+var AuditActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditLogout,
+	AuditPasswordChanged,
+	AuditPasswordReset,
+	AuditAccountDeletionRequested,
+	AuditAccountDeletionCancelled,
+	AuditAccountPurged,
+	AuditGalleryDeleted,
+	AuditImageDeleted,
+	AuditShareLinkCreated,
+	AuditShareLinkRevoked,
+	AuditCollaboratorInvited,
+	AuditCollaboratorRoleChanged,
+	AuditCollaboratorRemoved,
+	AuditAPITokenCreated,
+	AuditAPITokenRevoked,
+	AuditUserSuspended,
+	AuditUserUnsuspended,
+	AuditRoleChanged,
+	AuditImpersonationStarted,
+	AuditImpersonationStopped,
+}
+
+// AuditTitle describes an action for people reading the audit
+// log.
+func AuditTitle(action string) string {
+	if title, ok := auditTitles[action]; ok {
+		return title
+	}
+	return action
+}
+
+// The kinds of things an audit event can be about.
+const (
+	AuditTargetUser     = "user"
+	AuditTargetGallery  = "gallery"
+	AuditTargetAPIToken = "api_token"
+)
+
+// AuditEvent records that something security related
+// happened. ActorID is the user who did it, and is 0 when
+// nobody was signed in, eg for a failed sign in, or when we
+// did it ourselves, eg when purging an account. If an admin
+// was signed in as the actor, ImpersonatorID is the admin,
+// and if the actor used an API token, APITokenID is the
+// token.
+//
+// Audit events are never changed or deleted, not even when
+// the users they mention are purged, so the log can be
+// trusted after the fact.
+type AuditEvent struct {
+	ID             uint `gorm:"primary_key"`
+	ActorID        uint `gorm:"not null;index"`
+	ImpersonatorID uint `gorm:"not null;default:0"`
+	APITokenID     uint `gorm:"not null;default:0"`
+	IP             string
+	Action         string `gorm:"not null;index"`
+	TargetType     string `gorm:"index:idx_audit_target"`
+	TargetID       uint   `gorm:"index:idx_audit_target"`
+	Details        string
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+// Title describes the event's action.
+func (e *AuditEvent) Title() string {
+	return AuditTitle(e.Action)
+}
+
+// AuditFilter narrows down the events returned by Search.
+// Zero values match everything.
+type AuditFilter struct {
+	// UserID matches events where the user is the actor or
+	// the target.
+	UserID uint
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AuditDB is used to interact with the audit events table.
+// There is deliberately no way to update or delete events.
+type AuditDB interface {
+	Create(event *AuditEvent) error
+
+	// Search returns the events matching the filter, newest
+	// first.
+	Search(filter AuditFilter) ([]AuditEvent, error)
+}
+
+// AuditService is used to record and look up audit events.
+type AuditService interface {
+	// Record creates the event. Failing to record an event
+	// shouldn't stop whatever it is about from happening, so
+	// errors are logged rather than returned.
+	Record(event AuditEvent)
+
+	// ForUser returns the most recent events the user was the
+	// actor or the target of, newest first.
+	ForUser(userID uint, limit int) ([]AuditEvent, error)
+	AuditDB
+}
+
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditService{
+		AuditDB: &auditValidator{
+			AuditDB: &auditGorm{db},
+		},
+	}
+}
+
+type auditService struct {
+	AuditDB
+}
+
+func (as *auditService) Record(event AuditEvent) {
+	if err := as.Create(&event); err != nil {
+		log.Printf("models: recording %s audit event: %v", event.Action, err)
+	}
+}
+
+func (as *auditService) ForUser(userID uint, limit int) ([]AuditEvent, error) {
+	return as.Search(AuditFilter{UserID: userID, Limit: limit})
+}
+
+type auditValidator struct {
+	AuditDB
+}
+
+func (av *auditValidator) Create(event *AuditEvent) error {
+	err := runAuditValFns(event,
+		av.actionRequired)
+	if err != nil {
+		return err
+	}
+	return av.AuditDB.Create(event)
+}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) Create(event *AuditEvent) error {
+	return ag.db.Create(event).Error
+}
+
+func (ag *auditGorm) Search(filter AuditFilter) ([]AuditEvent, error) {
+	var events []AuditEvent
+	db := ag.db.Order("created_at desc, id desc")
+	if filter.UserID != 0 {
+		db = db.Where("actor_id = ? OR (target_type = ? AND target_id = ?)",
+			filter.UserID, AuditTargetUser, filter.UserID)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		db = db.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		db = db.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		db = db.Limit(filter.Limit)
+	}
+	if err := db.Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+type auditValFn func(*AuditEvent) error
+
+func runAuditValFns(event *AuditEvent, fns ...auditValFn) error {
+	for _, fn := range fns {
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (av *auditValidator) actionRequired(event *AuditEvent) error {
+	if event.Action == "" {
+		return ErrActionRequired
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	// Register the formats we accept avatars in.
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// ErrAvatarType is returned when an avatar isn't a JPEG, PNG, or GIF image.
+	ErrAvatarType modelError = "models: your picture must be a JPEG, PNG, or GIF image"
+
+	// ErrAvatarTooLarge is returned when an avatar is bigger than we are willing to process.
+	ErrAvatarTooLarge modelError = "models: your picture is too large. Please use one smaller than 10MB and 6000 pixels across"
+)
+
+// The sizes, in pixels, that avatars are stored in. Each
+// avatar is square.
+const (
+	AvatarSmall  = 32
+	AvatarMedium = 128
+	AvatarLarge  = 512
+)
+
+// AvatarSizes lists every size avatars are stored in, from
+// largest to smallest, as each is resized from the one before.
+var AvatarSizes = []int{AvatarLarge, AvatarMedium, AvatarSmall}
+
+const (
+	// MaxAvatarBytes is the largest file we accept as an
+	// avatar.
+	MaxAvatarBytes = 10 << 20
+
+	// maxAvatarDimension is the widest or tallest image we
+	// accept as an avatar. Small files can still decode into
+	// huge images, so we check before decoding them.
+	maxAvatarDimension = 6000
+
+	avatarQuality = 90
+)
+
+// avatarTypes are the content types we accept avatars in, as
+// sniffed from the image rather than trusting the upload.
+var avatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// HasAvatar returns true if the user has uploaded a picture.
+func (u *User) HasAvatar() bool {
+	return u.AvatarUpdatedAt != nil
+}
+
+// AvatarURL returns the path to the user's avatar in the
+// given size, which should be one of AvatarSizes. The path
+// changes whenever the avatar does, so browsers can cache it.
+func (u *User) AvatarURL(size int) string {
+	if !u.HasAvatar() {
+		return ""
+	}
+	return fmt.Sprintf("/%s?v=%d", filepath.ToSlash(avatarFile(u.ID, size)), u.AvatarUpdatedAt.Unix())
+}
+
+// avatarDir is where a user's avatars are stored, alongside
+// gallery images.
+func avatarDir(userID uint) string {
+	return filepath.Join("images", "avatars", fmt.Sprintf("%v", userID))
+}
+
+func avatarFile(userID uint, size int) string {
+	return filepath.Join(avatarDir(userID), fmt.Sprintf("%d.jpg", size))
+}
+
+// CreateAvatar validates the image, crops it to a square
+// around its center, and stores it in each of AvatarSizes,
+// replacing the user's current avatar.
+func (is *imageService) CreateAvatar(userID uint, r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxAvatarBytes {
+		return ErrAvatarTooLarge
+	}
+	if !avatarTypes[http.DetectContentType(data)] {
+		return ErrAvatarType
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ErrAvatarType
+	}
+	if cfg.Width > maxAvatarDimension || cfg.Height > maxAvatarDimension {
+		return ErrAvatarTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ErrAvatarType
+	}
+
+	dir := avatarDir(userID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	img := cropSquare(src)
+	for _, size := range AvatarSizes {
+		img = resize(img, size)
+		if err := writeJPEG(avatarFile(userID, size), img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) DeleteAvatar(userID uint) error {
+	return os.RemoveAll(avatarDir(userID))
+}
+
+// cropSquare returns the largest square in the middle of src,
+// drawn onto white so transparent images don't turn black
+// when they are saved as JPEGs.
+func cropSquare(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, offset, draw.Over)
+	return dst
+}
+
+// resize scales the square src to size by size pixels. Each
+// pixel is the average of the pixels it covers in src, which
+// is plenty for shrinking photos. Images smaller than size
+// are scaled up, with each pixel copied from the nearest one.
+func resize(src *image.RGBA, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	n := src.Bounds().Dx()
+	for y := 0; y < size; y++ {
+		y0, y1 := span(y, size, n)
+		for x := 0; x < size; x++ {
+			x0, x1 := span(x, size, n)
+			var r, g, b, a, count int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					count++
+					i += 4
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / count)
+			dst.Pix[i+1] = uint8(g / count)
+			dst.Pix[i+2] = uint8(b / count)
+			dst.Pix[i+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// span returns the range of source pixels covered by pixel i
+// when n pixels are scaled to size. It always covers at least
+// one pixel.
+func span(i, size, n int) (start, end int) {
+	start = i * n / size
+	end = (i + 1) * n / size
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
+
+func writeJPEG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: avatarQuality}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
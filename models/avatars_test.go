@@ -0,0 +1,47 @@
+package models
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCropSquare(t *testing.T) {
+	// A wide image with a red square in the middle and blue
+	// on either side.
+	src := image.NewRGBA(image.Rect(0, 0, 30, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 30; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x >= 10 && x < 20 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	got := cropSquare(src)
+	if b := got.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+		t.Fatalf("cropSquare() bounds = %v; want 10x10", b)
+	}
+	for _, p := range []image.Point{{0, 0}, {9, 9}, {5, 5}} {
+		if c := got.RGBAAt(p.X, p.Y); c != (color.RGBA{255, 0, 0, 255}) {
+			t.Errorf("cropSquare() at %v = %v; want red", p, c)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	for _, size := range []int{2, 4, 8} {
+		got := resize(src, size)
+		if b := got.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Fatalf("resize(%d) bounds = %v", size, b)
+		}
+		if c := got.RGBAAt(size-1, size-1); c != (color.RGBA{200, 200, 200, 200}) {
+			t.Errorf("resize(%d) corner = %v; want {200 200 200 200}", size, c)
+		}
+	}
+}
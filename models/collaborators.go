@@ -0,0 +1,326 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCollaboratorRoleInvalid is returned when a collaborator is given a role that doesn't exist.
+	ErrCollaboratorRoleInvalid modelError = "models: collaborator role is not valid"
+
+	// ErrCollaboratorExists is returned when someone is invited to a gallery they have already been invited to.
+	ErrCollaboratorExists modelError = "models: that person has already been invited to this gallery"
+
+	// ErrCollaboratorIsOwner is returned when the owner of a gallery is invited to it.
+	ErrCollaboratorIsOwner modelError = "models: you can't invite the owner of a gallery to it"
+
+	// ErrInvitationInvalid is returned when a collaboration invitation doesn't exist, was for somebody else, or has already been accepted.
+	ErrInvitationInvalid modelError = "models: that invitation is not valid anymore"
+)
+
+// CollaboratorRole is what a collaborator can do with a
+// gallery that has been shared with them. Each role can do
+// everything the roles before it in CollaboratorRoles can.
+type CollaboratorRole string
+
+const (
+	// CollaboratorViewer can see the gallery and download its
+	// images, no matter its visibility.
+	CollaboratorViewer CollaboratorRole = "viewer"
+
+	// CollaboratorContributor can upload images as well.
+	CollaboratorContributor CollaboratorRole = "contributor"
+
+	// CollaboratorEditor can rename the gallery and delete
+	// its images as well.
+	CollaboratorEditor CollaboratorRole = "editor"
+
+	// CollaboratorCoOwner can do everything the owner can,
+	// except delete the gallery.
+	CollaboratorCoOwner CollaboratorRole = "co_owner"
+)
+
+// CollaboratorRoles lists every role, from least to most
+// powerful.
+var CollaboratorRoles = []CollaboratorRole{
+	CollaboratorViewer,
+	CollaboratorContributor,
+	CollaboratorEditor,
+	CollaboratorCoOwner,
+}
+
+func (r CollaboratorRole) rank() int {
+	for i, role := range CollaboratorRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Valid returns true if r is one of CollaboratorRoles.
+func (r CollaboratorRole) Valid() bool {
+	return r.rank() >= 0
+}
+
+// AtLeast returns true if r can do everything other can.
+func (r CollaboratorRole) AtLeast(other CollaboratorRole) bool {
+	return r.Valid() && r.rank() >= other.rank()
+}
+
+// Title returns the role for people to read.
+func (r CollaboratorRole) Title() string {
+	if r == CollaboratorCoOwner {
+		return "Co-owner"
+	}
+	return strings.Title(string(r))
+}
+
+// Collaborator is somebody a gallery has been shared with.
+// Galleries are shared by inviting an email address, and
+// UserID is only set once the user with that email address
+// accepts the invitation.
+type Collaborator struct {
+	ID          uint             `gorm:"primary_key"`
+	GalleryID   uint             `gorm:"not null;unique_index:idx_collaborators_gallery_email"`
+	Email       string           `gorm:"not null;unique_index:idx_collaborators_gallery_email"`
+	UserID      uint             `gorm:"index"`
+	Role        CollaboratorRole `gorm:"not null"`
+	InvitedByID uint             `gorm:"not null"`
+	AcceptedAt  *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Accepted returns true if the invitation has been accepted,
+// and so the collaborator can use the gallery.
+func (c *Collaborator) Accepted() bool {
+	return c.AcceptedAt != nil && c.UserID != 0
+}
+
+// Collaborator returns the accepted collaborator for the user
+// from the gallery's Collaborators, or nil if the gallery
+// hasn't been shared with them.
+func (g *Gallery) Collaborator(userID uint) *Collaborator {
+	for i, c := range g.Collaborators {
+		if c.Accepted() && c.UserID == userID {
+			return &g.Collaborators[i]
+		}
+	}
+	return nil
+}
+
+// CollaboratorDB is used to interact with the collaborators
+// table.
+//
+// Like UserDB, single collaborator queries return ErrNotFound
+// if the collaborator can't be found.
+type CollaboratorDB interface {
+	ByID(id uint) (*Collaborator, error)
+
+	// ByGalleryID returns everyone the gallery has been shared
+	// with, including invitations that haven't been accepted
+	// yet, oldest first.
+	ByGalleryID(galleryID uint) ([]Collaborator, error)
+
+	// PendingByEmail returns the invitations to the email
+	// address that haven't been accepted yet.
+	PendingByEmail(email string) ([]Collaborator, error)
+
+	Create(collaborator *Collaborator) error
+	Update(collaborator *Collaborator) error
+	Delete(id uint) error
+}
+
+// CollaboratorService is used to share galleries with other
+// users.
+type CollaboratorService interface {
+	CollaboratorDB
+
+	// Accept accepts the invitation with the provided ID on
+	// behalf of the user. Invitations can only be accepted by
+	// the user with the email address they were sent to, and
+	// ErrInvitationInvalid is returned for anybody else.
+	Accept(id uint, user *User) (*Collaborator, error)
+}
+
+func NewCollaboratorService(db *gorm.DB) CollaboratorService {
+	return &collaboratorService{
+		CollaboratorDB: &collaboratorValidator{
+			CollaboratorDB: &collaboratorGorm{db},
+			emailRegex: regexp.MustCompile(
+				`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+type collaboratorService struct {
+	CollaboratorDB
+}
+
+func (cs *collaboratorService) Accept(id uint, user *User) (*Collaborator, error) {
+	collaborator, err := cs.ByID(id)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrInvitationInvalid
+		}
+		return nil, err
+	}
+	if collaborator.Accepted() || collaborator.Email != user.Email {
+		return nil, ErrInvitationInvalid
+	}
+	now := time.Now()
+	collaborator.UserID = user.ID
+	collaborator.AcceptedAt = &now
+	if err := cs.Update(collaborator); err != nil {
+		return nil, err
+	}
+	return collaborator, nil
+}
+
+type collaboratorValidator struct {
+	CollaboratorDB
+	emailRegex *regexp.Regexp
+}
+
+func (cv *collaboratorValidator) PendingByEmail(email string) ([]Collaborator, error) {
+	return cv.CollaboratorDB.PendingByEmail(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func (cv *collaboratorValidator) Create(collaborator *Collaborator) error {
+	err := runCollaboratorValFns(collaborator,
+		cv.galleryIDRequired,
+		cv.normalizeEmail,
+		cv.requireEmail,
+		cv.emailFormat,
+		cv.roleValid,
+		cv.emailIsAvail)
+	if err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Create(collaborator)
+}
+
+func (cv *collaboratorValidator) Update(collaborator *Collaborator) error {
+	err := runCollaboratorValFns(collaborator,
+		cv.galleryIDRequired,
+		cv.roleValid)
+	if err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Update(collaborator)
+}
+
+func (cv *collaboratorValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.CollaboratorDB.Delete(id)
+}
+
+type collaboratorGorm struct {
+	db *gorm.DB
+}
+
+func (cg *collaboratorGorm) ByID(id uint) (*Collaborator, error) {
+	var collaborator Collaborator
+	err := first(cg.db.Where("id = ?", id), &collaborator)
+	if err != nil {
+		return nil, err
+	}
+	return &collaborator, nil
+}
+
+func (cg *collaboratorGorm) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+	var collaborators []Collaborator
+	db := cg.db.Where("gallery_id = ?", galleryID).Order("created_at")
+	if err := db.Find(&collaborators).Error; err != nil {
+		return nil, err
+	}
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) PendingByEmail(email string) ([]Collaborator, error) {
+	var collaborators []Collaborator
+	db := cg.db.Where("email = ? AND accepted_at IS NULL", email).Order("created_at")
+	if err := db.Find(&collaborators).Error; err != nil {
+		return nil, err
+	}
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) Create(collaborator *Collaborator) error {
+	return cg.db.Create(collaborator).Error
+}
+
+func (cg *collaboratorGorm) Update(collaborator *Collaborator) error {
+	return cg.db.Save(collaborator).Error
+}
+
+func (cg *collaboratorGorm) Delete(id uint) error {
+	return cg.db.Delete(&Collaborator{ID: id}).Error
+}
+
+type collaboratorValFn func(*Collaborator) error
+
+func runCollaboratorValFns(collaborator *Collaborator, fns ...collaboratorValFn) error {
+	for _, fn := range fns {
+		if err := fn(collaborator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) galleryIDRequired(c *Collaborator) error {
+	if c.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) normalizeEmail(c *Collaborator) error {
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	return nil
+}
+
+func (cv *collaboratorValidator) requireEmail(c *Collaborator) error {
+	if c.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) emailFormat(c *Collaborator) error {
+	if !cv.emailRegex.MatchString(c.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) roleValid(c *Collaborator) error {
+	if !c.Role.Valid() {
+		return ErrCollaboratorRoleInvalid
+	}
+	return nil
+}
+
+// emailIsAvail makes sure nobody is invited to the same
+// gallery twice. The unique index would catch it too, but
+// not with an error we can show people.
+func (cv *collaboratorValidator) emailIsAvail(c *Collaborator) error {
+	existing, err := cv.ByGalleryID(c.GalleryID)
+	if err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if other.Email == c.Email && other.ID != c.ID {
+			return ErrCollaboratorExists
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// emailVerificationDuration is how long a user has to click
+// the link in their verification email.
+const emailVerificationDuration = 72 * time.Hour
+
+// emailVerification is used to store the tokens we email to
+// users to confirm they own an email address. Email records
+// the address the token was sent to so that a token sent
+// for an old pending address can't confirm a newer one.
+type emailVerification struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+}
+
+// Expired returns true if the verification token is too old
+// to be used.
+func (ev *emailVerification) Expired() bool {
+	return time.Now().Sub(ev.CreatedAt) > emailVerificationDuration
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+	Create(ev *emailVerification) error
+	Delete(id uint) error
+}
+
+func newEmailVerificationValidator(db emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: db,
+		hmac:                hmac,
+	}
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the provided token with each of our
+// HMAC keys and pass the hashes on to the database layer
+// until a verification is found.
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+	var ev *emailVerification
+	err := byHashes(evv.hmac.HashAll(token), func(tokenHash string) error {
+		var err error
+		ev, err = evv.emailVerificationDB.ByToken(tokenHash)
+		return err
+	})
+	return ev, err
+}
+
+// Create will generate a token if one isn't provided and
+// then hash it before it is stored.
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+	err := runEmailVerificationValFns(ev,
+		evv.requireUserID,
+		evv.requireEmail,
+		evv.setTokenIfUnset,
+		evv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return evv.emailVerificationDB.Delete(id)
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*emailVerification, error) {
+	var ev emailVerification
+	err := first(evg.db.Where("token_hash = ?", tokenHash), &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) Delete(id uint) error {
+	ev := emailVerification{ID: id}
+	return evg.db.Delete(&ev).Error
+}
+
+type emailVerificationValFn func(*emailVerification) error
+
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+	if ev.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) requireEmail(ev *emailVerification) error {
+	if ev.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+	if ev.Token == "" {
+		return nil
+	}
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
+
+// backfillEmailVerified marks the email addresses of users
+// who signed up before we verified them as verified when
+// they signed up, rather than locking them out of everything
+// that needs a verified address until they verify it.
+func (s *Services) backfillEmailVerified() error {
+	return s.db.Model(&User{}).
+		Where("email_verified_at IS NULL").
+		UpdateColumn("email_verified_at", gorm.Expr("created_at")).Error
+}
@@ -0,0 +1,530 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrExportPending is returned when a user asks for an export while another one is still being built.
+	ErrExportPending modelError = "models: your last export is still being prepared. We'll email you when it is ready"
+
+	// ErrExportExpired is returned when a user tries to download an export that isn't available anymore.
+	ErrExportExpired modelError = "models: that export has expired. Please request a new one"
+
+	// ErrExportNotReady is returned when a user tries to download an export that hasn't been built.
+	ErrExportNotReady modelError = "models: that export isn't ready yet"
+)
+
+const (
+	// ExportLifetime is how long an export can be downloaded
+	// for once it has been requested. After that the archive
+	// is deleted, as it is a full copy of the user's data.
+	ExportLifetime = 48 * time.Hour
+
+	// exportBuildTimeout is how long an export can be pending
+	// before we give up on it. Builds run in the background,
+	// so one that was interrupted by a restart would otherwise
+	// be pending forever and stop the user asking for another.
+	exportBuildTimeout = time.Hour
+
+	// exportDir is where export archives are stored, relative
+	// to where our Go application is run from.
+	exportDir = "exports"
+)
+
+// The statuses an export can be in.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is a ZIP archive of everything we hold about a user
+// that they have asked us for. The archive itself is stored
+// on disk, and is only kept until ExpiresAt.
+type Export struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Expired returns true if the export can no longer be
+// downloaded.
+func (e *Export) Expired() bool {
+	return time.Now().After(e.ExpiresAt)
+}
+
+// Ready returns true if the export can be downloaded.
+func (e *Export) Ready() bool {
+	return e.Status == ExportReady && !e.Expired()
+}
+
+// Filename is the name the archive is downloaded as.
+func (e *Export) Filename() string {
+	return "lenslocked-export-" + e.CreatedAt.Format("2006-01-02") + ".zip"
+}
+
+// exportPath is where the archive for the export with the
+// given ID is stored.
+func exportPath(id uint) string {
+	return filepath.Join(exportDir, fmt.Sprintf("%d.zip", id))
+}
+
+// ExportDB is used to interact with the exports table.
+//
+// Like UserDB, single export queries return ErrNotFound if
+// the export can't be found.
+type ExportDB interface {
+	ByID(id uint) (*Export, error)
+	ByUserID(userID uint) ([]Export, error)
+
+	// ByExpiresBefore returns every export that expired
+	// before t.
+	ByExpiresBefore(t time.Time) ([]Export, error)
+
+	// FailPendingBefore marks every export that has been
+	// pending since before t as failed.
+	FailPendingBefore(t time.Time) error
+
+	Create(export *Export) error
+	Update(export *Export) error
+	Delete(id uint) error
+}
+
+// ExportService is a set of methods used to build data
+// exports for users and to look them up.
+type ExportService interface {
+	// Request creates a pending export for the user, which
+	// then needs to be built with Build. Users can only have
+	// one pending export at a time, and ErrExportPending is
+	// returned if they already do.
+	Request(user *User) (*Export, error)
+
+	// Build writes the archive for a pending export and marks
+	// it as ready. If anything goes wrong the export is marked
+	// as failed and the error is returned. Builds can take a
+	// while for users with a lot of images, so this is meant
+	// to be called in the background.
+	Build(export *Export) error
+
+	// Open opens the archive of an export so it can be
+	// downloaded. The caller needs to close it.
+	Open(export *Export) (*os.File, error)
+
+	// Cleanup deletes expired exports along with their
+	// archives, and gives up on builds that have taken too
+	// long. It is safe to run as often as we like.
+	Cleanup() error
+	ExportDB
+}
+
+// NewExportService needs the services that hold a user's data
+// so that it can gather all of it into their export.
+func NewExportService(db *gorm.DB, us UserService, gs GalleryService, is ImageService, ss SessionService, ids IdentityService) ExportService {
+	return &exportService{
+		ExportDB: &exportValidator{
+			ExportDB: &exportGorm{db},
+		},
+		us:  us,
+		gs:  gs,
+		is:  is,
+		ss:  ss,
+		ids: ids,
+	}
+}
+
+type exportService struct {
+	ExportDB
+	us  UserService
+	gs  GalleryService
+	is  ImageService
+	ss  SessionService
+	ids IdentityService
+}
+
+func (es *exportService) Request(user *User) (*Export, error) {
+	exports, err := es.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, export := range exports {
+		if export.Status == ExportPending && time.Since(export.CreatedAt) < exportBuildTimeout {
+			return nil, ErrExportPending
+		}
+	}
+	export := Export{
+		UserID:    user.ID,
+		Status:    ExportPending,
+		ExpiresAt: time.Now().Add(ExportLifetime),
+	}
+	if err := es.Create(&export); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (es *exportService) Build(export *Export) error {
+	if err := es.writeArchive(export); err != nil {
+		export.Status = ExportFailed
+		if uerr := es.Update(export); uerr != nil {
+			log.Println(uerr)
+		}
+		return err
+	}
+	export.Status = ExportReady
+	return es.Update(export)
+}
+
+func (es *exportService) Open(export *Export) (*os.File, error) {
+	if export.Expired() {
+		return nil, ErrExportExpired
+	}
+	if export.Status != ExportReady {
+		return nil, ErrExportNotReady
+	}
+	return os.Open(exportPath(export.ID))
+}
+
+func (es *exportService) Cleanup() error {
+	err := es.FailPendingBefore(time.Now().Add(-exportBuildTimeout))
+	if err != nil {
+		return err
+	}
+	exports, err := es.ByExpiresBefore(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		err := os.Remove(exportPath(export.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := es.Delete(export.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportManifest is written to manifest.json at the root of
+// every export. It holds everything we know about the user
+// that isn't an image file, and says where in the archive
+// each of their images can be found.
+//
+// Password hashes and TOTP secrets are left out on purpose.
+// They aren't information about the user so much as the
+// means to sign in as them, and the archive could end up
+// anywhere once it has been downloaded.
+type exportManifest struct {
+	GeneratedAt    time.Time        `json:"generated_at"`
+	Profile        exportProfile    `json:"profile"`
+	Galleries      []exportGallery  `json:"galleries"`
+	Sessions       []exportSession  `json:"sessions"`
+	LinkedAccounts []exportIdentity `json:"linked_accounts"`
+}
+
+type exportProfile struct {
+	ID                  uint       `json:"id"`
+	Name                string     `json:"name"`
+	Username            string     `json:"username"`
+	Bio                 string     `json:"bio"`
+	Avatar              string     `json:"avatar,omitempty"`
+	Email               string     `json:"email"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+	PendingEmail        string     `json:"pending_email,omitempty"`
+	Role                Role       `json:"role"`
+	SuspendedAt         *time.Time `json:"suspended_at,omitempty"`
+	TwoFactorEnabledAt  *time.Time `json:"two_factor_enabled_at"`
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+type exportGallery struct {
+	ID          uint          `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description,omitempty"`
+	EventDate   *time.Time    `json:"event_date,omitempty"`
+	Location    string        `json:"location,omitempty"`
+	CoverImage  string        `json:"cover_image,omitempty"`
+	Visibility  Visibility    `json:"visibility"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Images      []exportImage `json:"images"`
+}
+
+type exportImage struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+}
+
+type exportSession struct {
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type exportIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeArchive writes the export's archive. The archive is
+// written to a temporary file that is only renamed into
+// place once it is complete, so a failed build never leaves
+// a partial archive to be downloaded.
+func (es *exportService) writeArchive(export *Export) error {
+	user, err := es.us.ByID(export.UserID)
+	if err != nil {
+		return err
+	}
+	galleries, err := es.gs.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	sessions, err := es.ss.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	identities, err := es.ids.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return err
+	}
+	dst := exportPath(export.ID)
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	manifest := exportManifest{
+		GeneratedAt: time.Now(),
+		Profile: exportProfile{
+			ID:                  user.ID,
+			Name:                user.Name,
+			Username:            user.Username,
+			Bio:                 user.Bio,
+			Email:               user.Email,
+			EmailVerifiedAt:     user.EmailVerifiedAt,
+			PendingEmail:        user.PendingEmail,
+			Role:                user.Role,
+			SuspendedAt:         user.SuspendedAt,
+			TwoFactorEnabledAt:  user.TOTPEnabledAt,
+			DeletionRequestedAt: user.DeletionRequestedAt,
+			CreatedAt:           user.CreatedAt,
+			UpdatedAt:           user.UpdatedAt,
+		},
+		Galleries:      make([]exportGallery, 0, len(galleries)),
+		Sessions:       make([]exportSession, 0, len(sessions)),
+		LinkedAccounts: make([]exportIdentity, 0, len(identities)),
+	}
+	zw := zip.NewWriter(f)
+	if user.HasAvatar() {
+		manifest.Profile.Avatar = "avatar.jpg"
+		if err := addFile(zw, manifest.Profile.Avatar, avatarFile(user.ID, AvatarLarge)); err != nil {
+			return err
+		}
+	}
+	for _, gallery := range galleries {
+		// Galleries shared with the user belong to somebody
+		// else, so they aren't part of the user's data.
+		if gallery.UserID != user.ID {
+			continue
+		}
+		images, err := es.is.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+		eg := exportGallery{
+			ID:          gallery.ID,
+			Title:       gallery.Title,
+			Description: gallery.Description,
+			EventDate:   gallery.EventDate,
+			Location:    gallery.Location,
+			CoverImage:  gallery.CoverImage,
+			Visibility:  gallery.Visibility,
+			CreatedAt:   gallery.CreatedAt,
+			UpdatedAt:   gallery.UpdatedAt,
+			Images:      make([]exportImage, 0, len(images)),
+		}
+		for _, image := range images {
+			name := path.Join("galleries", strconv.FormatUint(uint64(gallery.ID), 10), image.Filename)
+			if err := addFile(zw, name, image.RelativePath()); err != nil {
+				return err
+			}
+			eg.Images = append(eg.Images, exportImage{
+				Filename: image.Filename,
+				Path:     name,
+			})
+		}
+		manifest.Galleries = append(manifest.Galleries, eg)
+	}
+	for _, session := range sessions {
+		manifest.Sessions = append(manifest.Sessions, exportSession{
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+		})
+	}
+	for _, identity := range identities {
+		manifest.LinkedAccounts = append(manifest.LinkedAccounts, exportIdentity{
+			Provider:  identity.Provider,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// addFile copies the file at src into the archive as name.
+// Images are already compressed, so they are stored as they
+// are rather than spending time compressing them again.
+func addFile(zw *zip.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+type exportValidator struct {
+	ExportDB
+}
+
+func (ev *exportValidator) Create(export *Export) error {
+	err := runExportValFns(export,
+		ev.userIDRequired)
+	if err != nil {
+		return err
+	}
+	return ev.ExportDB.Create(export)
+}
+
+func (ev *exportValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return ev.ExportDB.Delete(id)
+}
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+func (eg *exportGorm) ByID(id uint) (*Export, error) {
+	var export Export
+	db := eg.db.Where("id = ?", id)
+	if err := first(db, &export); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (eg *exportGorm) ByUserID(userID uint) ([]Export, error) {
+	var exports []Export
+	db := eg.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := db.Find(&exports).Error; err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) ByExpiresBefore(t time.Time) ([]Export, error) {
+	var exports []Export
+	db := eg.db.Where("expires_at < ?", t)
+	if err := db.Find(&exports).Error; err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) FailPendingBefore(t time.Time) error {
+	return eg.db.Model(&Export{}).
+		Where("status = ? AND created_at < ?", ExportPending, t).
+		Update("status", ExportFailed).Error
+}
+
+func (eg *exportGorm) Create(export *Export) error {
+	return eg.db.Create(export).Error
+}
+
+func (eg *exportGorm) Update(export *Export) error {
+	return eg.db.Save(export).Error
+}
+
+func (eg *exportGorm) Delete(id uint) error {
+	export := Export{ID: id}
+	return eg.db.Delete(&export).Error
+}
+
+type exportValFn func(*Export) error
+
+func runExportValFns(export *Export, fns ...exportValFn) error {
+	for _, fn := range fns {
+		if err := fn(export); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ev *exportValidator) userIDRequired(export *Export) error {
+	if export.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
@@ -1,12 +1,88 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	ErrUserIDRequired    modelError = "models: user ID is required"
+	ErrTitleRequired     modelError = "models: title is required"
+	ErrVisibilityInvalid modelError = "models: visibility is not valid"
+
+	// ErrDescriptionTooLong is returned when a gallery's description is longer than MaxDescriptionLength.
+	ErrDescriptionTooLong modelError = "models: description must be at most 5000 characters long"
+
+	// ErrLocationTooLong is returned when a gallery's location is longer than MaxLocationLength.
+	ErrLocationTooLong modelError = "models: location must be at most 200 characters long"
+
+	// ErrEventDateInvalid is returned when a gallery's event date isn't a date we believe.
+	ErrEventDateInvalid modelError = "models: event date is not valid"
+
+	// ErrCoverImageInvalid is returned when a gallery's cover isn't one of its images.
+	ErrCoverImageInvalid modelError = "models: cover image must be one of the gallery's images"
+)
+
+const (
+	// MaxDescriptionLength is the most characters a gallery's
+	// description can have.
+	MaxDescriptionLength = 5000
+
+	// MaxLocationLength is the most characters a gallery's
+	// location can have.
+	MaxLocationLength = 200
+
+	// EventDateFormat is how event dates are entered and
+	// shown in forms.
+	EventDateFormat = "2006-01-02"
+)
+
+// unlistedKeyBytes is how much randomness goes into the key
+// in an unlisted gallery's URL.
+const unlistedKeyBytes = 16
+
+// Visibility decides who can see a gallery and its images.
+type Visibility string
 
 const (
-	ErrUserIDRequired modelError = "models: user ID is required"
-	ErrTitleRequired  modelError = "models: title is required"
+	// VisibilityPrivate galleries can only be seen by their
+	// owner.
+	VisibilityPrivate Visibility = "private"
+
+	// VisibilityUnlisted galleries can be seen by anyone with
+	// the link, which includes a key nobody can guess.
+	VisibilityUnlisted Visibility = "unlisted"
+
+	// VisibilityPublic galleries can be seen by anyone, and
+	// are listed on their owner's profile.
+	VisibilityPublic Visibility = "public"
 )
 
+// Visibilities lists every visibility, from most to least
+// private.
+var Visibilities = []Visibility{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// Valid returns true if v is one of Visibilities.
+func (v Visibility) Valid() bool {
+	for _, visibility := range Visibilities {
+		if v == visibility {
+			return true
+		}
+	}
+	return false
+}
+
+// Title returns the visibility for people to read.
+func (v Visibility) Title() string {
+	return strings.Title(string(v))
+}
+
 // Gallery represents the galleries table in our DB
 // and is mostly a container resource composed of images.
 type Gallery struct {
@@ -14,6 +90,58 @@ type Gallery struct {
 	UserID uint    `gorm:"not_null;index"`
 	Title  string  `gorm:"not_null"`
 	Images []Image `gorm:"-"`
+
+	// Description is written in Markdown, and rendered with
+	// the markdown package. EventDate is the day the photos
+	// were taken, if the gallery is for an event. CoverImage
+	// is the filename of the image shown for the gallery in
+	// lists of galleries.
+	Description string `gorm:"type:text"`
+	EventDate   *time.Time
+	Location    string
+	CoverImage  string
+
+	// Visibility defaults to private. UnlistedKey is the key
+	// in the gallery's URL while it is unlisted. It is kept
+	// if the gallery is made private or public, so links
+	// that were shared start working again if it is made
+	// unlisted again.
+	Visibility  Visibility `gorm:"not null;default:'private'"`
+	UnlistedKey string
+
+	// Password is only set when the owner is choosing a new
+	// password, and is never stored. Visitors other than the
+	// owner need to enter it before they can see the gallery
+	// if PasswordHash isn't empty.
+	Password     string `gorm:"-"`
+	PasswordHash string
+
+	// Collaborators are the people the gallery has been
+	// shared with. They aren't loaded by GalleryDB, so they
+	// need to be looked up with a CollaboratorService.
+	Collaborators []Collaborator `gorm:"-"`
+
+	// SharedRole is set by ByUserID for galleries that were
+	// shared with the user rather than owned by them.
+	SharedRole CollaboratorRole `gorm:"-"`
+}
+
+// KeyValid returns true if the gallery is unlisted and key is
+// the one in its URL.
+func (g *Gallery) KeyValid(key string) bool {
+	if g.Visibility != VisibilityUnlisted || key == "" || g.UnlistedKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(g.UnlistedKey)) == 1
+}
+
+// Cover returns the gallery's cover image, or nil if it
+// doesn't have one.
+func (g *Gallery) Cover() *Image {
+	if g.CoverImage == "" {
+		return nil
+	}
+	return &Image{GalleryID: g.ID, Filename: g.CoverImage}
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -28,22 +156,41 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	return ret
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+// NewGalleryService uses hmacKeys to sign the tokens visitors
+// are given when they unlock a gallery with its password.
+func NewGalleryService(db *gorm.DB, hmacKeys hash.KeySet) GalleryService {
+	passwords := hash.Bcrypt{}
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
 			},
+			passwords: passwords,
 		},
+		passwords: passwords,
+		hmac:      hash.NewHMAC(hmacKeys),
 	}
 }
 
 type GalleryService interface {
 	GalleryDB
+
+	// Unlock checks the password against the gallery's, and
+	// returns a token that proves the visitor knew it until
+	// the returned expiry. ErrPasswordIncorrect is returned
+	// if the password doesn't match.
+	Unlock(gallery *Gallery, password string) (token string, expires time.Time, err error)
+
+	// Unlocked returns true if token was returned by Unlock
+	// for the gallery, hasn't expired, and the gallery's
+	// password hasn't changed since.
+	Unlocked(gallery *Gallery, token string) bool
 }
 
 type galleryService struct {
 	GalleryDB
+	passwords hash.PasswordHasher
+	hmac      hash.HMAC
 }
 
 // GalleryDB is used to interact with the galleries database.
@@ -56,7 +203,20 @@ type galleryService struct {
 // an error generated by the models package.
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+
+	// ByUserID returns the galleries the user owns, followed
+	// by the galleries that have been shared with them.
 	ByUserID(userID uint) ([]Gallery, error)
+
+	// PublicByUserID returns the user's public galleries,
+	// newest first.
+	PublicByUserID(userID uint) ([]Gallery, error)
+
+	// Search returns up to limit galleries whose title
+	// contains query, newest first. An empty query matches
+	// every gallery.
+	Search(query string, limit int) ([]Gallery, error)
+
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
@@ -64,12 +224,23 @@ type GalleryDB interface {
 
 type galleryValidator struct {
 	GalleryDB
+	passwords hash.PasswordHasher
 }
 
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
+		gv.normalizeDetails,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.setUnlistedKey,
+		gv.passwordMinLength,
+		gv.descriptionLength,
+		gv.locationLength,
+		gv.eventDateValid,
+		gv.coverImageValid,
+		gv.hashPassword)
 	if err != nil {
 		return err
 	}
@@ -78,14 +249,28 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
+		gv.normalizeDetails,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.setUnlistedKey,
+		gv.passwordMinLength,
+		gv.descriptionLength,
+		gv.locationLength,
+		gv.eventDateValid,
+		gv.coverImageValid,
+		gv.hashPassword)
 	if err != nil {
 		return err
 	}
 	return gv.GalleryDB.Update(gallery)
 }
 
+func (gv *galleryValidator) Search(query string, limit int) ([]Gallery, error) {
+	return gv.GalleryDB.Search(strings.TrimSpace(query), limit)
+}
+
 func (gv *galleryValidator) Delete(id uint) error {
 	var gallery Gallery
 	gallery.ID = id
@@ -120,6 +305,50 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	if err := db.Find(&galleries).Error; err != nil {
 		return nil, err
 	}
+	var collaborators []Collaborator
+	db = gg.db.Where("user_id = ? AND accepted_at IS NOT NULL", userID)
+	if err := db.Find(&collaborators).Error; err != nil {
+		return nil, err
+	}
+	if len(collaborators) == 0 {
+		return galleries, nil
+	}
+	roles := make(map[uint]CollaboratorRole, len(collaborators))
+	ids := make([]uint, len(collaborators))
+	for i, c := range collaborators {
+		roles[c.GalleryID] = c.Role
+		ids[i] = c.GalleryID
+	}
+	var shared []Gallery
+	db = gg.db.Where("id IN (?)", ids).Order("id")
+	if err := db.Find(&shared).Error; err != nil {
+		return nil, err
+	}
+	for i := range shared {
+		shared[i].SharedRole = roles[shared[i].ID]
+	}
+	return append(galleries, shared...), nil
+}
+
+func (gg *galleryGorm) PublicByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Where("user_id = ? AND visibility = ?", userID, VisibilityPublic).
+		Order("id desc")
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Search(query string, limit int) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Order("id desc").Limit(limit)
+	if query != "" {
+		db = db.Where("title ILIKE ?", likePattern(query))
+	}
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
 	return galleries, nil
 }
 
@@ -150,6 +379,94 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	if !g.Visibility.Valid() {
+		return ErrVisibilityInvalid
+	}
+	return nil
+}
+
+// setUnlistedKey gives unlisted galleries a key the first
+// time they need one.
+func (gv *galleryValidator) setUnlistedKey(g *Gallery) error {
+	if g.Visibility != VisibilityUnlisted || g.UnlistedKey != "" {
+		return nil
+	}
+	key, err := rand.String(unlistedKeyBytes)
+	if err != nil {
+		return err
+	}
+	g.UnlistedKey = key
+	return nil
+}
+
+// normalizeDetails trims the details people type in, and
+// drops the time of day from the event date, which is only
+// ever a day.
+func (gv *galleryValidator) normalizeDetails(g *Gallery) error {
+	g.Title = strings.TrimSpace(g.Title)
+	g.Description = strings.TrimSpace(g.Description)
+	g.Location = strings.TrimSpace(g.Location)
+	g.CoverImage = strings.TrimSpace(g.CoverImage)
+	if g.EventDate != nil {
+		y, m, d := g.EventDate.Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		g.EventDate = &date
+	}
+	return nil
+}
+
+func (gv *galleryValidator) descriptionLength(g *Gallery) error {
+	if utf8.RuneCountInString(g.Description) > MaxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+func (gv *galleryValidator) locationLength(g *Gallery) error {
+	if utf8.RuneCountInString(g.Location) > MaxLocationLength {
+		return ErrLocationTooLong
+	}
+	return nil
+}
+
+// eventDateValid rejects dates from before photography was
+// commonplace, or so far in the future that they must be a
+// typo. Dates a little ahead are fine, as galleries can be
+// created ahead of an event.
+func (gv *galleryValidator) eventDateValid(g *Gallery) error {
+	if g.EventDate == nil {
+		return nil
+	}
+	if g.EventDate.Year() < 1850 || g.EventDate.After(time.Now().AddDate(10, 0, 0)) {
+		return ErrEventDateInvalid
+	}
+	return nil
+}
+
+// coverImageValid makes sure the cover is one of the
+// gallery's images. Images live on disk rather than in the
+// database, so the caller needs to have loaded them into
+// Images before setting a cover.
+func (gv *galleryValidator) coverImageValid(g *Gallery) error {
+	if g.CoverImage == "" {
+		return nil
+	}
+	for _, image := range g.Images {
+		if image.Filename == g.CoverImage {
+			return nil
+		}
+	}
+	return ErrCoverImageInvalid
+}
+
 func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
 		return ErrIDInvalid
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGalleryDetailsValidation(t *testing.T) {
+	gv := &galleryValidator{}
+	date := func(y int) *time.Time {
+		d := time.Date(y, time.June, 1, 15, 30, 0, 0, time.UTC)
+		return &d
+	}
+	images := []Image{{GalleryID: 1, Filename: "a.jpg"}}
+	tests := []struct {
+		name    string
+		gallery Gallery
+		want    error
+	}{
+		{"empty", Gallery{}, nil},
+		{"details", Gallery{Description: "# Hi", Location: "Paris", EventDate: date(2019)}, nil},
+		{"long description", Gallery{Description: strings.Repeat("é", MaxDescriptionLength+1)}, ErrDescriptionTooLong},
+		{"long location", Gallery{Location: strings.Repeat("a", MaxLocationLength+1)}, ErrLocationTooLong},
+		{"ancient date", Gallery{EventDate: date(1700)}, ErrEventDateInvalid},
+		{"future date", Gallery{EventDate: date(time.Now().Year() + 20)}, ErrEventDateInvalid},
+		{"cover", Gallery{CoverImage: "a.jpg", Images: images}, nil},
+		{"missing cover", Gallery{CoverImage: "b.jpg", Images: images}, ErrCoverImageInvalid},
+	}
+	for _, tc := range tests {
+		err := runGalleryValFns(&tc.gallery,
+			gv.normalizeDetails,
+			gv.descriptionLength,
+			gv.locationLength,
+			gv.eventDateValid,
+			gv.coverImageValid)
+		if err != tc.want {
+			t.Errorf("%s: err = %v; want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestGalleryNormalizeDetails(t *testing.T) {
+	gv := &galleryValidator{}
+	eventDate := time.Date(2020, time.March, 3, 23, 59, 0, 0, time.FixedZone("EST", -5*3600))
+	g := Gallery{
+		Title:     "  Wedding ",
+		Location:  " Paris\n",
+		EventDate: &eventDate,
+	}
+	if err := gv.normalizeDetails(&g); err != nil {
+		t.Fatalf("normalizeDetails() err = %v", err)
+	}
+	if g.Title != "Wedding" || g.Location != "Paris" {
+		t.Errorf("normalizeDetails() = %q, %q; want trimmed", g.Title, g.Location)
+	}
+	want := time.Date(2020, time.March, 3, 0, 0, 0, 0, time.UTC)
+	if !g.EventDate.Equal(want) {
+		t.Errorf("EventDate = %v; want %v", g.EventDate, want)
+	}
+}
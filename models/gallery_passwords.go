@@ -0,0 +1,96 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// GalleryUnlockDuration is how long visitors can see a
+// password protected gallery before they need to enter its
+// password again.
+const GalleryUnlockDuration = 7 * 24 * time.Hour
+
+// HasPassword returns true if visitors need to enter a
+// password before they can see the gallery.
+func (g *Gallery) HasPassword() bool {
+	return g.PasswordHash != ""
+}
+
+func (gs *galleryService) Unlock(gallery *Gallery, password string) (string, time.Time, error) {
+	if !gallery.HasPassword() {
+		return "", time.Time{}, ErrPasswordIncorrect
+	}
+	err := gs.passwords.Compare(gallery.PasswordHash, password)
+	switch err {
+	case nil:
+	case hash.ErrPasswordMismatch:
+		return "", time.Time{}, ErrPasswordIncorrect
+	default:
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(GalleryUnlockDuration)
+	token := strconv.FormatInt(expires.Unix(), 10) + "." +
+		gs.hmac.Hash(unlockMessage(gallery, expires.Unix()))
+	return token, expires, nil
+}
+
+func (gs *galleryService) Unlocked(gallery *Gallery, token string) bool {
+	if !gallery.HasPassword() {
+		return true
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	// Tokens signed with any of our keys are accepted, so
+	// rotating keys doesn't lock everyone out.
+	for _, sig := range gs.hmac.HashAll(unlockMessage(gallery, expires)) {
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(parts[1])) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockMessage is what an unlock token signs. The password
+// hash is included so that changing or removing the password
+// locks everyone out again.
+func unlockMessage(gallery *Gallery, expires int64) string {
+	return fmt.Sprintf("gallery-unlock:%d:%d:%s", gallery.ID, expires, gallery.PasswordHash)
+}
+
+func (gv *galleryValidator) passwordMinLength(g *Gallery) error {
+	if g.Password == "" {
+		return nil
+	}
+	if len(g.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// hashPassword replaces the gallery's password hash if it has
+// been given a new password. Gallery passwords aren't
+// peppered, as unlike user passwords they are meant to be
+// shared.
+func (gv *galleryValidator) hashPassword(g *Gallery) error {
+	if g.Password == "" {
+		return nil
+	}
+	hashed, err := gv.passwords.Hash(g.Password)
+	if err != nil {
+		return err
+	}
+	g.PasswordHash = hashed
+	g.Password = ""
+	return nil
+}
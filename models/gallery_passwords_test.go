@@ -0,0 +1,83 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+func testGalleryService(keys hash.KeySet) *galleryService {
+	return &galleryService{
+		passwords: hash.Bcrypt{Cost: 4},
+		hmac:      hash.NewHMAC(keys),
+	}
+}
+
+func TestGalleryUnlock(t *testing.T) {
+	gs := testGalleryService(hash.SingleKey("secret"))
+	gv := &galleryValidator{passwords: hash.Bcrypt{Cost: 4}}
+	gallery := &Gallery{Password: "correct horse"}
+	gallery.ID = 7
+	if err := gv.hashPassword(gallery); err != nil {
+		t.Fatalf("hashPassword() err = %v", err)
+	}
+
+	if _, _, err := gs.Unlock(gallery, "wrong password"); err != ErrPasswordIncorrect {
+		t.Fatalf("Unlock(wrong) err = %v; want %v", err, ErrPasswordIncorrect)
+	}
+	token, _, err := gs.Unlock(gallery, "correct horse")
+	if err != nil {
+		t.Fatalf("Unlock() err = %v", err)
+	}
+	if !gs.Unlocked(gallery, token) {
+		t.Errorf("Unlocked() = false for the token Unlock returned")
+	}
+
+	other := *gallery
+	other.ID = 8
+	if gs.Unlocked(&other, token) {
+		t.Errorf("Unlocked() = true for a different gallery")
+	}
+
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) +
+		"." + gs.hmac.Hash(unlockMessage(gallery, time.Now().Add(-time.Minute).Unix()))
+	if gs.Unlocked(gallery, expired) {
+		t.Errorf("Unlocked() = true for an expired token")
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	later := time.Now().Add(365 * 24 * time.Hour).Unix()
+	if gs.Unlocked(gallery, strconv.FormatInt(later, 10)+"."+parts[1]) {
+		t.Errorf("Unlocked() = true after the expiry was changed")
+	}
+
+	gallery.Password = "a new password"
+	if err := gv.hashPassword(gallery); err != nil {
+		t.Fatalf("hashPassword() err = %v", err)
+	}
+	if gs.Unlocked(gallery, token) {
+		t.Errorf("Unlocked() = true after the password was changed")
+	}
+}
+
+func TestGalleryUnlockKeyRotation(t *testing.T) {
+	gallery := &Gallery{PasswordHash: "$2a$04$not-checked-by-unlocked"}
+	gallery.ID = 1
+	old := testGalleryService(hash.SingleKey("old-secret"))
+	expires := time.Now().Add(time.Hour).Unix()
+	token := strconv.FormatInt(expires, 10) + "." + old.hmac.Hash(unlockMessage(gallery, expires))
+
+	rotated := testGalleryService(hash.KeySet{
+		Active: "new",
+		Keys: map[string]string{
+			"new": "new-secret",
+			"old": "old-secret",
+		},
+	})
+	if !rotated.Unlocked(gallery, token) {
+		t.Errorf("Unlocked() = false for a token signed with a retired key")
+	}
+}
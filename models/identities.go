@@ -0,0 +1,262 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrProviderRequired is returned when an identity is missing the provider it came from.
+	ErrProviderRequired modelError = "models: identity provider is required"
+
+	// ErrSubjectRequired is returned when an identity is missing the provider's ID for the user.
+	ErrSubjectRequired modelError = "models: identity subject is required"
+
+	// ErrIdentityEmailRequired is returned when a provider doesn't share an email address we can use to create an account.
+	ErrIdentityEmailRequired modelError = "models: we need your email address to create an account, but the provider didn't share it"
+
+	// ErrIdentityEmailTaken is returned when an identity can't be linked to the existing account with the same email address because one of the addresses isn't verified.
+	ErrIdentityEmailTaken modelError = "models: an account already exists with that email address. Please log in with your password, or reset it, and then link this account from your account settings"
+
+	// ErrIdentityTaken is returned when an identity is already linked to a different user.
+	ErrIdentityTaken modelError = "models: that account is already linked to a different user"
+)
+
+// Identity links a user to an account they have with an
+// OpenID Connect provider, so they can sign in with it.
+// Subject is the provider's ID for the user, which unlike
+// their email address never changes.
+type Identity struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Provider  string `gorm:"not null;unique_index:idx_identity_provider_subject"`
+	Subject   string `gorm:"not null;unique_index:idx_identity_provider_subject"`
+	Email     string
+	CreatedAt time.Time
+}
+
+// ExternalIdentity is what a provider tells us about a user
+// once they have signed in with it.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityDB is used to interact with the identities table.
+//
+// Like UserDB, single identity queries return ErrNotFound if
+// the identity can't be found.
+type IdentityDB interface {
+	ByProviderSubject(provider, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+	Create(identity *Identity) error
+	Delete(id uint) error
+}
+
+// IdentityService is a set of methods used to sign users in
+// with their provider accounts and to manage those links.
+type IdentityService interface {
+	// Resolve returns the user to sign in for the external
+	// identity. If it isn't linked to anyone yet it is linked
+	// to the user with the same email address, as long as both
+	// the provider and we have verified that address. If
+	// nobody has the address a new user is created.
+	Resolve(ext ExternalIdentity) (*User, error)
+
+	// Link links the external identity to the user. If it is
+	// already linked to a different user ErrIdentityTaken is
+	// returned.
+	Link(user *User, ext ExternalIdentity) error
+	IdentityDB
+}
+
+// NewIdentityService needs the UserService so that it can
+// look up and create the users that identities belong to.
+func NewIdentityService(db *gorm.DB, us UserService) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{db},
+		},
+		us: us,
+	}
+}
+
+type identityService struct {
+	IdentityDB
+	us UserService
+}
+
+func (is *identityService) Resolve(ext ExternalIdentity) (*User, error) {
+	identity, err := is.ByProviderSubject(ext.Provider, ext.Subject)
+	switch err {
+	case nil:
+		return is.us.ByID(identity.UserID)
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	if ext.Email == "" {
+		return nil, ErrIdentityEmailRequired
+	}
+	user, err := is.us.ByEmail(ext.Email)
+	switch err {
+	case nil:
+		// If either side hasn't verified the address, whoever
+		// signed up with it might not own it, and linking would
+		// hand one person's account to the other.
+		if !ext.EmailVerified || !user.EmailVerified() {
+			return nil, ErrIdentityEmailTaken
+		}
+	case ErrNotFound:
+		user, err = is.createUser(ext)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if err := is.Link(user, ext); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// createUser creates a user for an identity. Users need a
+// password, so they are given a random one that they can
+// replace by resetting it if they ever want to log in
+// without the provider.
+func (is *identityService) createUser(ext ExternalIdentity) (*User, error) {
+	password, err := rand.String(32)
+	if err != nil {
+		return nil, err
+	}
+	user := User{
+		Name:     ext.Name,
+		Email:    ext.Email,
+		Password: password,
+	}
+	if ext.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if user.Name == "" {
+		user.Name = strings.SplitN(ext.Email, "@", 2)[0]
+	}
+	if err := is.us.Create(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (is *identityService) Link(user *User, ext ExternalIdentity) error {
+	identity, err := is.ByProviderSubject(ext.Provider, ext.Subject)
+	switch err {
+	case nil:
+		if identity.UserID != user.ID {
+			return ErrIdentityTaken
+		}
+		return nil
+	case ErrNotFound:
+	default:
+		return err
+	}
+	return is.Create(&Identity{
+		UserID:   user.ID,
+		Provider: ext.Provider,
+		Subject:  ext.Subject,
+		Email:    ext.Email,
+	})
+}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+func (iv *identityValidator) Create(identity *Identity) error {
+	err := runIdentityValFns(identity,
+		iv.userIDRequired,
+		iv.providerRequired,
+		iv.subjectRequired)
+	if err != nil {
+		return err
+	}
+	return iv.IdentityDB.Create(identity)
+}
+
+func (iv *identityValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.IdentityDB.Delete(id)
+}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) ByProviderSubject(provider, subject string) (*Identity, error) {
+	var identity Identity
+	db := ig.db.Where("provider = ? AND subject = ?", provider, subject)
+	if err := first(db, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	db := ig.db.Where("user_id = ?", userID).Order("provider")
+	if err := db.Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return ig.db.Create(identity).Error
+}
+
+func (ig *identityGorm) Delete(id uint) error {
+	identity := Identity{ID: id}
+	return ig.db.Delete(&identity).Error
+}
+
+type identityValFn func(*Identity) error
+
+func runIdentityValFns(identity *Identity, fns ...identityValFn) error {
+	for _, fn := range fns {
+		if err := fn(identity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iv *identityValidator) userIDRequired(identity *Identity) error {
+	if identity.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) providerRequired(identity *Identity) error {
+	if identity.Provider == "" {
+		return ErrProviderRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) subjectRequired(identity *Identity) error {
+	if identity.Subject == "" {
+		return ErrSubjectRequired
+	}
+	return nil
+}
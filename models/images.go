@@ -11,9 +11,15 @@ import (
 // Image is used to represent images stored in a Gallery.
 // Image is NOT stored in the database, and instead
 // references data stored on disk.
+//
+// Access is added to the image's path as its query, so that
+// the image can be viewed by people who aren't signed in as
+// the gallery's owner, eg with the key to an unlisted gallery
+// or with a share link.
 type Image struct {
 	GalleryID uint
 	Filename  string
+	Access    url.Values
 }
 
 // Path is used to build the absolute path used to reference this image
@@ -22,6 +28,21 @@ func (i *Image) Path() string {
 	temp := url.URL{
 		Path: "/" + i.RelativePath(),
 	}
+	temp.RawQuery = i.Access.Encode()
+	return temp.String()
+}
+
+// DownloadPath is like Path, but asks for the image to be
+// downloaded rather than shown.
+func (i *Image) DownloadPath() string {
+	query := url.Values{"download": {"1"}}
+	for k, v := range i.Access {
+		query[k] = v
+	}
+	temp := url.URL{
+		Path:     "/" + i.RelativePath(),
+		RawQuery: query.Encode(),
+	}
 	return temp.String()
 }
 
@@ -37,6 +58,16 @@ type ImageService interface {
 	Create(galleryID uint, r io.Reader, filename string) error
 	ByGalleryID(galleryID uint) ([]Image, error)
 	Delete(i *Image) error
+
+	// DeleteAll deletes every image in the gallery, along with
+	// the directory they are stored in.
+	DeleteAll(galleryID uint) error
+
+	// CreateAvatar stores the image as the user's avatar, in
+	// each of AvatarSizes. It returns ErrAvatarType or
+	// ErrAvatarTooLarge if the image can't be used.
+	CreateAvatar(userID uint, r io.Reader) error
+	DeleteAvatar(userID uint) error
 }
 
 func NewImageService() ImageService {
@@ -68,6 +99,10 @@ func (is *imageService) Delete(i *Image) error {
 	return os.Remove(i.RelativePath())
 }
 
+func (is *imageService) DeleteAll(galleryID uint) error {
+	return os.RemoveAll(is.imagePath(galleryID))
+}
+
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
 	path := is.imagePath(galleryID)
 	strings, err := filepath.Glob(filepath.Join(path, "*"))
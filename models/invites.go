@@ -0,0 +1,222 @@
+package models
+
+import (
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrInviteInvalid is returned when an invite code doesn't exist, has expired, or has been used up.
+	ErrInviteInvalid modelError = "models: that invite code is not valid, or has already been used up"
+
+	// ErrInviteUsesInvalid is returned when an invite is created with a negative number of uses.
+	ErrInviteUsesInvalid modelError = "models: the number of times an invite can be used must not be negative"
+)
+
+// inviteCodeBytes is how much randomness goes into an invite
+// code, which works out to 16 base32 characters.
+const inviteCodeBytes = 10
+
+var inviteCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Invite lets people sign up while sign ups are invite only.
+// UserID is the user who created it. An invite can be used
+// MaxUses times, or any number of times if MaxUses is 0.
+//
+// Unlike our other tokens, invite codes are stored as they
+// are. They are meant to be passed around, so users need to
+// be able to see them again, and all one gets anybody is a
+// new account.
+type Invite struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Code      string `gorm:"not null;unique_index"`
+	MaxUses   int    `gorm:"not null"`
+	Uses      int    `gorm:"not null;default:0"`
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+// Expired returns true if the invite can no longer be used
+// because it is too old. Invites without an expiry last
+// until they are used up or deleted.
+func (i *Invite) Expired() bool {
+	return i.ExpiresAt != nil && time.Now().After(*i.ExpiresAt)
+}
+
+// UsedUp returns true if the invite has been used as many
+// times as it can be.
+func (i *Invite) UsedUp() bool {
+	return i.MaxUses > 0 && i.Uses >= i.MaxUses
+}
+
+// InviteDB is used to interact with the invites table.
+type InviteDB interface {
+	ByUserID(userID uint) ([]Invite, error)
+
+	// Create generates the invite's code.
+	Create(invite *Invite) error
+	Delete(id uint) error
+
+	// Claim uses up one use of the invite with the given code,
+	// and returns ErrInviteInvalid if it can't be used. Claims
+	// are atomic, so an invite can't be used more than MaxUses
+	// times no matter how many people use it at once.
+	Claim(code string) (*Invite, error)
+
+	// Release gives back a use claimed by Claim, eg because
+	// the user couldn't be created after all.
+	Release(id uint) error
+}
+
+// InviteService is used to create and look up invites. They
+// are claimed by the UserService when users sign up.
+type InviteService interface {
+	InviteDB
+}
+
+func NewInviteService(db *gorm.DB) InviteService {
+	return &inviteService{
+		InviteDB: newInviteValidator(&inviteGorm{db}),
+	}
+}
+
+type inviteService struct {
+	InviteDB
+}
+
+func newInviteValidator(idb InviteDB) *inviteValidator {
+	return &inviteValidator{idb}
+}
+
+type inviteValidator struct {
+	InviteDB
+}
+
+func (iv *inviteValidator) Create(invite *Invite) error {
+	err := runInviteValFns(invite,
+		iv.userIDRequired,
+		iv.usesValid,
+		iv.setCode)
+	if err != nil {
+		return err
+	}
+	return iv.InviteDB.Create(invite)
+}
+
+func (iv *inviteValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.InviteDB.Delete(id)
+}
+
+// Claim normalizes the code before passing it on, so people
+// can type it in a different case or copy it with spaces.
+func (iv *inviteValidator) Claim(code string) (*Invite, error) {
+	invite := Invite{Code: code}
+	if err := runInviteValFns(&invite, iv.normalizeCode); err != nil {
+		return nil, err
+	}
+	if invite.Code == "" {
+		return nil, ErrInviteInvalid
+	}
+	return iv.InviteDB.Claim(invite.Code)
+}
+
+type inviteGorm struct {
+	db *gorm.DB
+}
+
+func (ig *inviteGorm) ByUserID(userID uint) ([]Invite, error) {
+	var invites []Invite
+	db := ig.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := db.Find(&invites).Error; err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (ig *inviteGorm) Create(invite *Invite) error {
+	return ig.db.Create(invite).Error
+}
+
+func (ig *inviteGorm) Delete(id uint) error {
+	invite := Invite{ID: id}
+	return ig.db.Delete(&invite).Error
+}
+
+// Claim checks that the invite is usable in the same query
+// that uses it, so two people can't both take its last use.
+func (ig *inviteGorm) Claim(code string) (*Invite, error) {
+	db := ig.db.Model(&Invite{}).
+		Where("code = ?", code).
+		Where("max_uses = 0 OR uses < max_uses").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return nil, ErrInviteInvalid
+	}
+	var invite Invite
+	if err := first(ig.db.Where("code = ?", code), &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (ig *inviteGorm) Release(id uint) error {
+	return ig.db.Model(&Invite{ID: id}).
+		Where("uses > 0").
+		UpdateColumn("uses", gorm.Expr("uses - 1")).Error
+}
+
+type inviteValFn func(*Invite) error
+
+func runInviteValFns(invite *Invite, fns ...inviteValFn) error {
+	for _, fn := range fns {
+		if err := fn(invite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iv *inviteValidator) userIDRequired(invite *Invite) error {
+	if invite.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *inviteValidator) usesValid(invite *Invite) error {
+	if invite.MaxUses < 0 {
+		return ErrInviteUsesInvalid
+	}
+	return nil
+}
+
+// setCode always generates a new code, as codes are never
+// chosen by the user.
+func (iv *inviteValidator) setCode(invite *Invite) error {
+	b, err := rand.Bytes(inviteCodeBytes)
+	if err != nil {
+		return err
+	}
+	invite.Code = strings.ToLower(inviteCodeEncoding.EncodeToString(b))
+	return nil
+}
+
+func (iv *inviteValidator) normalizeCode(invite *Invite) error {
+	code := strings.ToLower(invite.Code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	invite.Code = code
+	return nil
+}
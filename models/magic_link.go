@@ -0,0 +1,164 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// magicLinkDuration is how long a sign in link is valid for
+// after it has been created. Unlike a password reset, the
+// link signs the user in directly, so it doesn't last long.
+const magicLinkDuration = 10 * time.Minute
+
+// magicLink is used to store the tokens in our passwordless
+// sign in links. As with our other tokens we only store the
+// HMAC hash of the token. We also store the email address the
+// link was sent to, so that a link sent before the user
+// changed their email address can't be used.
+type magicLink struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null"`
+	Email      string `gorm:"not null"`
+	RememberMe bool   `gorm:"not null;default:false"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	CreatedAt  time.Time
+}
+
+// Expired returns true if the link is too old to be used.
+func (ml *magicLink) Expired() bool {
+	return time.Now().Sub(ml.CreatedAt) > magicLinkDuration
+}
+
+type magicLinkDB interface {
+	ByToken(token string) (*magicLink, error)
+	Create(ml *magicLink) error
+
+	// Delete returns ErrNotFound if the link has already been
+	// deleted, which is how we make sure that two requests
+	// racing to use the same link can't both succeed.
+	Delete(id uint) error
+}
+
+func newMagicLinkValidator(db magicLinkDB, hmac hash.HMAC) *magicLinkValidator {
+	return &magicLinkValidator{
+		magicLinkDB: db,
+		hmac:        hmac,
+	}
+}
+
+type magicLinkValidator struct {
+	magicLinkDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the provided token with each of our
+// HMAC keys and pass the hashes on to the database layer
+// until a link is found.
+func (mlv *magicLinkValidator) ByToken(token string) (*magicLink, error) {
+	var ml *magicLink
+	err := byHashes(mlv.hmac.HashAll(token), func(tokenHash string) error {
+		var err error
+		ml, err = mlv.magicLinkDB.ByToken(tokenHash)
+		return err
+	})
+	return ml, err
+}
+
+// Create will generate a token if one isn't provided and
+// then hash it before it is stored.
+func (mlv *magicLinkValidator) Create(ml *magicLink) error {
+	err := runMagicLinkValFns(ml,
+		mlv.requireUserID,
+		mlv.requireEmail,
+		mlv.setTokenIfUnset,
+		mlv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return mlv.magicLinkDB.Create(ml)
+}
+
+func (mlv *magicLinkValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mlv.magicLinkDB.Delete(id)
+}
+
+type magicLinkGorm struct {
+	db *gorm.DB
+}
+
+func (mlg *magicLinkGorm) ByToken(tokenHash string) (*magicLink, error) {
+	var ml magicLink
+	err := first(mlg.db.Where("token_hash = ?", tokenHash), &ml)
+	if err != nil {
+		return nil, err
+	}
+	return &ml, nil
+}
+
+func (mlg *magicLinkGorm) Create(ml *magicLink) error {
+	return mlg.db.Create(ml).Error
+}
+
+func (mlg *magicLinkGorm) Delete(id uint) error {
+	ml := magicLink{ID: id}
+	db := mlg.db.Delete(&ml)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type magicLinkValFn func(*magicLink) error
+
+func runMagicLinkValFns(ml *magicLink, fns ...magicLinkValFn) error {
+	for _, fn := range fns {
+		if err := fn(ml); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mlv *magicLinkValidator) requireUserID(ml *magicLink) error {
+	if ml.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (mlv *magicLinkValidator) requireEmail(ml *magicLink) error {
+	if ml.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (mlv *magicLinkValidator) setTokenIfUnset(ml *magicLink) error {
+	if ml.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ml.Token = token
+	return nil
+}
+
+func (mlv *magicLinkValidator) hmacToken(ml *magicLink) error {
+	if ml.Token == "" {
+		return nil
+	}
+	ml.TokenHash = mlv.hmac.Hash(ml.Token)
+	return nil
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// AccountDeletionGracePeriod is how long we wait after a user
+// asks us to delete their account before we actually do it.
+// Until then they can sign in and cancel the deletion.
+const AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+// userOwned returns every model that belongs to a user via a
+// user_id column. Anything added to tables() that belongs to
+// a user needs to be added here as well, otherwise purging a
+// user would leave it behind.
+func userOwned() []interface{} {
+	return []interface{}{
+		&Gallery{},
+		&Session{},
+		&pwReset{},
+		&emailVerification{},
+		&recoveryCode{},
+		&loginChallenge{},
+		&magicLink{},
+		&Identity{},
+		&Export{},
+		&APIToken{},
+		&Invite{},
+		&Collaborator{},
+	}
+}
+
+// PurgeDeletedUsers permanently deletes every user whose
+// deletion grace period is over, along with their galleries,
+// images, sessions, and anything else that belongs to them.
+// It is safe to run as often as we like. It needs the Audit
+// service, as every purge is recorded.
+func (s *Services) PurgeDeletedUsers() error {
+	users, err := s.User.ByDeletionRequestedBefore(time.Now().Add(-AccountDeletionGracePeriod))
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := s.purgeUser(user.ID); err != nil {
+			return err
+		}
+		log.Printf("models: purged user %d", user.ID)
+		s.Audit.Record(AuditEvent{
+			Action:     AuditAccountPurged,
+			TargetType: AuditTargetUser,
+			TargetID:   user.ID,
+		})
+	}
+	return nil
+}
+
+// purgeUser deletes the user and everything they own from
+// the database in a single transaction, and then deletes
+// their images, avatar, and exports. We skip gorm's soft
+// deletes, as the whole point is that nothing is left behind.
+// Files are only removed once the transaction has been
+// committed, as we can't get them back if it fails.
+func (s *Services) purgeUser(userID uint) error {
+	var galleryIDs []uint
+	// Unscoped includes galleries that were already soft
+	// deleted, whose images are still on disk.
+	err := s.db.Unscoped().Model(&Gallery{}).
+		Where("user_id = ?", userID).Pluck("id", &galleryIDs).Error
+	if err != nil {
+		return err
+	}
+	var exportIDs []uint
+	err = s.db.Model(&Export{}).
+		Where("user_id = ?", userID).Pluck("id", &exportIDs).Error
+	if err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, model := range userOwned() {
+		err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Share links and collaborators belong to galleries
+	// rather than users.
+	if len(galleryIDs) > 0 {
+		for _, model := range []interface{}{&ShareLink{}, &Collaborator{}} {
+			err := tx.Where("gallery_id IN (?)", galleryIDs).Delete(model).Error
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := tx.Unscoped().Delete(&User{}, userID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	for _, id := range galleryIDs {
+		if err := s.Image.DeleteAll(id); err != nil {
+			// The user is already gone, so the best we can do
+			// is log it so the files can be cleaned up by hand.
+			log.Printf("models: deleting images for gallery %d of purged user %d: %v", id, userID, err)
+		}
+	}
+	if err := s.Image.DeleteAvatar(userID); err != nil {
+		log.Printf("models: deleting avatar of purged user %d: %v", userID, err)
+	}
+	for _, id := range exportIDs {
+		err := os.Remove(exportPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("models: deleting export %d of purged user %d: %v", id, userID, err)
+		}
+	}
+	return nil
+}
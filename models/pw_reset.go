@@ -0,0 +1,151 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// pwResetDuration is how long a password reset token is
+// valid for after it has been created.
+const pwResetDuration = time.Hour
+
+// pwReset is used to store password reset tokens. Like our
+// remember tokens, we only ever store the HMAC hash of the
+// token so a leaked database can't be used to reset passwords.
+type pwReset struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+}
+
+// Expired returns true if the reset token is too old to be used.
+func (pwr *pwReset) Expired() bool {
+	return time.Now().Sub(pwr.CreatedAt) > pwResetDuration
+}
+
+type pwResetDB interface {
+	ByToken(token string) (*pwReset, error)
+	Create(pwr *pwReset) error
+	Delete(id uint) error
+}
+
+func newPwResetValidator(db pwResetDB, hmac hash.HMAC) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		hmac:      hmac,
+	}
+}
+
+type pwResetValidator struct {
+	pwResetDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the provided token with each of our
+// HMAC keys and pass the hashes on to the database layer
+// until a reset is found, so that tokens created before a
+// key was rotated still work.
+func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
+	var pwr *pwReset
+	err := byHashes(pwrv.hmac.HashAll(token), func(tokenHash string) error {
+		var err error
+		pwr, err = pwrv.pwResetDB.ByToken(tokenHash)
+		return err
+	})
+	return pwr, err
+}
+
+// Create will generate a token if one isn't provided and
+// then hash it before it is stored.
+func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
+	err := runPwResetValFns(pwr,
+		pwrv.requireUserID,
+		pwrv.setTokenIfUnset,
+		pwrv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pwrv.pwResetDB.Delete(id)
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
+	var pwr pwReset
+	err := first(pwrg.db.Where("token_hash = ?", tokenHash), &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// Delete returns ErrNotFound if the reset has already been
+// deleted, which lets CompleteReset claim a token without
+// racing anyone else using it.
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	pwr := pwReset{ID: id}
+	db := pwrg.db.Delete(&pwr)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pwResetValFn func(*pwReset) error
+
+func runPwResetValFns(pwr *pwReset, fns ...pwResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) requireUserID(pwr *pwReset) error {
+	if pwr.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *pwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
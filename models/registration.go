@@ -0,0 +1,81 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ErrInviteRequired is returned when somebody tries to sign up without an invite code while sign ups are invite only.
+	ErrInviteRequired modelError = "models: an invite code is required to sign up"
+
+	// ErrEmailDomainNotAllowed is returned when somebody tries to sign up with an email address at a domain that isn't allowed to.
+	ErrEmailDomainNotAllowed modelError = "models: sign ups are not open to email addresses at that domain"
+)
+
+// RegistrationMode decides who is allowed to sign up.
+type RegistrationMode string
+
+const (
+	// RegistrationOpen lets anyone sign up.
+	RegistrationOpen RegistrationMode = "open"
+
+	// RegistrationInvite only lets people with an invite code
+	// sign up.
+	RegistrationInvite RegistrationMode = "invite"
+
+	// RegistrationDomains only lets people with an email
+	// address at one of the allowed domains sign up.
+	RegistrationDomains RegistrationMode = "domains"
+)
+
+// RegistrationPolicy decides who is allowed to sign up. It
+// is enforced when users are created, so it applies to
+// signing up with a password and with a provider alike.
+type RegistrationPolicy struct {
+	Mode           RegistrationMode
+	AllowedDomains []string
+}
+
+// Validate returns an error if the policy can't be enforced,
+// eg because it is limited to domains without listing any.
+// An empty mode is the same as RegistrationOpen.
+func (p RegistrationPolicy) Validate() error {
+	switch p.Mode {
+	case "", RegistrationOpen, RegistrationInvite:
+		return nil
+	case RegistrationDomains:
+		if len(p.AllowedDomains) == 0 {
+			return fmt.Errorf("registration: mode %q needs at least one allowed domain", p.Mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("registration: unknown mode %q", p.Mode)
+	}
+}
+
+// InviteRequired returns true if people need an invite code
+// to sign up.
+func (p RegistrationPolicy) InviteRequired() bool {
+	return p.Mode == RegistrationInvite
+}
+
+// EmailAllowed returns true if the policy lets people sign up
+// with the email address, which is expected to have already
+// been normalized.
+func (p RegistrationPolicy) EmailAllowed(email string) bool {
+	if p.Mode != RegistrationDomains {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, allowed := range p.AllowedDomains {
+		if strings.EqualFold(domain, strings.TrimSpace(allowed)) {
+			return true
+		}
+	}
+	return false
+}
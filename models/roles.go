@@ -0,0 +1,59 @@
+package models
+
+import "strings"
+
+// ErrRoleInvalid is returned when a user is given a role that doesn't exist.
+const ErrRoleInvalid modelError = "models: role is not valid"
+
+// Role decides what a user is allowed to do beyond managing
+// their own account and galleries. Each role can do
+// everything the roles below it can.
+type Role string
+
+const (
+	// RoleUser is the role everyone starts out with.
+	RoleUser Role = "user"
+
+	// RoleModerator can look up and suspend users, and can
+	// take down any gallery.
+	RoleModerator Role = "moderator"
+
+	// RoleAdmin can do anything, including changing roles
+	// and signing in as other users.
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every role, from least to most powerful.
+var Roles = []Role{RoleUser, RoleModerator, RoleAdmin}
+
+// rank returns where the role sits in Roles, or -1 if it
+// isn't a role at all.
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// Valid returns true if r is one of Roles.
+func (r Role) Valid() bool {
+	return r.rank() >= 0
+}
+
+// Outranks returns true if r is more powerful than other.
+func (r Role) Outranks(other Role) bool {
+	return r.rank() > other.rank()
+}
+
+// Title is the role's name as we show it to people.
+func (r Role) Title() string {
+	return strings.Title(string(r))
+}
+
+// HasRole returns true if the user has the given role, or a
+// more powerful one.
+func (u *User) HasRole(role Role) bool {
+	return u.Role.rank() >= role.rank() && role.Valid()
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"lenslocked.com/hash"
 )
 
 type ServicesConfig func(*Services) error
@@ -25,16 +26,88 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+// WithUser accepts key sets for both the pepper and the HMAC
+// key so that either can be rotated without invalidating
+// existing passwords or tokens.
+func WithUser(peppers, hmacKeys hash.KeySet, passwords *hash.Passwords, registration RegistrationPolicy) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.User = NewUserService(s.db, peppers, hmacKeys, passwords, registration)
 		return nil
 	}
 }
 
-func WithGallery() ServicesConfig {
+func WithSession(hmacKeys hash.KeySet, lifetime SessionLifetime) ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Session = NewSessionService(s.db, hmacKeys, lifetime)
+		return nil
+	}
+}
+
+// WithTwoFactor needs to run after WithUser, as the two
+// factor service stores TOTP secrets on users.
+func WithTwoFactor(hmacKeys hash.KeySet) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, hmacKeys)
+		return nil
+	}
+}
+
+// WithIdentity needs to run after WithUser, as identities
+// are used to look up and create users.
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		s.Identity = NewIdentityService(s.db, s.User)
+		return nil
+	}
+}
+
+// WithExport needs to run after every other service that
+// holds user data, as exports gather it from all of them.
+func WithExport() ServicesConfig {
+	return func(s *Services) error {
+		s.Export = NewExportService(s.db, s.User, s.Gallery, s.Image, s.Session, s.Identity)
+		return nil
+	}
+}
+
+func WithAPIToken(hmacKeys hash.KeySet) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKeys)
+		return nil
+	}
+}
+
+func WithInvite() ServicesConfig {
+	return func(s *Services) error {
+		s.Invite = NewInviteService(s.db)
+		return nil
+	}
+}
+
+func WithShareLink() ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db)
+		return nil
+	}
+}
+
+func WithCollaborator() ServicesConfig {
+	return func(s *Services) error {
+		s.Collaborator = NewCollaboratorService(s.db)
+		return nil
+	}
+}
+
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+func WithGallery(hmacKeys hash.KeySet) ServicesConfig {
+	return func(s *Services) error {
+		s.Gallery = NewGalleryService(s.db, hmacKeys)
 		return nil
 	}
 }
@@ -62,10 +135,19 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 }
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery      GalleryService
+	User         UserService
+	Session      SessionService
+	TwoFactor    TwoFactorService
+	Identity     IdentityService
+	Export       ExportService
+	APIToken     APITokenService
+	Audit        AuditService
+	Invite       InviteService
+	ShareLink    ShareLinkService
+	Collaborator CollaboratorService
+	Image        ImageService
+	db           *gorm.DB
 }
 
 // Closes the database connection
@@ -73,14 +155,59 @@ func (s *Services) Close() error {
 	return s.db.Close()
 }
 
+// tables returns every model that is stored in its own
+// table, so AutoMigrate and DestructiveReset can't drift apart.
+func tables() []interface{} {
+	return []interface{}{
+		&User{},
+		&Gallery{},
+		&Session{},
+		&pwReset{},
+		&emailVerification{},
+		&recoveryCode{},
+		&loginChallenge{},
+		&magicLink{},
+		&Identity{},
+		&Export{},
+		&APIToken{},
+		&AuditEvent{},
+		&Invite{},
+		&ShareLink{},
+		&Collaborator{},
+	}
+}
+
 // AutoMigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	// Users who signed up before we verified email addresses
+	// are only backfilled the first time, when the column is
+	// added, so that new users still need to verify theirs.
+	backfillVerified := s.db.HasTable(&User{}) &&
+		!s.db.Dialect().HasColumn("users", "email_verified_at")
+	err := s.db.AutoMigrate(tables()...).Error
+	if err != nil {
+		return err
+	}
+	if backfillVerified {
+		if err := s.backfillEmailVerified(); err != nil {
+			return err
+		}
+	}
+	// Remember tokens used to live on the users table before
+	// we had sessions. AutoMigrate never drops columns, so we
+	// need to do it ourselves or creating users will fail.
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		err := s.db.Model(&User{}).DropColumn("remember_hash").Error
+		if err != nil {
+			return err
+		}
+	}
+	return s.backfillUsernames()
 }
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(tables()...).Error
 	if err != nil {
 		return err
 	}
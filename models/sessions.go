@@ -0,0 +1,357 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// sessionTouchInterval limits how often we write a new
+	// LastSeenAt time for a session, so that we aren't
+	// updating the sessions table on every single request.
+	sessionTouchInterval = time.Minute
+)
+
+// SessionLifetime decides how long sessions last.
+//
+// A session expires once it hasn't been used for its idle
+// timeout, or once it reaches MaxAge no matter how recently it
+// was used. Persistent sessions, where the user asked us to
+// remember them, use RememberIdle as their idle timeout.
+type SessionLifetime struct {
+	Idle         time.Duration
+	RememberIdle time.Duration
+	MaxAge       time.Duration
+}
+
+// DefaultSessionLifetime returns the lifetime we use when one
+// isn't configured.
+func DefaultSessionLifetime() SessionLifetime {
+	return SessionLifetime{
+		Idle:         30 * time.Minute,
+		RememberIdle: 14 * 24 * time.Hour,
+		MaxAge:       30 * 24 * time.Hour,
+	}
+}
+
+// idleTimeout returns the idle timeout for the session.
+func (sl SessionLifetime) idleTimeout(session *Session) time.Duration {
+	if session.Persistent {
+		return sl.RememberIdle
+	}
+	return sl.Idle
+}
+
+// Session represents a single signed in browser or device.
+// A user has one session for every place they are signed
+// in, so signing out in one place leaves the others alone.
+//
+// ExpiresAt is the absolute end of the session, while
+// IdleExpiresAt is pushed back every time it is used.
+type Session struct {
+	ID            uint   `gorm:"primary_key"`
+	UserID        uint   `gorm:"not null;index"`
+	Remember      string `gorm:"-"`
+	RememberHash  string `gorm:"not null;unique_index"`
+	Persistent    bool   `gorm:"not null;default:false"`
+	UserAgent     string
+	IP            string
+	CreatedAt     time.Time
+	LastSeenAt    time.Time
+	IdleExpiresAt time.Time
+	ExpiresAt     time.Time `gorm:"not null"`
+
+	// ImpersonatorID is the ID of the admin who is signed in
+	// as the user with this session, if there is one.
+	ImpersonatorID uint
+}
+
+// Impersonated returns true if the session belongs to an
+// admin who is signed in as someone else.
+func (s *Session) Impersonated() bool {
+	return s.ImpersonatorID != 0
+}
+
+// Expired returns true if the session can no longer be used.
+// Sessions created before we had idle timeouts don't have an
+// IdleExpiresAt, so they are treated as expired.
+func (s *Session) Expired() bool {
+	now := time.Now()
+	return now.After(s.ExpiresAt) || now.After(s.IdleExpiresAt)
+}
+
+// renew pushes back the idle expiry of the session, without
+// going past its absolute expiry.
+func (s *Session) renew(now time.Time, idle time.Duration) {
+	s.IdleExpiresAt = now.Add(idle)
+	if s.IdleExpiresAt.After(s.ExpiresAt) {
+		s.IdleExpiresAt = s.ExpiresAt
+	}
+}
+
+// SessionDB is used to interact with the sessions database.
+//
+// Like UserDB, single session queries return ErrNotFound if
+// the session can't be found.
+type SessionDB interface {
+	ByRemember(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+
+	// DeleteByUserID deletes all of a user's sessions except
+	// for those with an ID in except.
+	DeleteByUserID(userID uint, except ...uint) error
+}
+
+// SessionService is a set of methods used to manipulate and
+// work with the session model
+type SessionService interface {
+	// Touch records that the session was just used and pushes
+	// back its idle expiry. To save on writes this only
+	// happens once every so often, and renewed reports
+	// whether it did.
+	Touch(session *Session) (renewed bool, err error)
+	SessionDB
+}
+
+func NewSessionService(db *gorm.DB, hmacKeys hash.KeySet, lifetime SessionLifetime) SessionService {
+	hmac := hash.NewHMAC(hmacKeys)
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hmac,
+			lifetime:  lifetime,
+		},
+		lifetime: lifetime,
+	}
+}
+
+type sessionService struct {
+	SessionDB
+	lifetime SessionLifetime
+}
+
+// ByRemember looks up a session using the remember token
+// stored in the user's cookie. Expired sessions are deleted
+// and reported as ErrNotFound.
+func (ss *sessionService) ByRemember(token string) (*Session, error) {
+	session, err := ss.SessionDB.ByRemember(token)
+	if err != nil {
+		return nil, err
+	}
+	if session.Expired() {
+		ss.Delete(session.ID)
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+func (ss *sessionService) Touch(session *Session) (bool, error) {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return false, nil
+	}
+	session.LastSeenAt = now
+	session.renew(now, ss.lifetime.idleTimeout(session))
+	if err := ss.Update(session); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac     hash.HMAC
+	lifetime SessionLifetime
+}
+
+// ByRemember will hash the remember token with each of our
+// HMAC keys and pass the hashes on to the database layer
+// until a session is found. If the session was found using
+// an old key it is rehashed with the active key, so that the
+// old key can eventually be retired.
+func (sv *sessionValidator) ByRemember(token string) (*Session, error) {
+	hashes := sv.hmac.HashAll(token)
+	var session *Session
+	err := byHashes(hashes, func(rememberHash string) error {
+		var err error
+		session, err = sv.SessionDB.ByRemember(rememberHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if session.RememberHash != hashes[0] {
+		session.Remember = token
+		if err := sv.Update(session); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Create will generate a remember token for the session if
+// one isn't provided and store the hash of it, along with
+// defaulting the timestamps.
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(session,
+		sv.userIDRequired,
+		sv.setRememberIfUnset,
+		sv.rememberMinBytes,
+		sv.hmacRemember,
+		sv.rememberHashRequired,
+		sv.setTimesIfUnset)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFns(session,
+		sv.userIDRequired,
+		sv.rememberMinBytes,
+		sv.hmacRemember,
+		sv.rememberHashRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint, except ...uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID, except...)
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByRemember(rememberHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("remember_hash = ?", rememberHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID returns all of a user's sessions, most recently
+// used first.
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	db := sg.db.Where("user_id = ?", userID).Order("last_seen_at desc")
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{ID: id}
+	return sg.db.Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID uint, except ...uint) error {
+	db := sg.db.Where("user_id = ?", userID)
+	if len(except) > 0 {
+		db = db.Where("id NOT IN (?)", except)
+	}
+	return db.Delete(Session{}).Error
+}
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *sessionValidator) userIDRequired(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setRememberIfUnset(session *Session) error {
+	if session.Remember != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Remember = token
+	return nil
+}
+
+func (sv *sessionValidator) rememberMinBytes(session *Session) error {
+	if session.Remember == "" {
+		return nil
+	}
+	n, err := rand.NBytes(session.Remember)
+	if err != nil {
+		return err
+	}
+	if n < 32 {
+		return ErrRememberTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacRemember(session *Session) error {
+	if session.Remember == "" {
+		return nil
+	}
+	session.RememberHash = sv.hmac.Hash(session.Remember)
+	return nil
+}
+
+func (sv *sessionValidator) rememberHashRequired(session *Session) error {
+	if session.RememberHash == "" {
+		return ErrRememberRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTimesIfUnset(session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(sv.lifetime.MaxAge)
+	}
+	if session.IdleExpiresAt.IsZero() {
+		session.renew(now, sv.lifetime.idleTimeout(session))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"lenslocked.com/hash"
+)
+
+// memSessionDB is an in-memory SessionDB so that we can test
+// the session validator without a database. It is safe for
+// concurrent use and hands out copies, just like the real
+// database would.
+type memSessionDB struct {
+	mu       sync.Mutex
+	nextID   uint
+	sessions map[uint]Session
+}
+
+func newMemSessionDB() *memSessionDB {
+	return &memSessionDB{sessions: make(map[uint]Session)}
+}
+
+func (db *memSessionDB) ByRemember(rememberHash string) (*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, s := range db.sessions {
+		if s.RememberHash == rememberHash {
+			return &s, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memSessionDB) ByUserID(userID uint) ([]Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var ret []Session
+	for _, s := range db.sessions {
+		if s.UserID == userID {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+func (db *memSessionDB) Create(session *Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.nextID++
+	session.ID = db.nextID
+	db.sessions[session.ID] = *session
+	return nil
+}
+
+func (db *memSessionDB) Update(session *Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.sessions[session.ID] = *session
+	return nil
+}
+
+func (db *memSessionDB) Delete(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.sessions, id)
+	return nil
+}
+
+func (db *memSessionDB) DeleteByUserID(userID uint, except ...uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+next:
+	for id, s := range db.sessions {
+		for _, e := range except {
+			if id == e {
+				continue next
+			}
+		}
+		if s.UserID == userID {
+			delete(db.sessions, id)
+		}
+	}
+	return nil
+}
+
+func createSessions(t *testing.T, sv *sessionValidator, n int) []Session {
+	t.Helper()
+	sessions := make([]Session, n)
+	for i := range sessions {
+		sessions[i].UserID = uint(i + 1)
+		if err := sv.Create(&sessions[i]); err != nil {
+			t.Fatalf("Create() err = %v", err)
+		}
+	}
+	return sessions
+}
+
+// hammerByRemember looks up every session from many
+// goroutines at once and checks that each lookup finds the
+// right session. Run with -race to catch shared state in
+// the validator or the hash package.
+func hammerByRemember(t *testing.T, sv *sessionValidator, sessions []Session) {
+	t.Helper()
+	const goroutines, rounds = 32, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := range sessions {
+					want := sessions[(i+g)%len(sessions)]
+					got, err := sv.ByRemember(want.Remember)
+					if err != nil {
+						errs <- fmt.Errorf("ByRemember() err = %v", err)
+						return
+					}
+					if got.ID != want.ID {
+						errs <- fmt.Errorf("ByRemember() found session %d; want %d", got.ID, want.ID)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSessionByRememberConcurrent(t *testing.T) {
+	sv := &sessionValidator{
+		SessionDB: newMemSessionDB(),
+		hmac:      hash.NewHMAC(hash.SingleKey("secret-hmac-key")),
+	}
+	sessions := createSessions(t, sv, 10)
+	hammerByRemember(t, sv, sessions)
+}
+
+// TestSessionByRememberRotatedConcurrent covers sessions that
+// were created with an old HMAC key, which get rehashed with
+// the active key the first time they are looked up.
+func TestSessionByRememberRotatedConcurrent(t *testing.T) {
+	db := newMemSessionDB()
+	old := &sessionValidator{
+		SessionDB: db,
+		hmac:      hash.NewHMAC(hash.SingleKey("old-hmac-key")),
+	}
+	sessions := createSessions(t, old, 10)
+
+	keys := hash.KeySet{
+		Active: "new",
+		Keys: map[string]string{
+			hash.DefaultKeyID: "old-hmac-key",
+			"new":             "new-hmac-key",
+		},
+	}
+	sv := &sessionValidator{
+		SessionDB: db,
+		hmac:      hash.NewHMAC(keys),
+	}
+	hammerByRemember(t, sv, sessions)
+
+	active := hash.NewHMAC(hash.SingleKey("new-hmac-key"))
+	for _, s := range sessions {
+		got, err := db.ByRemember(active.Hash(s.Remember))
+		if err != nil {
+			t.Errorf("session %d wasn't rehashed with the active key: %v", s.ID, err)
+			continue
+		}
+		if got.ID != s.ID {
+			t.Errorf("found session %d; want %d", got.ID, s.ID)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrShareLinkInvalid is returned when a share link doesn't exist, has expired, has been revoked, or has been viewed as many times as it can be.
+	ErrShareLinkInvalid modelError = "models: that link is not valid anymore. Please ask the photographer for a new one"
+
+	// ErrGalleryIDRequired is returned when a share link is created without a gallery.
+	ErrGalleryIDRequired modelError = "models: gallery ID is required"
+
+	// ErrShareExpiryInvalid is returned when a share link is created without an expiry in the future.
+	ErrShareExpiryInvalid modelError = "models: share links must expire in the future"
+
+	// ErrMaxViewsInvalid is returned when a share link is created with a negative number of views.
+	ErrMaxViewsInvalid modelError = "models: the number of times a link can be viewed must not be negative"
+
+	// ErrPermissionInvalid is returned when a share link is given a permission that doesn't exist.
+	ErrPermissionInvalid modelError = "models: permission is not valid"
+)
+
+const (
+	// ShareLinkLifetime is how long share links last unless
+	// they are given a different expiry.
+	ShareLinkLifetime = 14 * 24 * time.Hour
+
+	// shareLinkImageGrace is how long a link that has used up
+	// its views can still load images after its last view.
+	shareLinkImageGrace = 15 * time.Minute
+
+	shareTokenBytes = 32
+)
+
+// SharePermission is what a share link lets people do with a
+// gallery.
+type SharePermission string
+
+const (
+	// ShareView lets people look at the gallery's images.
+	ShareView SharePermission = "view"
+
+	// ShareDownload lets people download the images as well.
+	ShareDownload SharePermission = "download"
+)
+
+// SharePermissions lists every permission a share link can
+// have.
+var SharePermissions = []SharePermission{ShareView, ShareDownload}
+
+// Valid returns true if p is one of SharePermissions.
+func (p SharePermission) Valid() bool {
+	for _, permission := range SharePermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Title returns the permission for people to read.
+func (p SharePermission) Title() string {
+	return strings.Title(string(p))
+}
+
+// ShareLink lets anyone with its token see a gallery, no
+// matter its visibility, until it expires or is revoked. If
+// MaxViews isn't 0 the link stops working once the gallery
+// has been viewed with it that many times.
+//
+// Tokens are stored as they are so that the gallery's owner
+// can copy the link again later, just like unlisted keys.
+type ShareLink struct {
+	ID           uint            `gorm:"primary_key"`
+	GalleryID    uint            `gorm:"not null;index"`
+	Token        string          `gorm:"not null;unique_index"`
+	Permission   SharePermission `gorm:"not null;default:'view'"`
+	MaxViews     int             `gorm:"not null;default:0"`
+	Views        int             `gorm:"not null;default:0"`
+	ExpiresAt    time.Time       `gorm:"not null"`
+	RevokedAt    *time.Time
+	LastViewedAt *time.Time
+	CreatedAt    time.Time
+}
+
+// Expired returns true if the link is too old to use.
+func (l *ShareLink) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// Revoked returns true if the gallery's owner has stopped the
+// link from working.
+func (l *ShareLink) Revoked() bool {
+	return l.RevokedAt != nil
+}
+
+// ViewsUsed returns true if the link has been viewed as many
+// times as it can be.
+func (l *ShareLink) ViewsUsed() bool {
+	return l.MaxViews > 0 && l.Views >= l.MaxViews
+}
+
+// Active returns true if the link can still be used to view
+// the gallery. RecordView turns away links that have used up
+// their views.
+func (l *ShareLink) Active() bool {
+	return !l.Expired() && !l.Revoked()
+}
+
+// CanLoadImages returns true if the link can be used to load
+// the gallery's images. Once a link has used up its views
+// that only lasts for shareLinkImageGrace after its last
+// view, so the page that used it can finish loading.
+func (l *ShareLink) CanLoadImages() bool {
+	if !l.Active() {
+		return false
+	}
+	if !l.ViewsUsed() {
+		return true
+	}
+	return l.LastViewedAt != nil && time.Since(*l.LastViewedAt) < shareLinkImageGrace
+}
+
+// CanDownload returns true if the link lets people download
+// the gallery's images.
+func (l *ShareLink) CanDownload() bool {
+	return l.Permission == ShareDownload
+}
+
+// ShareLinkDB is used to interact with the share links table.
+//
+// Like UserDB, single link queries return ErrNotFound if the
+// link can't be found.
+type ShareLinkDB interface {
+	ByToken(token string) (*ShareLink, error)
+
+	// ByGalleryID returns the gallery's links, newest first.
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+
+	// Create generates the link's token.
+	Create(link *ShareLink) error
+	Revoke(id uint) error
+
+	// RecordView counts a view of the gallery with the link,
+	// and returns ErrShareLinkInvalid if the link can't be
+	// used. Views are counted atomically, so a link can't be
+	// viewed more than MaxViews times no matter how many
+	// people use it at once.
+	RecordView(id uint) error
+}
+
+// ShareLinkService is used to create and look up the links
+// that galleries are shared with.
+type ShareLinkService interface {
+	ShareLinkDB
+}
+
+func NewShareLinkService(db *gorm.DB) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+		},
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+}
+
+// ByToken doesn't bother looking up anything that can't be
+// one of our tokens.
+func (slv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return slv.ShareLinkDB.ByToken(token)
+}
+
+func (slv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValFns(link,
+		slv.galleryIDRequired,
+		slv.defaultExpiry,
+		slv.expiryInFuture,
+		slv.maxViewsValid,
+		slv.defaultPermission,
+		slv.permissionValid,
+		slv.setToken)
+	if err != nil {
+		return err
+	}
+	return slv.ShareLinkDB.Create(link)
+}
+
+func (slv *shareLinkValidator) Revoke(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return slv.ShareLinkDB.Revoke(id)
+}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (slg *shareLinkGorm) ByToken(token string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(slg.db.Where("token = ?", token), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (slg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	db := slg.db.Where("gallery_id = ?", galleryID).Order("created_at desc")
+	if err := db.Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (slg *shareLinkGorm) Create(link *ShareLink) error {
+	return slg.db.Create(link).Error
+}
+
+func (slg *shareLinkGorm) Revoke(id uint) error {
+	return slg.db.Model(&ShareLink{ID: id}).
+		Where("revoked_at IS NULL").
+		UpdateColumn("revoked_at", time.Now()).Error
+}
+
+// RecordView checks that the link is usable in the same query
+// that counts the view, so two people can't both take its
+// last view.
+func (slg *shareLinkGorm) RecordView(id uint) error {
+	now := time.Now()
+	db := slg.db.Model(&ShareLink{}).
+		Where("id = ?", id).
+		Where("revoked_at IS NULL AND expires_at > ?", now).
+		Where("max_views = 0 OR views < max_views").
+		UpdateColumns(map[string]interface{}{
+			"views":          gorm.Expr("views + 1"),
+			"last_viewed_at": now,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkInvalid
+	}
+	return nil
+}
+
+type shareLinkValFn func(*ShareLink) error
+
+func runShareLinkValFns(link *ShareLink, fns ...shareLinkValFn) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) defaultExpiry(link *ShareLink) error {
+	if link.ExpiresAt.IsZero() {
+		link.ExpiresAt = time.Now().Add(ShareLinkLifetime)
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) expiryInFuture(link *ShareLink) error {
+	if !link.ExpiresAt.After(time.Now()) {
+		return ErrShareExpiryInvalid
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) maxViewsValid(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return ErrMaxViewsInvalid
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) defaultPermission(link *ShareLink) error {
+	if link.Permission == "" {
+		link.Permission = ShareView
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) permissionValid(link *ShareLink) error {
+	if !link.Permission.Valid() {
+		return ErrPermissionInvalid
+	}
+	return nil
+}
+
+// setToken always generates a new token, as tokens are never
+// chosen by the user.
+func (slv *shareLinkValidator) setToken(link *ShareLink) error {
+	token, err := rand.String(shareTokenBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
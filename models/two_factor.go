@@ -0,0 +1,537 @@
+package models
+
+import (
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+	"lenslocked.com/totp"
+)
+
+const (
+	// ErrCodeInvalid is returned when a two factor authentication code or recovery code is not valid.
+	ErrCodeInvalid modelError = "models: the code provided is not valid"
+
+	// ErrTwoFactorNotStarted is returned when a user tries to enable two factor authentication without a pending secret.
+	ErrTwoFactorNotStarted modelError = "models: two factor authentication setup has not been started"
+
+	// ErrTwoFactorNotEnabled is returned when an action requires two factor authentication but the user hasn't enabled it.
+	ErrTwoFactorNotEnabled modelError = "models: two factor authentication is not enabled"
+)
+
+const (
+	// loginChallengeDuration is how long a user has to enter
+	// their two factor code after entering their password.
+	loginChallengeDuration = 5 * time.Minute
+
+	// loginChallengeMaxAttempts is how many codes can be tried
+	// before the user has to enter their password again.
+	loginChallengeMaxAttempts = 5
+
+	// recoveryCodeCount is how many recovery codes a user is
+	// given each time they generate a new set.
+	recoveryCodeCount = 10
+
+	// recoveryCodeBytes is the amount of randomness in each
+	// recovery code, which works out to 16 base32 characters.
+	recoveryCodeBytes = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorService is used to manage TOTP based two factor
+// authentication for users.
+//
+// Signing in with two factor authentication happens in two
+// steps. Once a user's password has been checked we create a
+// short-lived login challenge instead of a session, and only
+// once the challenge is completed with a valid code is the
+// user actually signed in.
+type TwoFactorService interface {
+	// Initiate gives the user a new TOTP secret that will be
+	// used once they confirm it with Enable. If the user
+	// already has a pending secret it is left alone so that
+	// reloading the setup page doesn't invalidate a secret
+	// they have already scanned.
+	Initiate(user *User) error
+
+	// Enable turns on two factor authentication for the user
+	// if the code matches their pending secret and returns a
+	// fresh set of recovery codes.
+	Enable(user *User, code string) ([]string, error)
+
+	// Disable turns off two factor authentication for the user
+	// and deletes their recovery codes.
+	Disable(user *User) error
+
+	// NewRecoveryCodes replaces all of a user's recovery codes
+	// with a new set and returns them. This is the only time
+	// the codes are available, as we only store their hashes.
+	NewRecoveryCodes(user *User) ([]string, error)
+
+	// RecoveryCodesLeft returns how many unused recovery codes
+	// the user has.
+	RecoveryCodesLeft(user *User) (int, error)
+
+	// CreateChallenge starts the second step of signing in and
+	// returns the token that identifies the pending sign in.
+	// rememberMe is kept with the challenge so that the user
+	// doesn't need to tell us again once they enter a code.
+	CreateChallenge(user *User, rememberMe bool) (string, error)
+
+	// ChallengeUser returns the user the pending sign in
+	// identified by token belongs to, without trying a code.
+	// ErrTokenInvalid is returned if the challenge is unknown
+	// or has expired.
+	ChallengeUser(token string) (*User, error)
+
+	// CompleteChallenge verifies the code for the pending sign
+	// in identified by token, accepting either a TOTP code or
+	// an unused recovery code. ErrCodeInvalid is returned for
+	// a bad code, and ErrTokenInvalid once the challenge has
+	// expired or too many codes have been tried.
+	CompleteChallenge(token, code string) (user *User, rememberMe bool, err error)
+}
+
+// NewTwoFactorService needs the UserService so that it can
+// store TOTP secrets on the users themselves.
+func NewTwoFactorService(db *gorm.DB, us UserService, hmacKeys hash.KeySet) TwoFactorService {
+	hmac := hash.NewHMAC(hmacKeys)
+	return &twoFactorService{
+		us: us,
+		rcDB: &recoveryCodeValidator{
+			recoveryCodeDB: &recoveryCodeGorm{db},
+			hmac:           hmac,
+		},
+		lcDB: &loginChallengeValidator{
+			loginChallengeDB: &loginChallengeGorm{db},
+			hmac:             hmac,
+		},
+	}
+}
+
+type twoFactorService struct {
+	us   UserService
+	rcDB recoveryCodeDB
+	lcDB loginChallengeDB
+}
+
+func (tfs *twoFactorService) Initiate(user *User) error {
+	if user.TwoFactorEnabled() || user.TOTPSecret != "" {
+		return nil
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, nil
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotStarted
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrCodeInvalid
+	}
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	if err := tfs.us.Update(user); err != nil {
+		return nil, err
+	}
+	return tfs.NewRecoveryCodes(user)
+}
+
+func (tfs *twoFactorService) Disable(user *User) error {
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	if err := tfs.us.Update(user); err != nil {
+		return err
+	}
+	return tfs.rcDB.DeleteByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) NewRecoveryCodes(user *User) ([]string, error) {
+	if !user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err := tfs.rcDB.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		rc := recoveryCode{UserID: user.ID}
+		if err := tfs.rcDB.Create(&rc); err != nil {
+			return nil, err
+		}
+		codes[i] = rc.Code
+	}
+	return codes, nil
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(user *User) (int, error) {
+	return tfs.rcDB.CountByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) CreateChallenge(user *User, rememberMe bool) (string, error) {
+	lc := loginChallenge{UserID: user.ID, RememberMe: rememberMe}
+	if err := tfs.lcDB.Create(&lc); err != nil {
+		return "", err
+	}
+	return lc.Token, nil
+}
+
+func (tfs *twoFactorService) ChallengeUser(token string) (*User, error) {
+	lc, err := tfs.lcDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if lc.Expired() {
+		return nil, ErrTokenInvalid
+	}
+	return tfs.us.ByID(lc.UserID)
+}
+
+func (tfs *twoFactorService) CompleteChallenge(token, code string) (*User, bool, error) {
+	lc, err := tfs.lcDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, false, ErrTokenInvalid
+		}
+		return nil, false, err
+	}
+	if lc.Expired() {
+		tfs.lcDB.Delete(lc.ID)
+		return nil, false, ErrTokenInvalid
+	}
+	user, err := tfs.us.ByID(lc.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err := tfs.verify(user, code)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		lc.Attempts++
+		if lc.Attempts >= loginChallengeMaxAttempts {
+			tfs.lcDB.Delete(lc.ID)
+		} else if err := tfs.lcDB.Update(lc); err != nil {
+			return nil, false, err
+		}
+		return nil, false, ErrCodeInvalid
+	}
+	tfs.lcDB.Delete(lc.ID)
+	return user, lc.RememberMe, nil
+}
+
+// verify checks a code against the user's TOTP secret, and
+// then their recovery codes. TOTP codes can only be used
+// once, and recovery codes are deleted once they are used.
+func (tfs *twoFactorService) verify(user *User, code string) (bool, error) {
+	if !user.TwoFactorEnabled() {
+		return false, ErrTwoFactorNotEnabled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if ok {
+		if step <= user.TOTPLastStep {
+			// This code has already been used to sign in.
+			return false, nil
+		}
+		user.TOTPLastStep = step
+		return true, tfs.us.Update(user)
+	}
+	rc, err := tfs.rcDB.ByCode(user.ID, code)
+	switch err {
+	case nil:
+		return true, tfs.rcDB.Delete(rc.ID)
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// recoveryCode is a single use code that can be used in
+// place of a TOTP code if the user loses their device. We
+// only store the HMAC hash of each code.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Code      string `gorm:"-"`
+	CodeHash  string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+type recoveryCodeDB interface {
+	ByCode(userID uint, code string) (*recoveryCode, error)
+	CountByUserID(userID uint) (int, error)
+	Create(rc *recoveryCode) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+// ByCode will normalize the code and hash it with each of
+// our HMAC keys before passing it on to the database layer
+// to perform the query.
+func (rcv *recoveryCodeValidator) ByCode(userID uint, code string) (*recoveryCode, error) {
+	rc := recoveryCode{
+		UserID: userID,
+		Code:   code,
+	}
+	if err := runRecoveryCodeValFns(&rc, rcv.normalizeCode); err != nil {
+		return nil, err
+	}
+	if rc.Code == "" {
+		return nil, ErrNotFound
+	}
+	var found *recoveryCode
+	err := byHashes(rcv.hmac.HashAll(rc.Code), func(codeHash string) error {
+		var err error
+		found, err = rcv.recoveryCodeDB.ByCode(rc.UserID, codeHash)
+		return err
+	})
+	return found, err
+}
+
+func (rcv *recoveryCodeValidator) Create(rc *recoveryCode) error {
+	err := runRecoveryCodeValFns(rc,
+		rcv.requireUserID,
+		rcv.setCodeIfUnset,
+		rcv.hmacCode)
+	if err != nil {
+		return err
+	}
+	return rcv.recoveryCodeDB.Create(rc)
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+func (rcg *recoveryCodeGorm) ByCode(userID uint, codeHash string) (*recoveryCode, error) {
+	var rc recoveryCode
+	db := rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash)
+	if err := first(db, &rc); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (rcg *recoveryCodeGorm) CountByUserID(userID uint) (int, error) {
+	var count int
+	err := rcg.db.Model(&recoveryCode{}).Where("user_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+func (rcg *recoveryCodeGorm) Create(rc *recoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+func (rcg *recoveryCodeGorm) Delete(id uint) error {
+	rc := recoveryCode{ID: id}
+	return rcg.db.Delete(&rc).Error
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Where("user_id = ?", userID).Delete(recoveryCode{}).Error
+}
+
+type recoveryCodeValFn func(*recoveryCode) error
+
+func runRecoveryCodeValFns(rc *recoveryCode, fns ...recoveryCodeValFn) error {
+	for _, fn := range fns {
+		if err := fn(rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) requireUserID(rc *recoveryCode) error {
+	if rc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// setCodeIfUnset generates a code formatted in groups of
+// four characters, eg "abcd-efgh-ijkl-mnop", so it is easy
+// to write down.
+func (rcv *recoveryCodeValidator) setCodeIfUnset(rc *recoveryCode) error {
+	if rc.Code != "" {
+		return nil
+	}
+	b, err := rand.Bytes(recoveryCodeBytes)
+	if err != nil {
+		return err
+	}
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+	groups := make([]string, 0, len(code)/4)
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	rc.Code = strings.Join(groups, "-")
+	return nil
+}
+
+// normalizeCode lets users type recovery codes without the
+// dashes or in a different case.
+func (rcv *recoveryCodeValidator) normalizeCode(rc *recoveryCode) error {
+	code := strings.ToLower(rc.Code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	rc.Code = code
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) hmacCode(rc *recoveryCode) error {
+	if rc.Code == "" {
+		return nil
+	}
+	code := strings.Replace(rc.Code, "-", "", -1)
+	rc.CodeHash = rcv.hmac.Hash(code)
+	return nil
+}
+
+// loginChallenge represents a sign in that has passed the
+// password check but is still waiting on a two factor code.
+type loginChallenge struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	RememberMe bool   `gorm:"not null;default:false"`
+	Attempts   int
+	CreatedAt  time.Time
+}
+
+// Expired returns true if the challenge is too old to be used.
+func (lc *loginChallenge) Expired() bool {
+	return time.Now().Sub(lc.CreatedAt) > loginChallengeDuration
+}
+
+type loginChallengeDB interface {
+	ByToken(token string) (*loginChallenge, error)
+	Create(lc *loginChallenge) error
+	Update(lc *loginChallenge) error
+	Delete(id uint) error
+}
+
+type loginChallengeValidator struct {
+	loginChallengeDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the provided token with each of our
+// HMAC keys and pass the hashes on to the database layer
+// until a challenge is found.
+func (lcv *loginChallengeValidator) ByToken(token string) (*loginChallenge, error) {
+	var lc *loginChallenge
+	err := byHashes(lcv.hmac.HashAll(token), func(tokenHash string) error {
+		var err error
+		lc, err = lcv.loginChallengeDB.ByToken(tokenHash)
+		return err
+	})
+	return lc, err
+}
+
+func (lcv *loginChallengeValidator) Create(lc *loginChallenge) error {
+	err := runLoginChallengeValFns(lc,
+		lcv.requireUserID,
+		lcv.setTokenIfUnset,
+		lcv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return lcv.loginChallengeDB.Create(lc)
+}
+
+func (lcv *loginChallengeValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return lcv.loginChallengeDB.Delete(id)
+}
+
+type loginChallengeGorm struct {
+	db *gorm.DB
+}
+
+func (lcg *loginChallengeGorm) ByToken(tokenHash string) (*loginChallenge, error) {
+	var lc loginChallenge
+	err := first(lcg.db.Where("token_hash = ?", tokenHash), &lc)
+	if err != nil {
+		return nil, err
+	}
+	return &lc, nil
+}
+
+func (lcg *loginChallengeGorm) Create(lc *loginChallenge) error {
+	return lcg.db.Create(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Update(lc *loginChallenge) error {
+	return lcg.db.Save(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Delete(id uint) error {
+	lc := loginChallenge{ID: id}
+	return lcg.db.Delete(&lc).Error
+}
+
+type loginChallengeValFn func(*loginChallenge) error
+
+func runLoginChallengeValFns(lc *loginChallenge, fns ...loginChallengeValFn) error {
+	for _, fn := range fns {
+		if err := fn(lc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lcv *loginChallengeValidator) requireUserID(lc *loginChallenge) error {
+	if lc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (lcv *loginChallengeValidator) setTokenIfUnset(lc *loginChallenge) error {
+	if lc.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	lc.Token = token
+	return nil
+}
+
+func (lcv *loginChallengeValidator) hmacToken(lc *loginChallenge) error {
+	if lc.Token == "" {
+		return nil
+	}
+	lc.TokenHash = lcv.hmac.Hash(lc.Token)
+	return nil
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrUsernameRequired is returned when a user is updated without a username.
+	ErrUsernameRequired modelError = "models: username is required"
+
+	// ErrUsernameInvalid is returned when a username has characters we don't allow, or is too short or too long.
+	ErrUsernameInvalid modelError = "models: usernames must be 3 to 30 characters long, and can only use letters, numbers, and underscores"
+
+	// ErrUsernameReserved is returned when a user tries to use a username we keep for ourselves.
+	ErrUsernameReserved modelError = "models: that username is not available"
+
+	// ErrUsernameTaken is returned when a user tries to use a username somebody else already has.
+	ErrUsernameTaken modelError = "models: that username is already taken"
+
+	// ErrBioTooLong is returned when a user's bio is longer than MaxBioLength.
+	ErrBioTooLong modelError = "models: bio must be at most 500 characters long"
+)
+
+// MaxBioLength is the longest a user's bio can be, in
+// characters.
+const MaxBioLength = 500
+
+var usernameRegex = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
+// reservedUsernames can't be used by anyone, as they would be
+// confusing in a profile URL or could be mistaken for us.
+var reservedUsernames = map[string]bool{
+	"about":         true,
+	"account":       true,
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"assets":        true,
+	"auth":          true,
+	"contact":       true,
+	"faq":           true,
+	"galleries":     true,
+	"help":          true,
+	"images":        true,
+	"lenslocked":    true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"moderator":     true,
+	"new":           true,
+	"null":          true,
+	"root":          true,
+	"security":      true,
+	"settings":      true,
+	"signup":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// UsernameReserved returns true if nobody can use the
+// username.
+func UsernameReserved(username string) bool {
+	return reservedUsernames[username]
+}
+
+func (uv *userValidator) normalizeUsername(user *User) error {
+	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
+	return nil
+}
+
+// defaultUsername gives users who sign up without choosing a
+// username, eg with a provider, one based on their email
+// address. They can change it later.
+func (uv *userValidator) defaultUsername(user *User) error {
+	if user.Username != "" {
+		return nil
+	}
+	base := usernameBase(user.Email)
+	for i := 0; i < 10; i++ {
+		candidate := base
+		if i > 0 {
+			suffix, err := usernameSuffix()
+			if err != nil {
+				return err
+			}
+			candidate = base + suffix
+		}
+		_, err := uv.ByUsername(candidate)
+		if err == ErrNotFound {
+			user.Username = candidate
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ErrUsernameTaken
+}
+
+// usernameBase turns the local part of an email address into
+// something that can be used as a username.
+func usernameBase(email string) string {
+	local := strings.SplitN(strings.ToLower(email), "@", 2)[0]
+	var b strings.Builder
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		case r == '.' || r == '-' || r == '+':
+			b.WriteRune('_')
+		}
+	}
+	base := strings.Trim(b.String(), "_")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	if len(base) < 3 || UsernameReserved(base) {
+		base = "user"
+	}
+	return base
+}
+
+// usernameSuffix returns four random digits to tell apart
+// users whose usernames would otherwise be the same.
+func usernameSuffix() (string, error) {
+	b, err := rand.Bytes(2)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", binary.BigEndian.Uint16(b)%10000), nil
+}
+
+func (uv *userValidator) usernameRequired(user *User) error {
+	if user.Username == "" {
+		return ErrUsernameRequired
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameFormat(user *User) error {
+	if !usernameRegex.MatchString(user.Username) {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameNotReserved(user *User) error {
+	if UsernameReserved(user.Username) {
+		return ErrUsernameReserved
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameIsAvail(user *User) error {
+	existing, err := uv.ByUsername(user.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != existing.ID {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+func (uv *userValidator) normalizeBio(user *User) error {
+	user.Bio = strings.TrimSpace(user.Bio)
+	return nil
+}
+
+func (uv *userValidator) bioLength(user *User) error {
+	if len([]rune(user.Bio)) > MaxBioLength {
+		return ErrBioTooLong
+	}
+	return nil
+}
+
+// backfillUsernames gives users who signed up before we had
+// usernames one based on their ID, which can't clash with
+// anybody else's as nobody has been able to choose one yet.
+// They can change it from their account page.
+func (s *Services) backfillUsernames() error {
+	return s.db.Model(&User{}).
+		Where("username IS NULL OR username = ''").
+		UpdateColumn("username", gorm.Expr("'user' || id")).Error
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestUsernameBase(t *testing.T) {
+	tests := []struct {
+		email, want string
+	}{
+		{"jon@example.com", "jon"},
+		{"Jon.Calhoun@example.com", "jon_calhoun"},
+		{"jon+photos@example.com", "jon_photos"},
+		{"jo@example.com", "user"},
+		{"admin@example.com", "user"},
+		{"__x__@example.com", "user"},
+		{"averyveryveryverylongemailaddress@example.com", "averyveryveryverylongema"},
+	}
+	for _, tc := range tests {
+		got := usernameBase(tc.email)
+		if got != tc.want {
+			t.Errorf("usernameBase(%q) = %q; want %q", tc.email, got, tc.want)
+		}
+		if !usernameRegex.MatchString(got) {
+			t.Errorf("usernameBase(%q) = %q, which isn't a valid username", tc.email, got)
+		}
+	}
+}
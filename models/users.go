@@ -1,15 +1,16 @@
 package models
 
 import (
+	"log"
 	"regexp"
 	"strings"
+	"time"
+	"unicode"
 
 	"lenslocked.com/hash"
-	"lenslocked.com/rand"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -37,11 +38,20 @@ const (
 	// ErrPasswordRequired is returned when a create is attempted without a user password provided.
 	ErrPasswordRequired modelError = "models: password is required"
 
-	// ErrRememberRequired is returned when a create or update is attempted without a user remember token hash
+	// ErrRememberRequired is returned when a create or update is attempted without a session remember token hash
 	ErrRememberRequired modelError = "models: remember token is required"
 
 	// ErrRememberTooShort is returned when a remember token is not at least 32 bytes
 	ErrRememberTooShort modelError = "models: remember token must be at least 32 bytes"
+
+	// ErrTokenInvalid is returned when a password reset token is unknown, expired, or has already been used.
+	ErrTokenInvalid modelError = "models: token provided is not valid"
+
+	// ErrNameInvalid is returned when a user's name contains line breaks or other control characters.
+	ErrNameInvalid modelError = "models: name can't contain line breaks or other control characters"
+
+	// ErrAccountSuspended is returned when a suspended user tries to sign in.
+	ErrAccountSuspended modelError = "models: your account has been suspended. Please contact us if you think this is a mistake"
 )
 
 // UserDB is used to interact with the users database.
@@ -60,7 +70,16 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByUsername(username string) (*User, error)
+
+	// ByDeletionRequestedBefore returns every user who asked
+	// for their account to be deleted before t.
+	ByDeletionRequestedBefore(t time.Time) ([]User, error)
+
+	// Search returns up to limit users whose name, username,
+	// or email address contains query, oldest first. An empty
+	// query matches everyone.
+	Search(query string, limit int) ([]User, error)
 
 	// Methods for altering users
 	Create(user *User) error
@@ -70,12 +89,73 @@ type UserDB interface {
 
 type User struct {
 	gorm.Model
-	Name         string
-	Email        string `gorm:"not null;unique_index"`
-	Password     string `gorm:"-"`
-	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	Name            string
+	Username        string `gorm:"unique_index"`
+	Bio             string
+	Email           string `gorm:"not null;unique_index"`
+	EmailVerifiedAt *time.Time
+	PendingEmail    string
+	Password        string `gorm:"-"`
+	PasswordHash    string `gorm:"not null"`
+	PepperID        string
+	TOTPSecret      string
+	TOTPEnabledAt   *time.Time
+	TOTPLastStep    int64
+
+	// DeletionRequestedAt is set when the user asks us to
+	// delete their account. Nothing is deleted until the
+	// grace period is over, so they can change their mind.
+	DeletionRequestedAt *time.Time
+
+	Role Role `gorm:"not null;default:'user'"`
+
+	// SuspendedAt is set when a moderator suspends the user.
+	// Suspended users can't sign in until they are
+	// unsuspended.
+	SuspendedAt *time.Time
+
+	// AvatarUpdatedAt is set when the user uploads a picture,
+	// and is nil if they haven't.
+	AvatarUpdatedAt *time.Time
+
+	// InviteCode is only used when creating a user while sign
+	// ups are invite only. InviteID is the invite they used.
+	InviteCode string `gorm:"-"`
+	InviteID   uint   `gorm:"not null;default:0"`
+}
+
+// EmailVerified returns true if the user has confirmed that
+// they own their current email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// TwoFactorEnabled returns true if the user needs to provide
+// a TOTP code when they sign in.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// DeletionPending returns true if the user has asked for
+// their account to be deleted.
+func (u *User) DeletionPending() bool {
+	return u.DeletionRequestedAt != nil
+}
+
+// Suspended returns true if the user isn't allowed to sign
+// in.
+func (u *User) Suspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// PurgeAt returns when the user's account will be purged if
+// they don't cancel its deletion. It is only meaningful if
+// DeletionPending is true.
+func (u *User) PurgeAt() time.Time {
+	if u.DeletionRequestedAt == nil {
+		return time.Time{}
+	}
+	return u.DeletionRequestedAt.Add(AccountDeletionGracePeriod)
 }
 
 // UserService is a set of methods used to manipulate and
@@ -88,29 +168,110 @@ type UserService interface {
 	// ErrNotFound, ErrPasswordIncorrect, or another error if
 	// something goes wrong.
 	Authenticate(email, password string) (*User, error)
+
+	// InitiateReset will start the password reset process for
+	// the user with the provided email address and return the
+	// reset token that needs to be sent to them, or an error
+	// if there was one.
+	InitiateReset(email string) (string, error)
+
+	// CompleteReset will update the password of the user the
+	// token belongs to and then invalidate the token. The
+	// caller is responsible for revoking the user's existing
+	// sessions. If the token is unknown, expired, or has
+	// already been used ErrTokenInvalid will be returned, and
+	// if newPw is empty ErrPasswordRequired is returned
+	// without using up the token.
+	CompleteReset(token, newPw string) (*User, error)
+
+	// InitiateVerification will create a token that can be
+	// used to confirm the user owns their email address, or
+	// their pending email address if they are changing it.
+	InitiateVerification(user *User) (string, error)
+
+	// RequestEmailChange will validate the new email address
+	// and store it as the user's pending email address. The
+	// returned token needs to be sent to the new address, and
+	// the change won't take effect until it is verified. If
+	// the email address isn't changing an empty token is
+	// returned.
+	RequestEmailChange(user *User, email string) (string, error)
+
+	// ScheduleDeletion marks the user's account to be purged
+	// once the deletion grace period is over, if password is
+	// their current password. Otherwise ErrPasswordIncorrect
+	// is returned. The caller is responsible for revoking the
+	// user's sessions.
+	ScheduleDeletion(user *User, password string) error
+
+	// CancelDeletion undoes ScheduleDeletion, as long as the
+	// account hasn't been purged yet.
+	CancelDeletion(user *User) error
+
+	// ChangePassword will update the user's password if
+	// currentPw is their current password, otherwise
+	// ErrPasswordIncorrect is returned. The caller is
+	// responsible for revoking the user's other sessions.
+	ChangePassword(user *User, currentPw, newPw string) error
+
+	// CompleteVerification will mark the email address the
+	// token was sent to as verified, replacing the user's old
+	// address if it was a pending change. If the token is
+	// unknown, expired, or outdated ErrTokenInvalid will be
+	// returned.
+	CompleteVerification(token string) (*User, error)
+
+	// InitiateMagicLink creates a token for a passwordless
+	// sign in link that needs to be emailed to the user with
+	// the provided email address. If no user exists with that
+	// email address ErrNotFound will be returned.
+	InitiateMagicLink(email string, rememberMe bool) (string, error)
+
+	// CompleteMagicLink looks up the user a sign in link was
+	// created for and invalidates the link, so it can only be
+	// used once. It doesn't sign the user in, but it does tell
+	// the caller whether they asked to be remembered. If the
+	// token is unknown, expired, or has already been used
+	// ErrTokenInvalid will be returned.
+	CompleteMagicLink(token string) (user *User, rememberMe bool, err error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, peppers, hmacKeys hash.KeySet, passwords *hash.Passwords, registration RegistrationPolicy) UserService {
 	ug := &userGorm{db}
-	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	hmac := hash.NewHMAC(hmacKeys)
+	uv := newUserValidator(ug, passwords, peppers)
+	uv.registration = registration
+	uv.invites = newInviteValidator(&inviteGorm{db})
+	// We only ever compare passwords against this hash, so
+	// the password used to generate it doesn't matter.
+	dummyHash, _ := passwords.Hash("lenslocked")
 	return &userService{
-		UserDB: uv,
-		pepper: pepper,
+		UserDB:              uv,
+		peppers:             peppers,
+		passwords:           passwords,
+		dummyHash:           dummyHash,
+		pwResetDB:           newPwResetValidator(&pwResetGorm{db}, hmac),
+		emailVerificationDB: newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
+		magicLinkDB:         newMagicLinkValidator(&magicLinkGorm{db}, hmac),
 	}
 }
 
 type userService struct {
 	UserDB
-	pepper string
+	peppers             hash.KeySet
+	passwords           *hash.Passwords
+	dummyHash           string
+	pwResetDB           pwResetDB
+	emailVerificationDB emailVerificationDB
+	magicLinkDB         magicLinkDB
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, passwords *hash.Passwords, peppers hash.KeySet) *userValidator {
 	return &userValidator{
-		UserDB: udb,
-		hmac:   hmac,
-		pepper: pepper,
+		UserDB:    udb,
+		passwords: passwords,
+		peppers:   peppers,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 	}
@@ -121,24 +282,289 @@ func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator
 // If the password provided is invalid, this will return nil, ErrPasswordIncorrect
 // If the email and password are both valid, this will return user, nil
 // Otherwise if another error is encountered this will return nil, error
+//
+// If the user's password was hashed with an outdated algorithm,
+// cost, or pepper it is hashed again with the current ones.
 func (us *userService) Authenticate(email, password string) (*User, error) {
 
 	foundUser, err := us.ByEmail(email)
 
 	if err != nil {
+		if err == ErrNotFound {
+			// Compare against a throwaway hash so that looking up
+			// an email that doesn't exist takes as long as one that
+			// does, otherwise response times give away which email
+			// addresses have accounts.
+			_, pepper := us.peppers.ActiveKey()
+			us.passwords.Compare(us.dummyHash, password+pepper)
+		}
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+us.pepper))
+	rehash, err := us.comparePassword(foundUser, password)
 
 	switch err {
 	case nil:
-		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
+	case hash.ErrPasswordMismatch:
 		return nil, ErrPasswordIncorrect
 	default:
 		return nil, err
 	}
+
+	if rehash {
+		// Failing to upgrade the hash shouldn't stop the user
+		// from logging in, we'll just try again next time.
+		foundUser.Password = password
+		if err := us.Update(foundUser); err != nil {
+			log.Println("models: unable to rehash password:", err)
+		}
+	}
+	return foundUser, nil
+}
+
+// comparePassword checks the password against the user's
+// password hash using the pepper it was hashed with. Users
+// whose passwords were hashed before we recorded which
+// pepper was used are checked against each of our peppers.
+// If the password matches but wasn't peppered with the
+// active pepper, rehash will be true.
+func (us *userService) comparePassword(user *User, password string) (rehash bool, err error) {
+	ids := us.peppers.IDs()
+	if user.PepperID != "" {
+		if _, ok := us.peppers.Key(user.PepperID); !ok {
+			log.Printf("models: user %d has a password peppered with retired pepper %q", user.ID, user.PepperID)
+			return false, hash.ErrPasswordMismatch
+		}
+		ids = []string{user.PepperID}
+	}
+	for _, id := range ids {
+		pepper, _ := us.peppers.Key(id)
+		rehash, err = us.passwords.Compare(user.PasswordHash, password+pepper)
+		if err == hash.ErrPasswordMismatch {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return rehash || id != us.peppers.Active || user.PepperID != id, nil
+	}
+	return false, hash.ErrPasswordMismatch
+}
+
+// InitiateReset creates a new password reset token for the
+// user with the provided email address. If no user exists with
+// that email address ErrNotFound will be returned.
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	pwr := pwReset{
+		UserID: user.ID,
+	}
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return "", err
+	}
+	return pwr.Token, nil
+}
+
+// CompleteReset looks up the reset token and deletes it
+// before changing anything, so that if the same token is
+// used twice at once only one of the requests resets the
+// password. The new password is checked first, so that a
+// typo doesn't use up the token.
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	switch {
+	case newPw == "":
+		return nil, ErrPasswordRequired
+	case len(newPw) < 8:
+		return nil, ErrPasswordTooShort
+	}
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	err = us.pwResetDB.Delete(pwr.ID)
+	switch {
+	case err == ErrNotFound:
+		return nil, ErrTokenInvalid
+	case err != nil:
+		return nil, err
+	case pwr.Expired():
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(pwr.UserID)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = newPw
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// InitiateVerification creates a verification token for the
+// user's pending email address if they have one, otherwise
+// for their current email address.
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if user.PendingEmail != "" {
+		ev.Email = user.PendingEmail
+	}
+	if err := us.emailVerificationDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+// RequestEmailChange stores the new email address as the
+// user's pending email address and creates a token to verify
+// it. The user's current email address is left untouched.
+func (us *userService) RequestEmailChange(user *User, email string) (string, error) {
+	user.PendingEmail = email
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	if user.PendingEmail == "" {
+		return "", nil
+	}
+	return us.InitiateVerification(user)
+}
+
+func (us *userService) ScheduleDeletion(user *User, password string) error {
+	if _, err := us.comparePassword(user, password); err != nil {
+		if err == hash.ErrPasswordMismatch {
+			return ErrPasswordIncorrect
+		}
+		return err
+	}
+	now := time.Now()
+	user.DeletionRequestedAt = &now
+	return us.Update(user)
+}
+
+func (us *userService) CancelDeletion(user *User) error {
+	user.DeletionRequestedAt = nil
+	return us.Update(user)
+}
+
+func (us *userService) ChangePassword(user *User, currentPw, newPw string) error {
+	if _, err := us.comparePassword(user, currentPw); err != nil {
+		if err == hash.ErrPasswordMismatch {
+			return ErrPasswordIncorrect
+		}
+		return err
+	}
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
+	user.Password = newPw
+	return us.Update(user)
+}
+
+// CompleteVerification looks up the verification token and,
+// if it is still valid, marks the address it was sent to as
+// verified. The token is deleted so it can't be reused.
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.emailVerificationDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if ev.Expired() {
+		us.emailVerificationDB.Delete(ev.ID)
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+	switch ev.Email {
+	case user.PendingEmail:
+		user.Email = user.PendingEmail
+		user.PendingEmail = ""
+	case user.Email:
+	default:
+		// The user has changed their email address since
+		// this token was sent.
+		us.emailVerificationDB.Delete(ev.ID)
+		return nil, ErrTokenInvalid
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	us.emailVerificationDB.Delete(ev.ID)
+	return user, nil
+}
+
+// InitiateMagicLink creates a new sign in link token for the
+// user with the provided email address.
+func (us *userService) InitiateMagicLink(email string, rememberMe bool) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	ml := magicLink{
+		UserID:     user.ID,
+		Email:      user.Email,
+		RememberMe: rememberMe,
+	}
+	if err := us.magicLinkDB.Create(&ml); err != nil {
+		return "", err
+	}
+	return ml.Token, nil
+}
+
+// CompleteMagicLink looks up the sign in link and deletes it
+// before anything else, so that if the same link is used
+// twice at once only one of the requests gets the user.
+// Following the link proves the user can read email sent to
+// their address, so it is marked as verified as well.
+func (us *userService) CompleteMagicLink(token string) (*User, bool, error) {
+	ml, err := us.magicLinkDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, false, ErrTokenInvalid
+		}
+		return nil, false, err
+	}
+	err = us.magicLinkDB.Delete(ml.ID)
+	switch {
+	case err == ErrNotFound:
+		return nil, false, ErrTokenInvalid
+	case err != nil:
+		return nil, false, err
+	case ml.Expired():
+		return nil, false, ErrTokenInvalid
+	}
+	user, err := us.ByID(ml.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	if user.Email != ml.Email {
+		// The user has changed their email address since
+		// this link was sent.
+		return nil, false, ErrTokenInvalid
+	}
+	if !user.EmailVerified() {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		if err := us.Update(user); err != nil {
+			return nil, false, err
+		}
+	}
+	return user, ml.RememberMe, nil
 }
 
 // userGorm represents our database interaction layer
@@ -180,16 +606,33 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember looks up a user with the given remember token
-// and returns that user. This method expects the remember
-// token to already be hashed.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
+func (ug *userGorm) ByUsername(username string) (*User, error) {
 	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
-	if err != nil {
+	db := ug.db.Where("username = ?", username)
+	err := first(db, &user)
+	return &user, err
+}
+
+func (ug *userGorm) ByDeletionRequestedBefore(t time.Time) ([]User, error) {
+	var users []User
+	db := ug.db.Where("deletion_requested_at < ?", t)
+	if err := db.Find(&users).Error; err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return users, nil
+}
+
+func (ug *userGorm) Search(query string, limit int) ([]User, error) {
+	var users []User
+	db := ug.db.Order("id").Limit(limit)
+	if query != "" {
+		pattern := likePattern(query)
+		db = db.Where("name ILIKE ? OR username ILIKE ? OR email ILIKE ?", pattern, pattern, pattern)
+	}
+	if err := db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
 // Create will create the provided user and backfill data
@@ -210,6 +653,28 @@ func (ug *userGorm) Delete(id uint) error {
 	return ug.db.Delete(&user).Error
 }
 
+// byHashes calls find with each of the hashes in turn until
+// one of them doesn't return ErrNotFound. This is used to look
+// things up by a token that may have been hashed with any of
+// our HMAC keys.
+func byHashes(hashes []string, find func(hash string) error) error {
+	for _, h := range hashes {
+		err := find(h)
+		if err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// likePattern returns a LIKE pattern that matches anything
+// containing s. Wildcards in s are escaped so that they only
+// match themselves.
+func likePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + r.Replace(s) + "%"
+}
+
 // first will query using the provided gorm.DB and it will
 // get the first item returned and place it into dst. If
 // nothing is found in the query, it will return ErrNotFound
@@ -226,9 +691,11 @@ func first(db *gorm.DB, dst interface{}) error {
 // UserDB in our interface chain.
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
-	emailRegex *regexp.Regexp
-	pepper     string
+	passwords    *hash.Passwords
+	emailRegex   *regexp.Regexp
+	peppers      hash.KeySet
+	registration RegistrationPolicy
+	invites      InviteDB
 }
 
 // ByEmail will normalize an email address before passing
@@ -244,14 +711,23 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-func (uv *userValidator) ByRemember(token string) (*User, error) {
+// ByUsername will normalize a username before passing it
+// on to the database layer to perform the query.
+func (uv *userValidator) ByUsername(username string) (*User, error) {
 	user := User{
-		Remember: token,
+		Username: username,
 	}
-	if err := runUserValFns(&user, uv.hmacRemember); err != nil {
+	err := runUserValFns(&user, uv.normalizeUsername)
+	if err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByRemember(user.RememberHash)
+	return uv.UserDB.ByUsername(user.Username)
+}
+
+// Search trims the query so stray whitespace doesn't stop
+// it matching anything.
+func (uv *userValidator) Search(query string, limit int) ([]User, error) {
+	return uv.UserDB.Search(strings.TrimSpace(query), limit)
 }
 
 // Create will create the provided user and backfill data
@@ -260,35 +736,58 @@ func (uv *userValidator) Create(user *User) error {
 	err := runUserValFns(user,
 		uv.passwordRequired,
 		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.hashPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.emailDomainAllowed,
+		uv.nameValid,
+		uv.normalizeUsername,
+		uv.defaultUsername,
+		uv.usernameFormat,
+		uv.usernameNotReserved,
+		uv.usernameIsAvail,
+		uv.normalizeBio,
+		uv.bioLength,
+		uv.defaultRole,
+		uv.roleValid,
+		uv.claimInvite)
 	if err != nil {
 		return err
 	}
-	return uv.UserDB.Create(user)
+	if err := uv.UserDB.Create(user); err != nil {
+		uv.releaseInvite(user)
+		return err
+	}
+	return nil
 }
 
-// Update will hash a remember token if it is provided.
+// Update will hash a password if it is provided.
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFns(user,
 		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.hashPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizePendingEmail,
+		uv.pendingEmailFormat,
+		uv.pendingEmailIsAvail,
+		uv.pendingEmailDomainAllowed,
+		uv.nameValid,
+		uv.normalizeUsername,
+		uv.usernameRequired,
+		uv.usernameFormat,
+		uv.usernameNotReserved,
+		uv.usernameIsAvail,
+		uv.normalizeBio,
+		uv.bioLength,
+		uv.defaultRole,
+		uv.roleValid)
 	if err != nil {
 		return err
 	}
@@ -317,9 +816,11 @@ func runUserValFns(user *User, fns ...userValFn) error {
 
 type userValFn func(*User) error
 
-// bcryptPassword will hash a user's password with an
-// app-wide pepper and bcrypt, which salts for us.
-func (uv *userValidator) bcryptPassword(user *User) error {
+// hashPassword will hash a user's password with the active
+// app-wide pepper and our current password hashing
+// algorithm, which salts for us. The ID of the pepper is
+// stored so we know which one to use when checking it.
+func (uv *userValidator) hashPassword(user *User) error {
 
 	if user.Password == "" {
 		// We DO NOT need to run this if the password
@@ -327,37 +828,17 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 		return nil
 	}
 
-	pwBytes := []byte(user.Password + uv.pepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes,
-		bcrypt.DefaultCost)
+	pepperID, pepper := uv.peppers.ActiveKey()
+	hashed, err := uv.passwords.Hash(user.Password + pepper)
 	if err != nil {
 		return err
 	}
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hashed
+	user.PepperID = pepperID
 	user.Password = ""
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
 func (uv *userValidator) idGreaterThan(n uint) userValFn {
 	return userValFn(func(user *User) error {
 		if user.ID <= n {
@@ -413,6 +894,52 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
+// normalizePendingEmail normalizes a pending email address
+// the same way we normalize email addresses, and clears it
+// if it matches the user's current email address.
+func (uv *userValidator) normalizePendingEmail(user *User) error {
+	user.PendingEmail = strings.ToLower(user.PendingEmail)
+	user.PendingEmail = strings.TrimSpace(user.PendingEmail)
+	if user.PendingEmail == user.Email {
+		user.PendingEmail = ""
+	}
+	return nil
+}
+
+func (uv *userValidator) pendingEmailFormat(user *User) error {
+	if user.PendingEmail == "" {
+		return nil
+	}
+	if !uv.emailRegex.MatchString(user.PendingEmail) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) pendingEmailIsAvail(user *User) error {
+	if user.PendingEmail == "" {
+		return nil
+	}
+	_, err := uv.ByEmail(user.PendingEmail)
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return ErrEmailTaken
+	default:
+		return err
+	}
+}
+
+// nameValid makes sure the user's name is safe to put in
+// the subject of an email we send on their behalf.
+func (uv *userValidator) nameValid(user *User) error {
+	if strings.IndexFunc(user.Name, unicode.IsControl) >= 0 {
+		return ErrNameInvalid
+	}
+	return nil
+}
+
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -437,25 +964,70 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
+// defaultRole gives users who don't have a role yet the
+// least powerful one.
+func (uv *userValidator) defaultRole(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	return nil
+}
+
+func (uv *userValidator) roleValid(user *User) error {
+	if !user.Role.Valid() {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) emailDomainAllowed(user *User) error {
+	if !uv.registration.EmailAllowed(user.Email) {
+		return ErrEmailDomainNotAllowed
+	}
+	return nil
+}
+
+// pendingEmailDomainAllowed stops users from getting around
+// the allowed domains by changing their email address once
+// they have signed up.
+func (uv *userValidator) pendingEmailDomainAllowed(user *User) error {
+	if user.PendingEmail == "" {
+		return nil
+	}
+	if !uv.registration.EmailAllowed(user.PendingEmail) {
+		return ErrEmailDomainNotAllowed
+	}
+	return nil
+}
+
+// claimInvite uses up one use of the user's invite while sign
+// ups are invite only. It needs to run last, so that a user
+// who fails any other validation doesn't use up the invite.
+func (uv *userValidator) claimInvite(user *User) error {
+	if !uv.registration.InviteRequired() {
 		return nil
 	}
-	n, err := rand.NBytes(user.Remember)
+	if strings.TrimSpace(user.InviteCode) == "" {
+		return ErrInviteRequired
+	}
+	invite, err := uv.invites.Claim(user.InviteCode)
 	if err != nil {
 		return err
 	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
+	user.InviteID = invite.ID
 	return nil
 }
 
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
+// releaseInvite gives back the use claimed by claimInvite
+// when the user couldn't be created after all.
+func (uv *userValidator) releaseInvite(user *User) {
+	if user.InviteID == 0 {
+		return
 	}
-	return nil
+	if err := uv.invites.Release(user.InviteID); err != nil {
+		log.Printf("models: releasing invite %d: %v", user.InviteID, err)
+	}
+	user.InviteID = 0
 }
 
 type modelError string
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/hash"
+)
+
+// unusedPwResetDB fails the test if a reset token is looked
+// up at all.
+type unusedPwResetDB struct {
+	pwResetDB
+	t *testing.T
+}
+
+func (db unusedPwResetDB) ByToken(token string) (*pwReset, error) {
+	db.t.Fatal("ByToken called; want the token left alone")
+	return nil, nil
+}
+
+func TestCompleteResetRequiresPassword(t *testing.T) {
+	us := &userService{pwResetDB: unusedPwResetDB{t: t}}
+	if _, err := us.CompleteReset("token", ""); err != ErrPasswordRequired {
+		t.Errorf("CompleteReset(empty password) err = %v; want %v", err, ErrPasswordRequired)
+	}
+	if _, err := us.CompleteReset("token", "short"); err != ErrPasswordTooShort {
+		t.Errorf("CompleteReset(short password) err = %v; want %v", err, ErrPasswordTooShort)
+	}
+}
+
+// memPwResetDB holds a single reset. Like the real database,
+// deleting it a second time returns ErrNotFound.
+type memPwResetDB struct {
+	mu      sync.Mutex
+	reset   pwReset
+	deleted bool
+}
+
+func (db *memPwResetDB) ByToken(token string) (*pwReset, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if token != db.reset.Token {
+		return nil, ErrNotFound
+	}
+	pwr := db.reset
+	return &pwr, nil
+}
+
+func (db *memPwResetDB) Create(pwr *pwReset) error {
+	return nil
+}
+
+func (db *memPwResetDB) Delete(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.deleted {
+		return ErrNotFound
+	}
+	db.deleted = true
+	return nil
+}
+
+// memUserDB counts how many times its one user is updated.
+type memUserDB struct {
+	UserDB
+	mu      sync.Mutex
+	updates int
+}
+
+func (db *memUserDB) ByID(id uint) (*User, error) {
+	return &User{Model: gorm.Model{ID: id}}, nil
+}
+
+func (db *memUserDB) Update(user *User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.updates++
+	return nil
+}
+
+func TestCompleteResetSingleUse(t *testing.T) {
+	udb := &memUserDB{}
+	us := &userService{
+		UserDB: udb,
+		pwResetDB: &memPwResetDB{reset: pwReset{
+			ID:        1,
+			UserID:    1,
+			Token:     "token",
+			CreatedAt: time.Now(),
+		}},
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = us.CompleteReset("token", "new password")
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+		case ErrTokenInvalid:
+		default:
+			t.Errorf("CompleteReset() err = %v; want nil or %v", err, ErrTokenInvalid)
+		}
+	}
+	if succeeded != 1 || udb.updates != 1 {
+		t.Errorf("CompleteReset() succeeded %d times with %d updates; want 1", succeeded, udb.updates)
+	}
+}
+
+func TestCompleteResetExpired(t *testing.T) {
+	udb := &memUserDB{}
+	us := &userService{
+		UserDB: udb,
+		pwResetDB: &memPwResetDB{reset: pwReset{
+			ID:        1,
+			UserID:    1,
+			Token:     "token",
+			CreatedAt: time.Now().Add(-2 * pwResetDuration),
+		}},
+	}
+	if _, err := us.CompleteReset("token", "new password"); err != ErrTokenInvalid {
+		t.Errorf("CompleteReset(expired) err = %v; want %v", err, ErrTokenInvalid)
+	}
+	if udb.updates != 0 {
+		t.Errorf("CompleteReset(expired) updated the user %d times; want 0", udb.updates)
+	}
+}
+
+// authUserDB holds one user, who can be looked up by email,
+// and remembers the last update made to them.
+type authUserDB struct {
+	UserDB
+	user    User
+	updated *User
+}
+
+func (db *authUserDB) ByEmail(email string) (*User, error) {
+	if email != db.user.Email {
+		return nil, ErrNotFound
+	}
+	user := db.user
+	return &user, nil
+}
+
+func (db *authUserDB) Update(user *User) error {
+	db.updated = user
+	return nil
+}
+
+func TestAuthenticateRehash(t *testing.T) {
+	weakBcrypt := hash.Bcrypt{Cost: bcrypt.MinCost}
+	argon := hash.Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}
+	oldHash, _ := weakBcrypt.Hash("password" + "pepper")
+	newHash, _ := argon.Hash("password" + "pepper")
+
+	tests := []struct {
+		hash   string
+		rehash bool
+		name   string
+	}{
+		{oldHash, true, "old algorithm"},
+		{newHash, false, "current algorithm"},
+	}
+	for _, tc := range tests {
+		db := &authUserDB{user: User{
+			Email:        "jon@example.com",
+			PasswordHash: tc.hash,
+			PepperID:     hash.DefaultKeyID,
+		}}
+		us := &userService{
+			UserDB:    db,
+			peppers:   hash.SingleKey("pepper"),
+			passwords: hash.NewPasswords(argon, weakBcrypt),
+		}
+		if _, err := us.Authenticate("jon@example.com", "password"); err != nil {
+			t.Fatalf("Authenticate(%s) err = %v", tc.name, err)
+		}
+		// The validator is what hashes the password, so all we
+		// can see here is that it was handed the password.
+		rehashed := db.updated != nil && db.updated.Password == "password"
+		if rehashed != tc.rehash {
+			t.Errorf("Authenticate(%s) rehashed = %v; want %v", tc.name, rehashed, tc.rehash)
+		}
+	}
+	db := &authUserDB{user: User{Email: "jon@example.com", PasswordHash: oldHash}}
+	us := &userService{
+		UserDB:    db,
+		peppers:   hash.SingleKey("pepper"),
+		passwords: hash.NewPasswords(argon, weakBcrypt),
+	}
+	if _, err := us.Authenticate("jon@example.com", "wrong"); err != ErrPasswordIncorrect {
+		t.Errorf("Authenticate(wrong password) err = %v; want %v", err, ErrPasswordIncorrect)
+	}
+	if db.updated != nil {
+		t.Errorf("Authenticate(wrong password) updated the user; want no update")
+	}
+}
+
+func TestNameValid(t *testing.T) {
+	uv := &userValidator{}
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"", nil},
+		{"Jon Calhoun", nil},
+		{"Zoë", nil},
+		{"Jon\r\nBcc: victim@example.com", ErrNameInvalid},
+		{"Jon\x00", ErrNameInvalid},
+		{"Jon\tCalhoun", ErrNameInvalid},
+	}
+	for _, tc := range tests {
+		if err := uv.nameValid(&User{Name: tc.name}); err != tc.want {
+			t.Errorf("nameValid(%q) = %v; want %v", tc.name, err, tc.want)
+		}
+	}
+}
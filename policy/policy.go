@@ -0,0 +1,126 @@
+// Package policy decides what users are allowed to do to
+// each other and to each other's galleries. Controllers ask
+// it rather than comparing user IDs and roles themselves, so
+// the rules live in one place.
+package policy
+
+import "lenslocked.com/models"
+
+// hasGalleryRole returns true if the user owns the gallery,
+// or it has been shared with them with at least the role.
+// The gallery's Collaborators need to have been loaded for
+// anyone other than the owner to have a role.
+func hasGalleryRole(user *models.User, gallery *models.Gallery, role models.CollaboratorRole) bool {
+	if user == nil {
+		return false
+	}
+	if gallery.UserID == user.ID {
+		return true
+	}
+	c := gallery.Collaborator(user.ID)
+	return c != nil && c.Role.AtLeast(role)
+}
+
+// IsGalleryMember returns true if the user owns the gallery
+// or it has been shared with them. Members can download its
+// images, and never need to enter its password.
+func IsGalleryMember(user *models.User, gallery *models.Gallery) bool {
+	return hasGalleryRole(user, gallery, models.CollaboratorViewer)
+}
+
+// CanViewGallery returns true if the user can see the gallery
+// and its images. Anyone can see public galleries, but only
+// their owner and the people they are shared with can see
+// the others. Unlisted galleries can also be seen with their
+// key, which isn't up to the policy as it doesn't depend on
+// who the user is.
+func CanViewGallery(user *models.User, gallery *models.Gallery) bool {
+	return gallery.Visibility == models.VisibilityPublic || IsGalleryMember(user, gallery)
+}
+
+// CanUploadImages returns true if the user can add images to
+// the gallery, which contributors can.
+func CanUploadImages(user *models.User, gallery *models.Gallery) bool {
+	return hasGalleryRole(user, gallery, models.CollaboratorContributor)
+}
+
+// CanRenameGallery returns true if the user can change the
+// gallery's title and details, like its description and
+// cover image, which editors can.
+func CanRenameGallery(user *models.User, gallery *models.Gallery) bool {
+	return hasGalleryRole(user, gallery, models.CollaboratorEditor)
+}
+
+// CanDeleteImages returns true if the user can delete the
+// gallery's images, which editors can.
+func CanDeleteImages(user *models.User, gallery *models.Gallery) bool {
+	return hasGalleryRole(user, gallery, models.CollaboratorEditor)
+}
+
+// CanEditGallery returns true if the user can change the
+// gallery's settings, like its visibility, password, share
+// links and collaborators. Only its owner and co-owners can.
+func CanEditGallery(user *models.User, gallery *models.Gallery) bool {
+	return hasGalleryRole(user, gallery, models.CollaboratorCoOwner)
+}
+
+// CanDeleteGallery returns true if the user can delete the
+// gallery. Only its owner can, not even co-owners, but
+// moderators can take down anyone's gallery.
+func CanDeleteGallery(user *models.User, gallery *models.Gallery) bool {
+	return (user != nil && gallery.UserID == user.ID) || CanModerate(user)
+}
+
+// CanModerate returns true if the user can use the admin
+// area to look up users and take down galleries.
+func CanModerate(user *models.User) bool {
+	return user != nil && user.HasRole(models.RoleModerator)
+}
+
+// UserInviteUses is the most times an invite created by
+// somebody other than an admin can be used.
+const UserInviteUses = 5
+
+// InviteUseLimit returns the most times an invite created by
+// the user can be used, or 0 if there is no limit. Admins can
+// create invites for as many people as they like.
+func InviteUseLimit(user *models.User) int {
+	if user != nil && user.HasRole(models.RoleAdmin) {
+		return 0
+	}
+	return UserInviteUses
+}
+
+// CanViewAuditLog returns true if the user can see everyone's
+// audit events. Only admins can, as the log includes what
+// moderators have done.
+func CanViewAuditLog(user *models.User) bool {
+	return user != nil && user.HasRole(models.RoleAdmin)
+}
+
+// CanSuspend returns true if actor can suspend or unsuspend
+// target. Moderators can only suspend people with a less
+// powerful role than theirs, so they can't lock each other,
+// or the admins, out.
+func CanSuspend(actor, target *models.User) bool {
+	return CanModerate(actor) && actor.ID != target.ID &&
+		actor.Role.Outranks(target.Role)
+}
+
+// CanChangeRole returns true if actor can change target's
+// role. Only admins can, and never their own, so there is
+// always at least one admin left.
+func CanChangeRole(actor, target *models.User) bool {
+	return actor != nil && actor.HasRole(models.RoleAdmin) &&
+		actor.ID != target.ID
+}
+
+// CanImpersonate returns true if actor can sign in as
+// target. Only admins can, and only as people with a less
+// powerful role, so impersonation can't be used to gain
+// powers the admin doesn't already have.
+func CanImpersonate(actor, target *models.User) bool {
+	return actor != nil && actor.HasRole(models.RoleAdmin) &&
+		actor.ID != target.ID && actor.Role.Outranks(target.Role) &&
+		!target.Suspended()
+}
@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/models"
+)
+
+func user(id uint, role models.Role) *models.User {
+	return &models.User{Model: gorm.Model{ID: id}, Role: role}
+}
+
+func TestGalleryPolicies(t *testing.T) {
+	owner := user(1, models.RoleUser)
+	other := user(2, models.RoleUser)
+	mod := user(3, models.RoleModerator)
+	admin := user(4, models.RoleAdmin)
+	gallery := &models.Gallery{UserID: owner.ID, Visibility: models.VisibilityPrivate}
+	public := &models.Gallery{UserID: owner.ID, Visibility: models.VisibilityPublic}
+
+	tests := []struct {
+		user      *models.User
+		edit, del bool
+		name      string
+	}{
+		{owner, true, true, "owner"},
+		{other, false, false, "other user"},
+		{mod, false, true, "moderator"},
+		{admin, false, true, "admin"},
+		{nil, false, false, "signed out"},
+	}
+	for _, tc := range tests {
+		if got := CanViewGallery(tc.user, gallery); got != tc.edit {
+			t.Errorf("CanViewGallery(%s, private) = %v; want %v", tc.name, got, tc.edit)
+		}
+		if !CanViewGallery(tc.user, public) {
+			t.Errorf("CanViewGallery(%s, public) = false; want true", tc.name)
+		}
+		if got := CanEditGallery(tc.user, gallery); got != tc.edit {
+			t.Errorf("CanEditGallery(%s) = %v; want %v", tc.name, got, tc.edit)
+		}
+		if got := CanDeleteGallery(tc.user, gallery); got != tc.del {
+			t.Errorf("CanDeleteGallery(%s) = %v; want %v", tc.name, got, tc.del)
+		}
+	}
+}
+
+func TestGalleryCollaboratorPolicies(t *testing.T) {
+	owner := user(1, models.RoleUser)
+	now := time.Now()
+	gallery := &models.Gallery{UserID: owner.ID, Visibility: models.VisibilityPrivate}
+	var members []*models.User
+	for i, role := range models.CollaboratorRoles {
+		member := user(uint(10+i), models.RoleUser)
+		members = append(members, member)
+		gallery.Collaborators = append(gallery.Collaborators, models.Collaborator{
+			GalleryID:  1,
+			UserID:     member.ID,
+			Role:       role,
+			AcceptedAt: &now,
+		})
+	}
+	// Invitations that haven't been accepted don't count.
+	invited := user(20, models.RoleUser)
+	gallery.Collaborators = append(gallery.Collaborators, models.Collaborator{
+		GalleryID: 1,
+		Email:     "invited@example.com",
+		Role:      models.CollaboratorCoOwner,
+	})
+
+	tests := []struct {
+		user                            *models.User
+		view, upload, rename, edit, del bool
+		name                            string
+	}{
+		{owner, true, true, true, true, true, "owner"},
+		{members[0], true, false, false, false, false, "viewer"},
+		{members[1], true, true, false, false, false, "contributor"},
+		{members[2], true, true, true, false, false, "editor"},
+		{members[3], true, true, true, true, false, "co-owner"},
+		{invited, false, false, false, false, false, "invited"},
+		{nil, false, false, false, false, false, "signed out"},
+	}
+	for _, tc := range tests {
+		if got := CanViewGallery(tc.user, gallery); got != tc.view {
+			t.Errorf("CanViewGallery(%s) = %v; want %v", tc.name, got, tc.view)
+		}
+		if got := IsGalleryMember(tc.user, gallery); got != tc.view {
+			t.Errorf("IsGalleryMember(%s) = %v; want %v", tc.name, got, tc.view)
+		}
+		if got := CanUploadImages(tc.user, gallery); got != tc.upload {
+			t.Errorf("CanUploadImages(%s) = %v; want %v", tc.name, got, tc.upload)
+		}
+		if got := CanRenameGallery(tc.user, gallery); got != tc.rename {
+			t.Errorf("CanRenameGallery(%s) = %v; want %v", tc.name, got, tc.rename)
+		}
+		if got := CanDeleteImages(tc.user, gallery); got != tc.rename {
+			t.Errorf("CanDeleteImages(%s) = %v; want %v", tc.name, got, tc.rename)
+		}
+		if got := CanEditGallery(tc.user, gallery); got != tc.edit {
+			t.Errorf("CanEditGallery(%s) = %v; want %v", tc.name, got, tc.edit)
+		}
+		if got := CanDeleteGallery(tc.user, gallery); got != tc.del {
+			t.Errorf("CanDeleteGallery(%s) = %v; want %v", tc.name, got, tc.del)
+		}
+	}
+}
+
+func TestUserPolicies(t *testing.T) {
+	regular := user(1, models.RoleUser)
+	mod := user(2, models.RoleModerator)
+	otherMod := user(3, models.RoleModerator)
+	admin := user(4, models.RoleAdmin)
+	otherAdmin := user(5, models.RoleAdmin)
+	now := time.Now()
+	suspended := user(6, models.RoleUser)
+	suspended.SuspendedAt = &now
+
+	tests := []struct {
+		name                       string
+		actor, target              *models.User
+		suspend, role, impersonate bool
+	}{
+		{"user on user", regular, suspended, false, false, false},
+		{"moderator on user", mod, regular, true, false, false},
+		{"moderator on moderator", mod, otherMod, false, false, false},
+		{"moderator on admin", mod, admin, false, false, false},
+		{"admin on user", admin, regular, true, true, true},
+		{"admin on moderator", admin, mod, true, true, true},
+		{"admin on admin", admin, otherAdmin, false, true, false},
+		{"admin on suspended user", admin, suspended, true, true, false},
+		{"admin on themselves", admin, admin, false, false, false},
+	}
+	for _, tc := range tests {
+		if got := CanSuspend(tc.actor, tc.target); got != tc.suspend {
+			t.Errorf("%s: CanSuspend() = %v; want %v", tc.name, got, tc.suspend)
+		}
+		if got := CanChangeRole(tc.actor, tc.target); got != tc.role {
+			t.Errorf("%s: CanChangeRole() = %v; want %v", tc.name, got, tc.role)
+		}
+		if got := CanImpersonate(tc.actor, tc.target); got != tc.impersonate {
+			t.Errorf("%s: CanImpersonate() = %v; want %v", tc.name, got, tc.impersonate)
+		}
+	}
+}
+
+func TestAdminAreaPolicies(t *testing.T) {
+	tests := []struct {
+		name            string
+		user            *models.User
+		moderate, audit bool
+	}{
+		{"user", user(1, models.RoleUser), false, false},
+		{"moderator", user(2, models.RoleModerator), true, false},
+		{"admin", user(3, models.RoleAdmin), true, true},
+		{"signed out", nil, false, false},
+	}
+	for _, tc := range tests {
+		if got := CanModerate(tc.user); got != tc.moderate {
+			t.Errorf("CanModerate(%s) = %v; want %v", tc.name, got, tc.moderate)
+		}
+		if got := CanViewAuditLog(tc.user); got != tc.audit {
+			t.Errorf("CanViewAuditLog(%s) = %v; want %v", tc.name, got, tc.audit)
+		}
+	}
+}
+
+func TestInviteUseLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		user *models.User
+		want int
+	}{
+		{"user", user(1, models.RoleUser), UserInviteUses},
+		{"moderator", user(2, models.RoleModerator), UserInviteUses},
+		{"admin", user(3, models.RoleAdmin), 0},
+	}
+	for _, tc := range tests {
+		if got := InviteUseLimit(tc.user); got != tc.want {
+			t.Errorf("InviteUseLimit(%s) = %d; want %d", tc.name, got, tc.want)
+		}
+	}
+}
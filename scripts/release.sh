@@ -23,6 +23,8 @@ echo "  Code uploaded successfully!"
 echo "  Go getting deps..."
 ssh root@142.93.86.14 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get golang.org/x/crypto/bcrypt"
+ssh root@142.93.86.14 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get golang.org/x/crypto/argon2"
 ssh root@142.93.86.14 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get github.com/gorilla/mux"
 ssh root@142.93.86.14 "export GOPATH=/root/go; \
@@ -33,6 +35,12 @@ ssh root@142.93.86.14 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get github.com/jinzhu/gorm"
 ssh root@142.93.86.14 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get github.com/gorilla/csrf"
+ssh root@142.93.86.14 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/skip2/go-qrcode"
+ssh root@142.93.86.14 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/coreos/go-oidc/v3/oidc"
+ssh root@142.93.86.14 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get golang.org/x/oauth2"
 
 echo "  Building the code on remote server..."
 ssh root@142.93.86.14 'export GOPATH=/root/go; \
@@ -0,0 +1,172 @@
+// Package sso lets users sign in with any OpenID Connect
+// provider, using the authorization code flow with PKCE.
+//
+// Providers are discovered from their issuer URL the first
+// time they are used, so the app still starts if a provider
+// is down, and tests can point a provider at a local mock
+// server.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"lenslocked.com/rand"
+)
+
+var (
+	// ErrNonceMismatch is returned when the ID token wasn't
+	// issued for the sign in we started.
+	ErrNonceMismatch = errors.New("sso: ID token nonce doesn't match")
+
+	// ErrNoIDToken is returned when the provider doesn't give
+	// us an ID token along with the access token.
+	ErrNoIDToken = errors.New("sso: no ID token in the token response")
+)
+
+// ProviderConfig describes a single OpenID Connect provider.
+// Name is used in our URLs, eg "google" results in the
+// redirect URL "<base_url>/auth/google/callback", which needs
+// to be registered with the provider.
+type ProviderConfig struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// NewProvider returns a Provider that redirects users back to
+// redirectURL once they have signed in.
+func NewProvider(cfg ProviderConfig, redirectURL string) *Provider {
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	return &Provider{
+		Name:        cfg.Name,
+		DisplayName: cfg.DisplayName,
+		issuer:      cfg.Issuer,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+	}
+}
+
+// Provider is an OpenID Connect provider that users can sign
+// in with. It is safe for concurrent use.
+type Provider struct {
+	Name        string
+	DisplayName string
+
+	issuer string
+
+	mu       sync.Mutex
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// AuthRequest holds the values we generate when starting a
+// sign in. They need to be kept by the user's browser until
+// the provider sends the user back to us.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// Claims are the parts of the ID token that we care about.
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// discover fetches the provider's configuration the first
+// time it is needed. Failures aren't cached, so a provider
+// that was down will be retried on the next sign in.
+func (p *Provider) discover(ctx context.Context) (oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier == nil {
+		// The provider keeps using this context to refresh its
+		// keys, so it can't be tied to the current request.
+		provider, err := oidc.NewProvider(context.WithoutCancel(ctx), p.issuer)
+		if err != nil {
+			return oauth2.Config{}, nil, fmt.Errorf("sso: discovering %s: %w", p.Name, err)
+		}
+		p.oauth.Endpoint = provider.Endpoint()
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.oauth.ClientID})
+	}
+	return p.oauth, p.verifier, nil
+}
+
+// AuthCodeURL returns the URL to send the user to in order
+// to start a sign in. The AuthRequest needs to be held on to
+// until they come back.
+func (p *Provider) AuthCodeURL(ctx context.Context, ar AuthRequest) (string, error) {
+	cfg, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return cfg.AuthCodeURL(ar.State,
+		oidc.Nonce(ar.Nonce),
+		oauth2.S256ChallengeOption(ar.Verifier)), nil
+}
+
+// Exchange finishes a sign in by trading the code for tokens
+// and verifying the ID token. The caller is responsible for
+// checking the state param before calling Exchange.
+func (p *Provider) Exchange(ctx context.Context, ar AuthRequest, code string) (*Claims, error) {
+	cfg, verifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(ar.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("sso: exchanging code with %s: %w", p.Name, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrNoIDToken
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("sso: verifying %s ID token: %w", p.Name, err)
+	}
+	if idToken.Nonce != ar.Nonce {
+		return nil, ErrNonceMismatch
+	}
+	var claims Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// NewAuthRequest generates a new random state, nonce, and
+// PKCE verifier for a sign in.
+func NewAuthRequest() (AuthRequest, error) {
+	state, err := rand.String(32)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+	nonce, err := rand.String(32)
+	if err != nil {
+		return AuthRequest{}, err
+	}
+	return AuthRequest{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+	}, nil
+}
@@ -0,0 +1,245 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOIDC is a tiny OpenID Connect provider. Its authorize
+// endpoint signs everyone in as the same user straight away,
+// and its token endpoint enforces PKCE.
+type mockOIDC struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuth
+}
+
+type mockAuth struct {
+	challenge string
+	nonce     string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{t: t, key: key, codes: make(map[string]mockAuth)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/keys", m.keys)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDC) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockOIDC) keys(w http.ResponseWriter, r *http.Request) {
+	pub := m.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   b64(pub.N.Bytes()),
+			"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockOIDC) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE is required", http.StatusBadRequest)
+		return
+	}
+	code := "code-" + q.Get("state")
+	m.mu.Lock()
+	m.codes[code] = mockAuth{
+		challenge: q.Get("code_challenge"),
+		nonce:     q.Get("nonce"),
+	}
+	m.mu.Unlock()
+	v := url.Values{}
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	auth, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || b64(sum[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token": m.idToken(map[string]interface{}{
+			"iss":            m.URL,
+			"aud":            "client",
+			"sub":            "user-123",
+			"email":          "jon@example.com",
+			"email_verified": true,
+			"name":           "Jon Calhoun",
+			"nonce":          auth.nonce,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}),
+	})
+}
+
+func (m *mockOIDC) idToken(claims map[string]interface{}) string {
+	header := b64([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	signingInput := header + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signingInput + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// authorize follows the provider's authorize step like a
+// browser would, and returns the code it sends us back with.
+func authorize(t *testing.T, p *Provider, ar AuthRequest) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), ar)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() err = %v", err)
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), "http://localhost:3000/auth/mock/callback") {
+		t.Fatalf("redirected to %q; want our callback", loc)
+	}
+	if got := loc.Query().Get("state"); got != ar.State {
+		t.Fatalf("state = %q; want %q", got, ar.State)
+	}
+	return loc.Query().Get("code")
+}
+
+func newTestProvider(m *mockOIDC) *Provider {
+	return NewProvider(ProviderConfig{
+		Name:         "mock",
+		DisplayName:  "Mock",
+		Issuer:       m.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+	}, "http://localhost:3000/auth/mock/callback")
+}
+
+func TestProviderSignIn(t *testing.T) {
+	m := newMockOIDC(t)
+	p := newTestProvider(m)
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, ar)
+
+	claims, err := p.Exchange(context.Background(), ar, code)
+	if err != nil {
+		t.Fatalf("Exchange() err = %v", err)
+	}
+	want := Claims{
+		Subject:       "user-123",
+		Email:         "jon@example.com",
+		EmailVerified: true,
+		Name:          "Jon Calhoun",
+	}
+	if *claims != want {
+		t.Errorf("Exchange() = %+v; want %+v", *claims, want)
+	}
+}
+
+func TestProviderWrongVerifier(t *testing.T) {
+	m := newMockOIDC(t)
+	p := newTestProvider(m)
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, ar)
+
+	other, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.Verifier = other.Verifier
+	if _, err := p.Exchange(context.Background(), ar, code); err == nil {
+		t.Error("Exchange() err = nil; want an error for the wrong PKCE verifier")
+	}
+}
+
+func TestProviderWrongNonce(t *testing.T) {
+	m := newMockOIDC(t)
+	p := newTestProvider(m)
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, ar)
+
+	ar.Nonce = "not-the-nonce"
+	if _, err := p.Exchange(context.Background(), ar, code); err != ErrNonceMismatch {
+		t.Errorf("Exchange() err = %v; want %v", err, ErrNonceMismatch)
+	}
+}
@@ -0,0 +1,144 @@
+// Package throttle slows down repeated failures, like
+// someone guessing passwords, using exponential backoff and
+// a temporary lockout once too many attempts have failed.
+package throttle
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Config describes how quickly a Limiter backs off.
+type Config struct {
+	// Name is used when logging lockouts, eg "login ip"
+	Name string
+
+	// Free is how many failures are allowed before we start
+	// making the caller wait between attempts.
+	Free int
+
+	// BaseDelay is the wait after the first failure beyond
+	// Free. Each failure after that doubles the wait, up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// LockoutAfter is the number of failures that results in
+	// a lockout, which lasts for LockoutFor.
+	LockoutAfter int
+	LockoutFor   time.Duration
+
+	// Window is how long we remember failures for. A key that
+	// hasn't failed for this long starts over from scratch.
+	Window time.Duration
+}
+
+// New returns a Limiter that uses the provided config.
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// Limiter tracks failures by key. It is safe for concurrent
+// use. Everything is kept in memory, so restarting the
+// server resets all limits.
+type Limiter struct {
+	cfg       Config
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+
+	// now is replaced in tests so they don't need to sleep.
+	now func() time.Time
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Wait returns how long the caller needs to wait before key
+// is allowed another attempt. A zero duration means the
+// attempt is allowed right away.
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	e, ok := l.entries[key]
+	if !ok || now.After(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Fail records a failed attempt for key and returns true if
+// this failure resulted in the key being locked out.
+func (l *Limiter) Fail(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > l.cfg.Window {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	if l.cfg.LockoutAfter > 0 && e.failures >= l.cfg.LockoutAfter {
+		e.blockedUntil = now.Add(l.cfg.LockoutFor)
+		if e.failures == l.cfg.LockoutAfter {
+			log.Printf("throttle: %s %q locked out for %s after %d failed attempts",
+				l.cfg.Name, key, l.cfg.LockoutFor, e.failures)
+			return true
+		}
+		return false
+	}
+	if e.failures > l.cfg.Free {
+		e.blockedUntil = now.Add(l.delay(e.failures - l.cfg.Free))
+	}
+	return false
+}
+
+// Reset forgets all failures for key, eg after a successful
+// login.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// delay returns the backoff for the nth failure beyond the
+// free ones.
+func (l *Limiter) delay(n int) time.Duration {
+	d := l.cfg.BaseDelay
+	for i := 1; i < n; i++ {
+		d *= 2
+		if d >= l.cfg.MaxDelay {
+			return l.cfg.MaxDelay
+		}
+	}
+	return d
+}
+
+// sweep removes entries we no longer need to remember so
+// that the map doesn't grow forever. It only does the work
+// once per Window.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.Window {
+		return
+	}
+	l.lastSweep = now
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > l.cfg.Window && now.After(e.blockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
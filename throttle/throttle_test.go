@@ -0,0 +1,122 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake clock that only moves when told to.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newLimiter(cfg Config) (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1000000000, 0)}
+	l := New(cfg)
+	l.now = c.now
+	return l, c
+}
+
+var testConfig = Config{
+	Name:         "test",
+	Free:         2,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Second,
+	LockoutAfter: 8,
+	LockoutFor:   time.Minute,
+	Window:       time.Hour,
+}
+
+func TestBackoff(t *testing.T) {
+	l, _ := newLimiter(testConfig)
+	// The clock never moves, so each wait is the full delay
+	// after that many failures.
+	want := []time.Duration{
+		0, 0, // free
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second, // capped at MaxDelay
+	}
+	for i, w := range want {
+		if l.Fail("key") {
+			t.Errorf("Fail() #%d locked out; want no lockout yet", i+1)
+		}
+		if got := l.Wait("key"); got != w {
+			t.Errorf("Wait() after %d failures = %s; want %s", i+1, got, w)
+		}
+	}
+	if got := l.Wait("other"); got != 0 {
+		t.Errorf("Wait(other key) = %s; want 0", got)
+	}
+}
+
+func TestWaitElapses(t *testing.T) {
+	l, c := newLimiter(testConfig)
+	for i := 0; i < 4; i++ {
+		l.Fail("key")
+	}
+	c.t = c.t.Add(time.Second)
+	if got := l.Wait("key"); got != time.Second {
+		t.Errorf("Wait() = %s; want 1s", got)
+	}
+	c.t = c.t.Add(time.Second + time.Nanosecond)
+	if got := l.Wait("key"); got != 0 {
+		t.Errorf("Wait() once the delay is over = %s; want 0", got)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l, c := newLimiter(testConfig)
+	for i := 1; i < testConfig.LockoutAfter; i++ {
+		l.Fail("key")
+	}
+	if !l.Fail("key") {
+		t.Fatalf("Fail() #%d = false; want a lockout", testConfig.LockoutAfter)
+	}
+	if got := l.Wait("key"); got != time.Minute {
+		t.Errorf("Wait() when locked out = %s; want 1m0s", got)
+	}
+	// Only the failure that caused the lockout reports it,
+	// but any more failures push it back.
+	c.t = c.t.Add(30 * time.Second)
+	if l.Fail("key") {
+		t.Errorf("Fail() while locked out = true; want false")
+	}
+	if got := l.Wait("key"); got != time.Minute {
+		t.Errorf("Wait() after failing while locked out = %s; want 1m0s", got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	l, c := newLimiter(testConfig)
+	for i := 0; i < 3; i++ {
+		l.Fail("key")
+	}
+	// Once the window has passed without a failure the key
+	// starts over, so the next failure is a free one.
+	c.t = c.t.Add(testConfig.Window + time.Second)
+	l.Fail("key")
+	if got := l.Wait("key"); got != 0 {
+		t.Errorf("Wait() after the window = %s; want 0", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	l, _ := newLimiter(testConfig)
+	for i := 0; i < testConfig.LockoutAfter; i++ {
+		l.Fail("key")
+	}
+	l.Reset("key")
+	if got := l.Wait("key"); got != 0 {
+		t.Errorf("Wait() after Reset = %s; want 0", got)
+	}
+	l.Fail("key")
+	if got := l.Wait("key"); got != 0 {
+		t.Errorf("Wait() after Reset and one failure = %s; want 0", got)
+	}
+}
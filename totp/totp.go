@@ -0,0 +1,115 @@
+// Package totp implements the time-based one-time passwords
+// described in RFC 6238, using the defaults that every
+// authenticator app understands: HMAC-SHA1, 6 digits and a
+// 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"lenslocked.com/rand"
+)
+
+const (
+	// SecretBytes is the size of the secrets we generate. RFC
+	// 4226 recommends 160 bits, which matches HMAC-SHA1.
+	SecretBytes = 20
+
+	// Period is how many seconds each code is valid for.
+	Period = 30
+
+	// Digits is the number of digits in each code.
+	Digits = 6
+
+	// Skew is the number of periods before or after the
+	// current one that we will still accept codes from, to
+	// allow for clocks that are a little off.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded
+// so that it can be typed into an authenticator app.
+func GenerateSecret() (string, error) {
+	b, err := rand.Bytes(SecretBytes)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI builds the otpauth:// URI that authenticator apps use
+// to enroll a secret, usually by scanning it as a QR code.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", Digits))
+	v.Set("period", fmt.Sprintf("%d", Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// Step returns the time step that t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for the given secret and time step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, as described in RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, bin%mod), nil
+}
+
+// Validate checks the code against the secret at time t,
+// allowing for Skew. If the code is valid the time step it
+// matched is returned so that callers can refuse to accept
+// the same code twice.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,82 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret from RFC 6238 appendix B,
+// "12345678901234567890", base32 encoded.
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The RFC's codes have 8 digits, and ours are the last 6
+	// of them.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code(%d) err = %v", tc.unix, err)
+		}
+		if got != tc.want {
+			t.Errorf("Code(%d) = %s; want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-Skew - 1, false},
+		{-Skew, true},
+		{0, true},
+		{Skew, true},
+		{Skew + 1, false},
+	}
+	for _, tc := range tests {
+		code, err := Code(rfcSecret, step+tc.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Validate(rfcSecret, code, now)
+		if ok != tc.ok {
+			t.Errorf("Validate(step %+d) ok = %v; want %v", tc.offset, ok, tc.ok)
+		}
+		if ok && got != step+tc.offset {
+			t.Errorf("Validate(step %+d) step = %d; want %d", tc.offset, got, step+tc.offset)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{"287082", true},
+		{" 287 082 ", true},
+		{"28708", false},
+		{"94287082", false},
+		{"000000", false},
+	}
+	for _, tc := range tests {
+		if _, ok := Validate(rfcSecret, tc.code, now); ok != tc.ok {
+			t.Errorf("Validate(%q) ok = %v; want %v", tc.code, ok, tc.ok)
+		}
+	}
+}
@@ -24,6 +24,10 @@ type Data struct {
 	Alert *Alert
 	User  *models.User
 	Yield interface{}
+
+	// Impersonating is true when an admin is signed in as
+	// User, so we can remind them and let them stop.
+	Impersonating bool
 }
 
 func (d *Data) AlertError(msg string) {
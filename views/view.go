@@ -12,6 +12,7 @@ import (
 
 	"github.com/gorilla/csrf"
 	"lenslocked.com/context"
+	"lenslocked.com/markdown"
 )
 
 var (
@@ -63,6 +64,7 @@ func NewView(layout string, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"markdown": markdown.Render,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -97,6 +99,9 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	}
 
 	vd.User = context.User(r.Context())
+	if session := context.Session(r.Context()); session != nil {
+		vd.Impersonating = session.Impersonated()
+	}
 	var buf bytes.Buffer
 	csrfField := csrf.TemplateField(r)
 	tpl := v.Template.Funcs(template.FuncMap{